@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/dkim"
+	"github.com/grafana/smtprelay/v2/internal/dmarc"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/spf"
+	"github.com/grafana/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// authResolver looks up the DNS records needed to verify inbound messages. It
+// is satisfied by *net.Resolver.
+type authResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// resolver used for inbound verification - overridable for tests
+var defaultAuthResolver authResolver = net.DefaultResolver
+
+// inbound_verify policies
+const (
+	verifyNone     = "none"     // don't verify inbound messages
+	verifyAnnotate = "annotate" // add an Authentication-Results header
+	verifyTempfail = "tempfail" // also defer messages failing verification
+	verifyReject   = "reject"   // also reject messages failing verification
+)
+
+var (
+	errAuthTemporary = &textproto.Error{Code: 451, Msg: "4.4.3 Could not verify the sender. Try again later."}
+	errAuthDeferred  = &textproto.Error{Code: 451, Msg: "4.7.1 Message failed sender authentication. Try again later."}
+	errAuthRejected  = &textproto.Error{Code: 550, Msg: "5.7.1 Message failed sender authentication"}
+)
+
+func validateInboundVerify(policy string) error {
+	switch policy {
+	case verifyNone, verifyAnnotate, verifyTempfail, verifyReject:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy %q", policy)
+	}
+}
+
+// authResults are the results of the verification of an inbound message.
+type authResults struct {
+	spf         spf.Result
+	spfProperty string // the identity checked by SPF, like smtp.mailfrom=bob@example.com
+	dkim        []dkim.Result
+	dmarc       dmarc.Result
+}
+
+// authenticate checks the SPF record of the sender domain, the DKIM
+// signatures of the message, and the DMARC policy of its From domain.
+func (r *relay) authenticate(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) *authResults {
+	res := &authResults{spfProperty: "smtp.mailfrom=" + env.Sender}
+	if env.Sender == "" {
+		res.spfProperty = "smtp.helo=" + peer.HeloName
+	}
+
+	var ip net.IP
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	result, spfDomain, _ := spf.Check(ctx, r.resolver, ip, env.Sender, peer.HeloName)
+	res.spf = result
+
+	res.dkim = dkim.Verify(ctx, env.Reader(), r.resolver.LookupTXT, time.Now())
+
+	ids := dmarc.Identifiers{}
+	if res.spf == spf.Pass {
+		ids.SPF = spfDomain
+	}
+
+	for _, d := range res.dkim {
+		if d.Status == dkim.StatusPass {
+			ids.DKIM = append(ids.DKIM, d.Domain)
+		}
+	}
+
+	from, err := fromDomain(env.Header)
+	if err != nil {
+		res.dmarc = dmarc.Result{Status: dmarc.StatusPermError, Err: fmt.Errorf("no valid From header: %w", err)}
+	} else {
+		res.dmarc = dmarc.Check(ctx, r.resolver.LookupTXT, from, ids)
+	}
+
+	return res
+}
+
+// dkimStatuses returns the status of each signature, or none if the message
+// isn't signed.
+func (a *authResults) dkimStatuses() []string {
+	if len(a.dkim) == 0 {
+		return []string{string(dkim.StatusNone)}
+	}
+
+	statuses := []string{}
+	for _, d := range a.dkim {
+		statuses = append(statuses, string(d.Status))
+	}
+
+	return statuses
+}
+
+// header returns the value of an Authentication-Results header field
+// (RFC 8601) with the results, folded.
+func (a *authResults) header(authservID string) string {
+	b := strings.Builder{}
+
+	fmt.Fprintf(&b, "%s;\r\n\tspf=%s %s", authValue(authservID), a.spf, authValue(a.spfProperty))
+
+	if len(a.dkim) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+
+	for _, d := range a.dkim {
+		fmt.Fprintf(&b, ";\r\n\tdkim=%s", d.Status)
+
+		if d.Domain != "" {
+			fmt.Fprintf(&b, " header.d=%s", authValue(d.Domain))
+		}
+
+		if d.Selector != "" {
+			fmt.Fprintf(&b, " header.s=%s", authValue(d.Selector))
+		}
+	}
+
+	fmt.Fprintf(&b, ";\r\n\tdmarc=%s", a.dmarc.Status)
+
+	if a.dmarc.Domain != "" {
+		fmt.Fprintf(&b, " header.from=%s", authValue(a.dmarc.Domain))
+	}
+
+	return b.String()
+}
+
+// verdict tells whether the message failed verification, or couldn't be
+// verified for now. Messages fail when their From domain has a DMARC policy
+// of quarantine or reject which they don't pass, or when their sender domain
+// has no DMARC policy and its SPF record fails the sending host.
+func (a *authResults) verdict() (failed, temporary bool) {
+	if a.dmarc.Status == dmarc.StatusPass {
+		return false, false
+	}
+
+	if a.spf == spf.TempError || a.dmarc.Status == dmarc.StatusTempError {
+		return false, true
+	}
+
+	for _, d := range a.dkim {
+		if d.Status == dkim.StatusTempError {
+			return false, true
+		}
+	}
+
+	switch a.dmarc.Status {
+	case dmarc.StatusFail:
+		return a.dmarc.Policy == dmarc.PolicyQuarantine || a.dmarc.Policy == dmarc.PolicyReject, false
+	case dmarc.StatusNone:
+		return a.spf == spf.Fail, false
+	default:
+		return false, false
+	}
+}
+
+// verifyInbound verifies the message according to inbound_verify: it adds an
+// Authentication-Results header to the message, and returns an error when the
+// message should be deferred or rejected.
+func (r *relay) verifyInbound(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) *textproto.Error {
+	policy := r.cfg.inboundVerify
+	if policy == "" || policy == verifyNone {
+		return nil
+	}
+
+	res := r.authenticate(ctx, peer, env)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		traceutil.AuthSPF(string(res.spf)),
+		traceutil.AuthDKIM(res.dkimStatuses()),
+		traceutil.AuthDMARC(string(res.dmarc.Status)),
+	)
+
+	logger := slog.With(slog.String("component", "inbound_verify"))
+	logger.DebugContext(ctx, "inbound message verified",
+		slog.String("spf", string(res.spf)),
+		slog.Any("dkim", res.dkimStatuses()),
+		slog.String("dmarc", string(res.dmarc.Status)),
+		slog.Any("dmarc_error", res.dmarc.Err),
+	)
+
+	// results claiming to be ours can't be trusted
+	env.RewriteHeader(func(key, value string) (string, bool) {
+		return value, !isAuthResults(key, value, r.cfg.hostName)
+	})
+
+	env.AddHeader("Authentication-Results", res.header(r.cfg.hostName))
+
+	if policy == verifyAnnotate {
+		return nil
+	}
+
+	failed, temporary := res.verdict()
+
+	switch {
+	case temporary:
+		logger.WarnContext(ctx, "could not verify sender, deferring message")
+		return errAuthTemporary
+	case !failed:
+		return nil
+	case policy == verifyTempfail:
+		logger.WarnContext(ctx, "sender verification failed, deferring message", slog.Any("dmarc_error", res.dmarc.Err))
+		return errAuthDeferred
+	default:
+		logger.WarnContext(ctx, "sender verification failed, rejecting message", slog.Any("dmarc_error", res.dmarc.Err))
+		return errAuthRejected
+	}
+}
+
+// isAuthResults reports whether a header field is an Authentication-Results
+// field with the given authserv-id.
+func isAuthResults(key, value, authservID string) bool {
+	if key != "Authentication-Results" {
+		return false
+	}
+
+	id, _, _ := strings.Cut(value, ";")
+
+	fields := strings.Fields(id)
+
+	return len(fields) > 0 && strings.EqualFold(fields[0], authservID)
+}
+
+// authValue strips the characters which can't appear in an unquoted value of
+// an Authentication-Results header.
+func authValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f || strings.ContainsRune(`;()"\`, r) {
+			return -1
+		}
+
+		return r
+	}, s)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/dkim"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyInbound(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":               {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"_dmarc.example.com":        {"v=DMARC1; p=reject"},
+			"s1._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+			"nodmarc.example":           {"v=spf1 -all"},
+		},
+		temporary: map[string]bool{"tempfail.example": true},
+	}
+
+	good := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25}
+	bad := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 25}
+
+	unsigned := "From: Bob <bob@example.com>\r\nSubject: hello\r\n\r\nhello\r\n"
+
+	header, err := dkim.Sign(strings.NewReader(unsigned), &dkim.Key{Domain: "example.com", Selector: "s1", Signer: priv}, dkim.DefaultHeaders, time.Now())
+	require.NoError(t, err)
+
+	signed := header + unsigned
+
+	for _, tc := range []struct {
+		name   string
+		policy string
+		addr   net.Addr
+		sender string
+		data   string
+		want   *textproto.Error
+		header []string
+	}{
+		{
+			name: "spf aligned", policy: verifyReject, addr: good, sender: "bob@example.com", data: unsigned,
+			header: []string{"Authentication-Results: relay.example.org;\r\n\tspf=pass smtp.mailfrom=bob@example.com;\r\n\tdkim=none;\r\n\tdmarc=pass header.from=example.com\r\n"},
+		},
+		{
+			name: "dkim aligned", policy: verifyReject, addr: bad, sender: "bob@example.com", data: signed,
+			header: []string{"spf=fail", "dkim=pass header.d=example.com header.s=s1", "dmarc=pass"},
+		},
+		{
+			name: "dmarc fail", policy: verifyReject, addr: bad, sender: "bob@example.com", data: unsigned,
+			want: errAuthRejected,
+		},
+		{
+			name: "dmarc fail deferred", policy: verifyTempfail, addr: bad, sender: "bob@example.com", data: unsigned,
+			want: errAuthDeferred,
+		},
+		{
+			name: "dmarc fail annotated", policy: verifyAnnotate, addr: bad, sender: "bob@example.com", data: unsigned,
+			header: []string{"spf=fail", "dmarc=fail"},
+		},
+		{
+			name: "spf fail without dmarc", policy: verifyReject, addr: good, sender: "bob@nodmarc.example",
+			data: "From: bob@nodmarc.example\r\n\r\nhello\r\n", want: errAuthRejected,
+		},
+		{
+			name: "null sender", policy: verifyReject, addr: good, sender: "",
+			data:   "From: bob@nodmarc.example\r\n\r\nhello\r\n",
+			header: []string{"spf=none smtp.helo=client.example", "dmarc=none header.from=nodmarc.example"},
+		},
+		{
+			name: "temporary", policy: verifyReject, addr: good, sender: "bob@tempfail.example",
+			data: "From: bob@tempfail.example\r\n\r\nhello\r\n", want: errAuthTemporary,
+		},
+	} {
+		r := &relay{cfg: &config{hostName: "relay.example.org", inboundVerify: tc.policy}, resolver: resolver}
+		env := testEnvelope(tc.sender, nil, tc.data)
+
+		tperr := r.verifyInbound(ctx, smtpd.Peer{Addr: tc.addr, HeloName: "client.example"}, env)
+		if tc.want != nil {
+			assert.Equal(t, tc.want, tperr, tc.name)
+			continue
+		}
+
+		require.Nil(t, tperr, tc.name)
+		data := envelopeData(t, env)
+		require.True(t, strings.HasPrefix(data, "Authentication-Results: relay.example.org;"), tc.name)
+		assert.True(t, strings.HasSuffix(data, tc.data), tc.name)
+
+		for _, h := range tc.header {
+			assert.Contains(t, data, h, tc.name)
+		}
+	}
+
+	// messages aren't verified by default
+	r := &relay{cfg: &config{}, resolver: resolver}
+	env := testEnvelope("bob@example.com", nil, unsigned)
+	require.Nil(t, r.verifyInbound(ctx, smtpd.Peer{Addr: bad}, env))
+	assert.Equal(t, unsigned, envelopeData(t, env))
+}
+
+func TestIsAuthResults(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isAuthResults("Authentication-Results", "Relay.Example.org; spf=pass", "relay.example.org"))
+	assert.True(t, isAuthResults("Authentication-Results", "relay.example.org 1; dkim=pass", "relay.example.org"))
+	assert.True(t, isAuthResults("Authentication-Results", "relay.example.org; none", "relay.example.org"))
+	assert.False(t, isAuthResults("Authentication-Results", "mx.example.net; dmarc=pass", "relay.example.org"))
+	assert.False(t, isAuthResults("X-Authentication-Results", "relay.example.org; none", "relay.example.org"))
+}
+
+func TestValidateInboundVerify(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []string{verifyNone, verifyAnnotate, verifyTempfail, verifyReject} {
+		require.NoError(t, validateInboundVerify(policy))
+	}
+
+	require.Error(t, validateInboundVerify("quarantine"))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+)
+
+var errCircuitOpen = &textproto.Error{Code: 451, Msg: "4.4.1 Upstream unavailable, try again later"}
+
+// circuitState is the state of a circuit breaker, as reported by the
+// circuit_breaker_state gauge.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops relaying messages while deliveries keep failing, so
+// clients are told right away to try again later instead of waiting for
+// timeouts. The circuit opens after maxFailures consecutive failures within
+// window. After cooldown, it's half-open: the next message is let through as
+// a probe, and closes the circuit if delivered, or opens it again if not.
+type circuitBreaker struct {
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu         sync.Mutex
+	state      circuitState
+	failures   int
+	firstFail  time.Time // of the consecutive failures
+	openedAt   time.Time
+	probeSince time.Time // zero unless a probe is in progress
+}
+
+// validateCircuitBreaker checks the circuit breaker settings.
+func validateCircuitBreaker(cfg *config) error {
+	if cfg.circuitBreakerFailures <= 0 {
+		return nil
+	}
+
+	// spooled messages are accepted regardless, and retried from the spool
+	if cfg.spoolDir != "" {
+		return errors.New("circuit_breaker_failures can't be used with spool_dir")
+	}
+
+	if cfg.circuitBreakerWindow <= 0 {
+		return errors.New("circuit_breaker_window must be positive")
+	}
+
+	if cfg.circuitBreakerCooldown <= 0 {
+		return errors.New("circuit_breaker_cooldown must be positive")
+	}
+
+	return nil
+}
+
+// newCircuitBreaker returns a circuit breaker for the circuit_breaker_*
+// settings, or nil if it's disabled.
+func newCircuitBreaker(cfg *config) *circuitBreaker {
+	if cfg.circuitBreakerFailures <= 0 {
+		return nil
+	}
+
+	circuitBreakerState.Set(float64(circuitClosed))
+
+	return &circuitBreaker{
+		maxFailures: cfg.circuitBreakerFailures,
+		window:      cfg.circuitBreakerWindow,
+		cooldown:    cfg.circuitBreakerCooldown,
+	}
+}
+
+// allow reports whether a message can be relayed. While the circuit is
+// half-open, a single message is allowed at a time, as a probe; a probe
+// whose outcome isn't known after cooldown (the client may have given up)
+// is replaced with another one.
+func (b *circuitBreaker) allow(ctx context.Context, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.setState(ctx, circuitHalfOpen)
+	case circuitHalfOpen:
+		if !b.probeSince.IsZero() && now.Sub(b.probeSince) < b.cooldown {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.probeSince = now
+
+	return true
+}
+
+// record records the outcome of a delivery.
+func (b *circuitBreaker) record(ctx context.Context, now time.Time, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !deliveryFailed(err) {
+		b.failures = 0
+
+		if b.state != circuitClosed {
+			b.probeSince = time.Time{}
+			b.setState(ctx, circuitClosed)
+		}
+
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFail) > b.window {
+		b.failures = 0
+		b.firstFail = now
+	}
+
+	b.failures++
+
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.maxFailures) {
+		b.openedAt = now
+		b.probeSince = time.Time{}
+		b.setState(ctx, circuitOpen)
+	}
+}
+
+// circuitChecker wraps a sender checker, deferring the messages of allowed
+// senders while the circuit is open.
+func (r *relay) circuitChecker(next func(ctx context.Context, peer smtpd.Peer, addr string) error) func(ctx context.Context, peer smtpd.Peer, addr string) error {
+	if r.breaker == nil {
+		return next
+	}
+
+	return func(ctx context.Context, peer smtpd.Peer, addr string) error {
+		if err := next(ctx, peer, addr); err != nil {
+			return err
+		}
+
+		if !r.breaker.allow(ctx, time.Now()) {
+			slog.WarnContext(ctx, "circuit open, deferring message",
+				slog.String("component", "circuit_breaker"), slog.String("sender_address", addr))
+
+			return observeErr(ctx, errCircuitOpen)
+		}
+
+		return nil
+	}
+}
+
+func (b *circuitBreaker) setState(ctx context.Context, state circuitState) {
+	logger := slog.With(slog.String("component", "circuit_breaker"), slog.String("state", state.String()))
+
+	switch state {
+	case circuitOpen:
+		logger.ErrorContext(ctx, "circuit opened, deferring messages",
+			slog.Int("consecutive_failures", b.failures), slog.Duration("cooldown", b.cooldown))
+	case circuitHalfOpen:
+		logger.InfoContext(ctx, "circuit half-open, probing with the next message")
+	default:
+		logger.InfoContext(ctx, "circuit closed, relaying messages again")
+	}
+
+	b.state = state
+	circuitBreakerState.Set(float64(state))
+}
+
+// deliveryFailed reports whether a delivery error means the upstreams are
+// failing: they couldn't be reached or used, or replied they're unavailable.
+// Other replies, and deliveries to some of the recipients, show they're up.
+func deliveryFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var rerr *recipientsError
+	if errors.As(err, &rerr) && rerr.partial() {
+		return false
+	}
+
+	var uerr *upstreamError
+	if errors.As(err, &uerr) {
+		return true
+	}
+
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) {
+		return tperr.Code == 421
+	}
+
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	b := newCircuitBreaker(&config{circuitBreakerFailures: 3, circuitBreakerWindow: time.Minute, circuitBreakerCooldown: 10 * time.Second})
+	require.NotNil(t, b)
+
+	down := &upstreamError{addr: "smtp.example.com:25", err: errors.New("connection refused")}
+	now := time.Now()
+
+	// failures spread over more than the window don't open the circuit
+	b.record(ctx, now, down)
+	b.record(ctx, now.Add(30*time.Second), down)
+	b.record(ctx, now.Add(70*time.Second), down)
+	assert.Equal(t, circuitClosed, b.state)
+
+	// neither do failures interrupted by a success
+	now = now.Add(2 * time.Minute)
+	b.record(ctx, now, down)
+	b.record(ctx, now, down)
+	b.record(ctx, now, nil)
+	b.record(ctx, now, down)
+	assert.Equal(t, circuitClosed, b.state)
+	assert.True(t, b.allow(ctx, now))
+
+	b.record(ctx, now, down)
+	b.record(ctx, now, down)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.False(t, b.allow(ctx, now.Add(5*time.Second)))
+
+	// a single probe is let through after the cooldown
+	now = now.Add(10 * time.Second)
+	assert.True(t, b.allow(ctx, now))
+	assert.Equal(t, circuitHalfOpen, b.state)
+	assert.False(t, b.allow(ctx, now))
+
+	// the circuit opens again if it fails
+	b.record(ctx, now, down)
+	assert.Equal(t, circuitOpen, b.state)
+	assert.False(t, b.allow(ctx, now.Add(5*time.Second)))
+
+	// probes which never complete are replaced
+	now = now.Add(10 * time.Second)
+	assert.True(t, b.allow(ctx, now))
+	assert.False(t, b.allow(ctx, now.Add(5*time.Second)))
+	assert.True(t, b.allow(ctx, now.Add(10*time.Second)))
+
+	// and it closes if one succeeds
+	b.record(ctx, now, nil)
+	assert.Equal(t, circuitClosed, b.state)
+	assert.True(t, b.allow(ctx, now))
+
+	assert.Nil(t, newCircuitBreaker(&config{}))
+}
+
+func TestDeliveryFailed(t *testing.T) {
+	t.Parallel()
+
+	rejected := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	unavailable := &textproto.Error{Code: 421, Msg: "4.3.2 Service shutting down"}
+	greylisted := &textproto.Error{Code: 451, Msg: "4.7.1 Greylisted"}
+
+	assert.False(t, deliveryFailed(nil))
+	assert.False(t, deliveryFailed(rejected))
+	assert.False(t, deliveryFailed(greylisted))
+	assert.True(t, deliveryFailed(unavailable))
+	assert.True(t, deliveryFailed(errors.New("i/o timeout")))
+	assert.True(t, deliveryFailed(&upstreamError{addr: "smtp.example.com:25", err: &textproto.Error{Code: 535, Msg: "Authentication failed"}}))
+	assert.False(t, deliveryFailed(&recipientsError{
+		delivered: []string{"alice@example.com"},
+		failed:    []rcptFailure{{rcpt: "bob@example.com", err: unavailable}},
+	}))
+	assert.True(t, deliveryFailed(&recipientsError{
+		failed: []rcptFailure{{rcpt: "bob@example.com", err: unavailable}},
+	}))
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateCircuitBreaker(&config{}))
+	require.NoError(t, validateCircuitBreaker(&config{circuitBreakerFailures: 5, circuitBreakerWindow: time.Minute, circuitBreakerCooldown: time.Second}))
+	require.Error(t, validateCircuitBreaker(&config{circuitBreakerFailures: 5, circuitBreakerCooldown: time.Second}))
+	require.Error(t, validateCircuitBreaker(&config{circuitBreakerFailures: 5, circuitBreakerWindow: time.Minute}))
+	require.Error(t, validateCircuitBreaker(&config{circuitBreakerFailures: 5, circuitBreakerWindow: time.Minute, circuitBreakerCooldown: time.Second, spoolDir: "/var/spool/smtprelay"}))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// catcherSpec is the upstream spec of the catcher destination.
+const catcherSpec = "catcher://"
+
+// catcherDestination accepts messages without relaying them anywhere, so that
+// they're only kept in the mail catcher.
+type catcherDestination struct{}
+
+// isCatcher reports whether the upstream spec requests messages to be only
+// kept in the mail catcher.
+func isCatcher(spec string) bool {
+	return spec == catcherSpec
+}
+
+// checkCatcher checks that the mail catcher is enabled, for the catcher://
+// spec.
+func checkCatcher(cfg *config) error {
+	if cfg.catcher == nil {
+		return errors.New("catcher:// requires catcher_size to be set")
+	}
+
+	return nil
+}
+
+func (catcherDestination) start(_ context.Context) {}
+
+func (catcherDestination) String() string {
+	return catcherSpec
+}
+
+// send does nothing: sent messages are recorded in the catcher by the relay.
+func (catcherDestination) send(_ context.Context, _ string, _ []string, _ *message) error {
+	return nil
+}
+
+// recordCaught keeps a copy of a message sent to the given recipients in the
+// mail catcher, if it's enabled.
+func (r *relay) recordCaught(ctx context.Context, sender string, recipients []string, data *message) {
+	if r.cfg.catcher == nil || len(recipients) == 0 {
+		return
+	}
+
+	copied, err := data.bytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "could not keep message in the catcher",
+			slog.String("component", "catcher"), slog.Any("error", err))
+
+		return
+	}
+
+	r.cfg.catcher.Add(sender, recipients, copied)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/smtprelay/v2/internal/catcher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestCatcher(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	// the catcher must be enabled
+	require.Error(t, validateUpstreams([]string{"catcher://"}, &config{}))
+
+	cfg := &config{catcher: catcher.NewStore(10)}
+	require.NoError(t, validateUpstreams([]string{"catcher://"}, cfg))
+	require.Error(t, validateUpstreams([]string{"catcher://", "smtp.example.com:25"}, cfg))
+
+	dest, err := newDestination(ctx, cfg, []string{"catcher://"}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	r := &relay{cfg: cfg, remote: dest}
+
+	err = r.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("Subject: caught\n\nhello\n")))
+	require.NoError(t, err)
+
+	msgs := cfg.catcher.List()
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "caught", msgs[0].Subject)
+	assert.Equal(t, []string{"alice@example.com"}, msgs[0].Recipients)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,6 +12,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/grafana/smtprelay/v2/internal/catcher"
+	"github.com/grafana/smtprelay/v2/internal/dkim"
 	"github.com/vharitonsky/iniflags"
 )
 
@@ -30,7 +34,29 @@ type config struct {
 	allowedUsers               string
 	remoteHost                 string
 	remoteUser                 string
+	remoteHostMaxFailures      int
+	remoteHostProbeInterval    time.Duration
+	transportMap               string
+	remoteDialTimeout          time.Duration
+	remoteTLSTimeout           time.Duration
+	remoteAuthTimeout          time.Duration
+	remoteCommandTimeout       time.Duration
+	remoteDataTimeout          time.Duration
+	remotePoolSize             int
+	remotePoolMaxIdle          time.Duration
+	remotePoolMaxMessages      int
+	remoteTLSPolicy            string
+	remoteCAFile               string
+	remoteCert                 string
+	remoteKey                  string
+	remoteTLSMinVersion        string
+	remoteTLSServerName        string
+	remoteHTTPFormat           string
+	remoteHTTPToken            string
+	remotePipeArgs             string
 	maxMessageSize             int
+	spillSize                  int
+	spillDir                   string
 	maxConnections             int
 	maxRecipients              int
 	readTimeout                time.Duration
@@ -46,12 +72,45 @@ type config struct {
 	rateLimitMessagesPerSecond float64
 	rateLimitBurst             int
 	rateLimitHeader            string
+	spoolDir                   string
+	spoolWorkers               int
+	spoolMaxAge                time.Duration
+	spoolRetryBackoff          time.Duration
+	spoolRetryMaxBackoff       time.Duration
+	catcherSize                int
+	dsnEnabled                 bool
+	inboundVerify              string
+	senderRewriteMap           string
+	headerRules                string
+	redirectTo                 string
+	redirectMap                string
+	redirectExclude            string
+	journalTo                  string
+	journalHost                string
+	journalInclude             string
+	journalRequired            bool
+	mirrorHost                 string
+	mirrorSample               float64
+	mirrorMaxPending           int
+	circuitBreakerFailures     int
+	circuitBreakerWindow       time.Duration
+	circuitBreakerCooldown     time.Duration
+	responseMap                string
+	srsDomain                  string
+	srsSecret                  string
+	srsMaxAge                  time.Duration
+	srsExcludeDomains          string
+	dkimKeys                   string
+	dkimHeaders                string
+	dkimReloadInterval         time.Duration
 	xoauth2ClientID            string
 	xoauth2ClientSecret        string
 	xoauth2TokenURL            string
 	xoauth2RefreshToken        string
 	xoauth2Scopes              string
 	allowedNets                []*net.IPNet
+	remoteTLS                  *tls.Config
+	catcher                    *catcher.Store
 	logHeaders                 map[string]string
 }
 
@@ -76,6 +135,59 @@ func setupAllowedNetworks(s string) ([]*net.IPNet, error) {
 	return nets, nil
 }
 
+// tlsVersions are the supported values of remote_tls_min_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// setupRemoteTLS returns the TLS settings with upstreams. Server names are set
+// per upstream.
+func setupRemoteTLS(cfg *config) (*tls.Config, error) {
+	if err := validateTLSPolicy(cfg.remoteTLSPolicy); err != nil {
+		return nil, fmt.Errorf("remote_tls_policy: %w", err)
+	}
+
+	minVersion, ok := tlsVersions[cfg.remoteTLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("remote_tls_min_version: unsupported TLS version %q", cfg.remoteTLSMinVersion)
+	}
+
+	//nolint:gosec // TLS 1.0 and 1.1 can be explicitly allowed for old servers
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+
+	if cfg.remoteCAFile != "" {
+		pem, err := os.ReadFile(cfg.remoteCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("remote_ca_file: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("remote_ca_file: no certificate found in %q", cfg.remoteCAFile)
+		}
+
+		tlsConfig.RootCAs = roots
+	}
+
+	if (cfg.remoteCert == "") != (cfg.remoteKey == "") {
+		return nil, errors.New("remote_cert and remote_key must be set together")
+	}
+
+	if cfg.remoteCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.remoteCert, cfg.remoteKey)
+		if err != nil {
+			return nil, fmt.Errorf("remote_cert: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func loadConfig() (*config, error) {
 	cfg := config{}
 	registerFlags(flag.CommandLine, &cfg)
@@ -97,47 +209,201 @@ func loadConfig() (*config, error) {
 		}
 	}
 
-	switch cfg.remoteAuth {
+	if cfg.remoteHTTPToken == "" {
+		cfg.remoteHTTPToken = os.Getenv("REMOTE_HTTP_TOKEN")
+	}
+
+	if cfg.srsSecret == "" {
+		cfg.srsSecret = os.Getenv("SRS_SECRET")
+	}
+
+	if err := validateAuth(cfg.remoteAuth, cfg.remoteUser, &cfg); err != nil {
+		return nil, err
+	}
+
+	remoteTLS, err := setupRemoteTLS(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.remoteTLS = remoteTLS
+
+	if cfg.catcherSize > 0 {
+		cfg.catcher = catcher.NewStore(cfg.catcherSize)
+	}
+
+	if err := validateUpstreams(splitstr(cfg.remoteHost, ' '), &cfg); err != nil {
+		return nil, fmt.Errorf("remote_host: %w", err)
+	}
+
+	if err := validateDKIM(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateInboundVerify(cfg.inboundVerify); err != nil {
+		return nil, fmt.Errorf("inbound_verify: %w", err)
+	}
+
+	if err := validateSenderRewrite(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateRedirect(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateJournal(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateMirror(&cfg); err != nil {
+		return nil, fmt.Errorf("mirror_host: %w", err)
+	}
+
+	if err := validateCircuitBreaker(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.transportMap != "" {
+		transports, err := loadTransportMap(cfg.transportMap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load transport map %q: %w", cfg.transportMap, err)
+		}
+
+		for _, t := range transports {
+			if err := validateUpstreams(t.upstreams, &cfg); err != nil {
+				return nil, fmt.Errorf("transport map %q, pattern %q: %w", cfg.transportMap, t.pattern, err)
+			}
+		}
+	}
+
+	if cfg.headerRules != "" {
+		if _, err := loadHeaderRules(cfg.headerRules); err != nil {
+			return nil, fmt.Errorf("cannot load header rules %q: %w", cfg.headerRules, err)
+		}
+	}
+
+	if cfg.responseMap != "" {
+		if _, err := loadResponseMap(cfg.responseMap); err != nil {
+			return nil, fmt.Errorf("cannot load response map %q: %w", cfg.responseMap, err)
+		}
+	}
+
+	if cfg.spillSize == 0 || cfg.spillSize < -1 {
+		return nil, errors.New("spill_size must be positive, or -1 to disable spilling")
+	}
+
+	if cfg.spillDir != "" {
+		if info, err := os.Stat(cfg.spillDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("spill_dir %q is not a directory", cfg.spillDir)
+		}
+	}
+
+	if cfg.spoolDir != "" {
+		if cfg.spoolWorkers < 1 {
+			return nil, errors.New("spool_workers must be at least 1")
+		}
+		if cfg.spoolRetryBackoff <= 0 || cfg.spoolRetryMaxBackoff < cfg.spoolRetryBackoff {
+			return nil, errors.New("spool_retry_backoff must be positive and not greater than spool_retry_max_backoff")
+		}
+	}
+
+	allowedNets, err := setupAllowedNetworks(cfg.allowedNetsStr)
+	if err != nil {
+		return nil, fmt.Errorf("setupAllowedNetworks: %w", err)
+	}
+	cfg.allowedNets = allowedNets
+
+	cfg.logHeaders = parseLogHeaders(cfg.logHeadersStr)
+
+	return &cfg, nil
+}
+
+// validateUpstreams checks that the upstreams can be parsed, and have the
+// settings required by their authentication method.
+func validateUpstreams(specs []string, cfg *config) error {
+	if err := checkSoleSpec(specs); err != nil {
+		return err
+	}
+
+	if len(specs) > 0 && isMX(specs[0]) {
+		_, err := parseMX(specs[0])
+		return err
+	}
+
+	if len(specs) > 0 && isHTTP(specs[0]) {
+		_, err := parseHTTP(specs[0], cfg)
+		return err
+	}
+
+	if len(specs) > 0 && isMailAPI(specs[0]) {
+		_, err := parseMailAPI(specs[0], cfg)
+		return err
+	}
+
+	if len(specs) > 0 && isFileSink(specs[0]) {
+		_, _, err := parseFileSink(specs[0])
+		return err
+	}
+
+	if len(specs) > 0 && isPipe(specs[0]) {
+		_, err := parsePipe(specs[0])
+		return err
+	}
+
+	if len(specs) > 0 && isCatcher(specs[0]) {
+		return checkCatcher(cfg)
+	}
+
+	upstreams, err := parseUpstreams(specs, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range upstreams {
+		if err := validateAuth(u.auth, u.user, cfg); err != nil {
+			return fmt.Errorf("upstream %q: %w", u.addr, err)
+		}
+	}
+
+	return nil
+}
+
+// validateAuth checks that the settings required by the given remote_auth
+// method are set.
+func validateAuth(method, user string, cfg *config) error {
+	switch method {
 	case "xoauth2":
-		if cfg.remoteUser == "" {
-			return nil, errors.New("remote_user is required for xoauth2 authentication")
+		if user == "" {
+			return errors.New("remote_user is required for xoauth2 authentication")
 		}
 		if cfg.xoauth2ClientID == "" {
-			return nil, errors.New("xoauth2_client_id is required for xoauth2 authentication")
+			return errors.New("xoauth2_client_id is required for xoauth2 authentication")
 		}
 		if cfg.xoauth2ClientSecret == "" {
-			return nil, errors.New("xoauth2_client_secret is required for xoauth2 authentication")
+			return errors.New("xoauth2_client_secret is required for xoauth2 authentication")
 		}
 		if cfg.xoauth2TokenURL == "" {
-			return nil, errors.New("xoauth2_token_url is required for xoauth2 authentication")
+			return errors.New("xoauth2_token_url is required for xoauth2 authentication")
 		}
 		if cfg.xoauth2RefreshToken == "" {
-			return nil, errors.New("xoauth2_refresh_token is required for xoauth2 authentication")
+			return errors.New("xoauth2_refresh_token is required for xoauth2 authentication")
 		}
 	case "xoauth2_client_credentials":
-		if cfg.remoteUser == "" {
-			return nil, errors.New("remote_user is required for xoauth2_client_credentials authentication")
+		if user == "" {
+			return errors.New("remote_user is required for xoauth2_client_credentials authentication")
 		}
 		if cfg.xoauth2ClientID == "" {
-			return nil, errors.New("xoauth2_client_id is required for xoauth2_client_credentials authentication")
+			return errors.New("xoauth2_client_id is required for xoauth2_client_credentials authentication")
 		}
 		if cfg.xoauth2ClientSecret == "" {
-			return nil, errors.New("xoauth2_client_secret is required for xoauth2_client_credentials authentication")
+			return errors.New("xoauth2_client_secret is required for xoauth2_client_credentials authentication")
 		}
 		if cfg.xoauth2TokenURL == "" {
-			return nil, errors.New("xoauth2_token_url is required for xoauth2_client_credentials authentication")
+			return errors.New("xoauth2_token_url is required for xoauth2_client_credentials authentication")
 		}
 	}
 
-	allowedNets, err := setupAllowedNetworks(cfg.allowedNetsStr)
-	if err != nil {
-		return nil, fmt.Errorf("setupAllowedNetworks: %w", err)
-	}
-	cfg.allowedNets = allowedNets
-
-	cfg.logHeaders = parseLogHeaders(cfg.logHeadersStr)
-
-	return &cfg, nil
+	return nil
 }
 
 func registerFlags(f *flag.FlagSet, cfg *config) {
@@ -154,16 +420,38 @@ func registerFlags(f *flag.FlagSet, cfg *config) {
 	f.StringVar(&cfg.allowedRecipients, "allowed_recipients", "", "Regular expression for valid 'to' email addresses (leave empty to allow any recipient)")
 	f.StringVar(&cfg.deniedRecipients, "denied_recipients", "", "Regular expression for email addresses for which will never deliver any emails.")
 	f.StringVar(&cfg.allowedUsers, "allowed_users", "", "Path to file with valid users/passwords (leave empty to allow any user)")
-	f.StringVar(&cfg.remoteHost, "remote_host", "smtp.gmail.com:587", "Outgoing SMTP server")
+	f.StringVar(&cfg.remoteHost, "remote_host", "smtp.gmail.com:587", "Outgoing SMTP server(s) tried in order, separated by spaces (host:port or smtp[s]://user:pass@host:port?auth=method), mx://, an http(s):// API URL, graph://, gmail://, or maildir://, mbox:// or eml:// with a path")
+	f.IntVar(&cfg.remoteHostMaxFailures, "remote_host_max_failures", 3, "Consecutive failures after which an outgoing SMTP server is considered unhealthy")
+	f.DurationVar(&cfg.remoteHostProbeInterval, "remote_host_probe_interval", 30*time.Second, "Interval between checks of unhealthy outgoing SMTP servers")
+	f.StringVar(&cfg.transportMap, "transport_map", "", "Path to file routing recipients to their own outgoing SMTP servers (leave empty to relay everything to remote_host)")
+	f.DurationVar(&cfg.remoteDialTimeout, "remote_dial_timeout", 30*time.Second, "Timeout for connecting to outgoing SMTP servers and reading their greeting")
+	f.DurationVar(&cfg.remoteTLSTimeout, "remote_tls_timeout", 30*time.Second, "Timeout for STARTTLS with outgoing SMTP servers")
+	f.DurationVar(&cfg.remoteAuthTimeout, "remote_auth_timeout", 30*time.Second, "Timeout for authentication with outgoing SMTP servers")
+	f.DurationVar(&cfg.remoteCommandTimeout, "remote_command_timeout", 5*time.Minute, "Timeout for other commands sent to outgoing SMTP servers (EHLO, MAIL, RCPT...)")
+	f.DurationVar(&cfg.remoteDataTimeout, "remote_data_timeout", 10*time.Minute, "Timeout for sending a message to outgoing SMTP servers and getting their reply")
+	f.IntVar(&cfg.remotePoolSize, "remote_pool_size", 0, "Max number of sessions kept open with each outgoing SMTP server for reuse (0 to open a new session for every message)")
+	f.DurationVar(&cfg.remotePoolMaxIdle, "remote_pool_max_idle", time.Minute, "Close pooled sessions with outgoing SMTP servers after being idle for this long")
+	f.IntVar(&cfg.remotePoolMaxMessages, "remote_pool_max_messages", 100, "Close pooled sessions with outgoing SMTP servers after sending this many messages")
+	f.StringVar(&cfg.remoteTLSPolicy, "remote_tls_policy", "opportunistic", "Use of STARTTLS with outgoing SMTP servers (none, opportunistic: when offered, required: fail if not offered)")
+	f.StringVar(&cfg.remoteCAFile, "remote_ca_file", "", "File of PEM CA certificates to verify outgoing SMTP servers with, instead of the system ones")
+	f.StringVar(&cfg.remoteCert, "remote_cert", "", "Client certificate presented to outgoing SMTP servers (needs remote_key)")
+	f.StringVar(&cfg.remoteKey, "remote_key", "", "Private key of the client certificate presented to outgoing SMTP servers")
+	f.StringVar(&cfg.remoteTLSMinVersion, "remote_tls_min_version", "1.2", "Minimum TLS version with outgoing SMTP servers (1.0, 1.1, 1.2 or 1.3)")
+	f.StringVar(&cfg.remoteTLSServerName, "remote_tls_server_name", "", "Name to verify the certificates of outgoing SMTP servers against, instead of their host name")
+	f.StringVar(&cfg.remoteHTTPFormat, "remote_http_format", "raw", "Format of the messages posted to HTTP APIs (raw: the message, with the envelope in X-Envelope-From/To headers, json: a JSON envelope)")
+	f.StringVar(&cfg.remoteHTTPToken, "remote_http_token", "", "Bearer token for HTTP APIs (set $REMOTE_HTTP_TOKEN to use env var instead)")
+	f.StringVar(&cfg.remotePipeArgs, "remote_pipe_args", "-i -f {sender} -- {recipients}", "Arguments of pipe:// commands, where {sender} is replaced by the envelope sender and {recipients} by the recipients")
 	f.StringVar(&cfg.remoteUser, "remote_user", "", "Username for authentication on outgoing SMTP server")
 	f.IntVar(&cfg.maxMessageSize, "max_message_size", 51200000, "Max message size allowed in bytes")
+	f.IntVar(&cfg.spillSize, "spill_size", 1048576, "Size in bytes past which the bodies of messages being relayed are written to a temporary file instead of held in memory, use -1 to disable")
+	f.StringVar(&cfg.spillDir, "spill_dir", "", "Directory of the temporary files of large messages (leave empty for the system's temporary directory)")
 	f.IntVar(&cfg.maxConnections, "max_connections", 100, "Max number of concurrent connections, use -1 to disable")
 	f.IntVar(&cfg.maxRecipients, "max_recipients", 100, "Max number of recipients on an email")
 	f.DurationVar(&cfg.readTimeout, "read_timeout", 60*time.Second, "Socket timeout for read operations")
 	f.DurationVar(&cfg.writeTimeout, "write_timeout", 60*time.Second, "Socket timeout for write operations")
 	f.DurationVar(&cfg.dataTimeout, "data_timeout", 5*time.Minute, "Socket timeout for DATA command")
 	f.StringVar(&cfg.remotePass, "remote_pass", "", "Password for authentication on outgoing SMTP server (set $REMOTE_PASS to use env var instead)")
-	f.StringVar(&cfg.remoteAuth, "remote_auth", "plain", "Auth method on outgoing SMTP server (plain, xoauth2, xoauth2_client_credentials)")
+	f.StringVar(&cfg.remoteAuth, "remote_auth", "plain", "Auth method on outgoing SMTP server (plain, login, cram-md5, scram-sha-256, auto, xoauth2, xoauth2_client_credentials)")
 	f.StringVar(&cfg.remoteSender, "remote_sender", "", "Sender email address on outgoing SMTP server")
 	f.BoolVar(&cfg.versionInfo, "version", false, "Show version information")
 	f.StringVar(&cfg.logLevel, "log_level", "debug", "Minimum log level to output")
@@ -172,6 +460,37 @@ func registerFlags(f *flag.FlagSet, cfg *config) {
 	f.Float64Var(&cfg.rateLimitMessagesPerSecond, "rate_limit_messages_per_second", 10, "Maximum messages per second per sender")
 	f.IntVar(&cfg.rateLimitBurst, "rate_limit_burst", 5, "Burst capacity for rate limiter")
 	f.StringVar(&cfg.rateLimitHeader, "rate_limit_header", "", "Email header to extract sender identity for rate limiting (by default, the sender address is used)")
+	f.StringVar(&cfg.spoolDir, "spool_dir", "", "Directory to spool accepted messages to for asynchronous delivery (leave empty to deliver synchronously)")
+	f.IntVar(&cfg.spoolWorkers, "spool_workers", 4, "Number of concurrent deliveries from the spool")
+	f.DurationVar(&cfg.spoolMaxAge, "spool_max_age", 24*time.Hour, "Give up on spooled messages which could not be delivered for this long")
+	f.DurationVar(&cfg.spoolRetryBackoff, "spool_retry_backoff", time.Minute, "Delay before retrying a failed delivery, doubled after every attempt")
+	f.DurationVar(&cfg.spoolRetryMaxBackoff, "spool_retry_max_backoff", time.Hour, "Maximum delay between delivery retries")
+	f.StringVar(&cfg.dkimKeys, "dkim_keys", "", "DKIM signing keys, as a space-separated list of domain:selector:path (PEM-encoded RSA or Ed25519 keys), selected by the From domain")
+	f.StringVar(&cfg.dkimHeaders, "dkim_headers", strings.Join(dkim.DefaultHeaders, " "), "Header fields to sign with DKIM, space-separated")
+	f.DurationVar(&cfg.dkimReloadInterval, "dkim_reload_interval", time.Minute, "Interval to check DKIM key files for changes, 0 to disable reloading")
+	f.BoolVar(&cfg.dsnEnabled, "dsn_enabled", false, "Send delivery status notifications to senders when spooled messages can't be delivered to some recipients. Without spool_dir, recipients failing after others were delivered are always notified")
+	f.StringVar(&cfg.senderRewriteMap, "sender_rewrite_map", "", "File with rules rewriting envelope senders")
+	f.StringVar(&cfg.srsDomain, "srs_domain", "", "Rewrite envelope senders with SRS into addresses of this domain")
+	f.StringVar(&cfg.srsSecret, "srs_secret", "", "Secrets authenticating SRS addresses, space-separated, the first one is used for new addresses (or SRS_SECRET env var)")
+	f.DurationVar(&cfg.srsMaxAge, "srs_max_age", 21*24*time.Hour, "How long SRS addresses are accepted for")
+	f.StringVar(&cfg.srsExcludeDomains, "srs_exclude_domains", "", "Sender domains not rewritten with SRS, space-separated")
+	f.StringVar(&cfg.redirectTo, "redirect_to", "", "Redirect all recipients to this address, for staging (leave empty to deliver to the actual recipients)")
+	f.StringVar(&cfg.redirectMap, "redirect_map", "", "File with per-sender addresses to redirect recipients to, defaulting to redirect_to")
+	f.StringVar(&cfg.redirectExclude, "redirect_exclude", "", "Recipient patterns not redirected, space-separated, as in transport_map")
+	f.StringVar(&cfg.journalTo, "journal_to", "", "Archive address to send a journal report of every delivered message to (leave empty to disable journaling)")
+	f.StringVar(&cfg.journalHost, "journal_host", "", "Upstreams to send journal reports through, as in remote_host (by default, they are relayed like other messages)")
+	f.StringVar(&cfg.journalInclude, "journal_include", "", "Only journal messages whose sender or a recipient matches one of these patterns, space-separated, as in transport_map")
+	f.BoolVar(&cfg.journalRequired, "journal_required", false, "Journal messages delivered synchronously before delivering them, and fail them with a temporary error if they could not be journaled, instead of only logging the failure. Has no effect on spooled messages")
+	f.StringVar(&cfg.mirrorHost, "mirror_host", "", "Upstreams to replay a copy of messages to in the background, as in remote_host, without affecting replies (leave empty to disable mirroring)")
+	f.Float64Var(&cfg.mirrorSample, "mirror_sample", 100, "Percentage of messages to mirror")
+	f.IntVar(&cfg.mirrorMaxPending, "mirror_max_pending", 100, "Maximum number of mirrored deliveries in progress, further messages aren't mirrored. Each holds a copy of its message, in memory up to spill_size bytes and in spill_dir past it, so mirroring uses up to mirror_max_pending times spill_size bytes of memory")
+	f.IntVar(&cfg.circuitBreakerFailures, "circuit_breaker_failures", 0, "Defer messages at MAIL FROM after this many consecutive delivery failures within circuit_breaker_window, 0 to disable (not supported with spool_dir)")
+	f.DurationVar(&cfg.circuitBreakerWindow, "circuit_breaker_window", time.Minute, "Window the consecutive delivery failures must happen within to open the circuit")
+	f.DurationVar(&cfg.circuitBreakerCooldown, "circuit_breaker_cooldown", 30*time.Second, "How long messages are deferred for once the circuit is open, before probing with the next message")
+	f.StringVar(&cfg.responseMap, "response_map", "", "File with rules rewriting the codes and texts of upstream failures, and whether they're retried")
+	f.StringVar(&cfg.headerRules, "header_rules", "", "File with rules removing, adding and rewriting header fields of relayed messages")
+	f.StringVar(&cfg.inboundVerify, "inbound_verify", verifyNone, "Verify SPF, DKIM and DMARC of inbound messages (none, annotate: add an Authentication-Results header, tempfail or reject: also defer or reject failing messages)")
+	f.IntVar(&cfg.catcherSize, "catcher_size", 0, "Keep this many of the last sent messages in memory, browsable at /catcher/ on metrics_listen (0 to disable)")
 	f.StringVar(&cfg.xoauth2ClientID, "xoauth2_client_id", "", "Client ID for OAuth2 authentication")
 	f.StringVar(&cfg.xoauth2ClientSecret, "xoauth2_client_secret", "", "Client secret for OAuth2 authentication")
 	f.StringVar(&cfg.xoauth2RefreshToken, "xoauth2_refresh_token", "", "Refresh token for OAuth2 authentication")
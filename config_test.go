@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"net"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -61,3 +63,42 @@ func FuzzParseLogHeaders(f *testing.F) {
 		parseLogHeaders(s)
 	})
 }
+
+func TestSetupRemoteTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "test")
+
+	cfg := &config{remoteTLSPolicy: "opportunistic", remoteTLSMinVersion: "1.2"}
+
+	tlsConfig, err := setupRemoteTLS(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	assert.Nil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	tlsConfig, err = setupRemoteTLS(&config{
+		remoteTLSPolicy:     "required",
+		remoteTLSMinVersion: "1.3",
+		remoteCAFile:        certFile,
+		remoteCert:          certFile,
+		remoteKey:           keyFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	for name, bad := range map[string]config{
+		"policy":       {remoteTLSPolicy: "always", remoteTLSMinVersion: "1.2"},
+		"version":      {remoteTLSPolicy: "none", remoteTLSMinVersion: "1.4"},
+		"missing CA":   {remoteTLSPolicy: "none", remoteTLSMinVersion: "1.2", remoteCAFile: filepath.Join(dir, "nope.crt")},
+		"CA not PEM":   {remoteTLSPolicy: "none", remoteTLSMinVersion: "1.2", remoteCAFile: keyFile},
+		"missing key":  {remoteTLSPolicy: "none", remoteTLSMinVersion: "1.2", remoteCert: certFile},
+		"mismatch key": {remoteTLSPolicy: "none", remoteTLSMinVersion: "1.2", remoteCert: certFile, remoteKey: certFile},
+	} {
+		_, err := setupRemoteTLS(&bad)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/dkim"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+)
+
+// dkimKeyFile is a signing key of a domain, as set in dkim_keys.
+type dkimKeyFile struct {
+	domain   string
+	selector string
+	path     string
+}
+
+// dkimSigner signs messages with the key of the domain of their From header.
+// Key files are reloaded when they change.
+type dkimSigner struct {
+	files    []dkimKeyFile
+	headers  []string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]*dkim.Key // by domain
+	modTimes map[string]time.Time // by path
+}
+
+// parseDKIMKeys parses the dkim_keys setting: a space-separated list of
+// domain:selector:path entries.
+func parseDKIMKeys(spec string) ([]dkimKeyFile, error) {
+	files := []dkimKeyFile{}
+	domains := map[string]bool{}
+
+	for _, entry := range splitstr(spec, ' ') {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected domain:selector:path", entry)
+		}
+
+		domain := strings.ToLower(parts[0])
+		if domains[domain] {
+			return nil, fmt.Errorf("duplicate domain %q", domain)
+		}
+
+		domains[domain] = true
+
+		files = append(files, dkimKeyFile{domain: domain, selector: parts[1], path: parts[2]})
+	}
+
+	return files, nil
+}
+
+// validateDKIM checks the DKIM settings.
+func validateDKIM(cfg *config) error {
+	if cfg.dkimKeys == "" {
+		return nil
+	}
+
+	if _, err := parseDKIMKeys(cfg.dkimKeys); err != nil {
+		return fmt.Errorf("dkim_keys: %w", err)
+	}
+
+	for _, h := range splitstr(cfg.dkimHeaders, ' ') {
+		if strings.EqualFold(h, "From") {
+			return nil
+		}
+	}
+
+	return errors.New("dkim_headers must include From")
+}
+
+// newDKIMSigner loads the keys set in dkim_keys, or returns nil if there are
+// none.
+func newDKIMSigner(cfg *config) (*dkimSigner, error) {
+	if cfg.dkimKeys == "" {
+		return nil, nil
+	}
+
+	files, err := parseDKIMKeys(cfg.dkimKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dkimSigner{
+		files:    files,
+		headers:  splitstr(cfg.dkimHeaders, ' '),
+		interval: cfg.dkimReloadInterval,
+		keys:     map[string]*dkim.Key{},
+		modTimes: map[string]time.Time{},
+	}
+
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// reload loads the key files which changed since they were last loaded, and
+// reports whether any did. On error, the previous keys are kept.
+func (s *dkimSigner) reload() (bool, error) {
+	s.mu.RLock()
+	keys := maps.Clone(s.keys)
+	s.mu.RUnlock()
+
+	modTimes := map[string]time.Time{}
+	changed := false
+
+	for _, f := range s.files {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return false, fmt.Errorf("dkim key of %s: %w", f.domain, err)
+		}
+
+		modTimes[f.path] = info.ModTime()
+
+		s.mu.RLock()
+		loaded, ok := s.modTimes[f.path]
+		s.mu.RUnlock()
+
+		if ok && loaded.Equal(info.ModTime()) {
+			continue
+		}
+
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return false, fmt.Errorf("dkim key of %s: %w", f.domain, err)
+		}
+
+		signer, err := dkim.ParseKey(data)
+		if err != nil {
+			return false, fmt.Errorf("dkim key of %s in %q: %w", f.domain, f.path, err)
+		}
+
+		keys[f.domain] = &dkim.Key{Domain: f.domain, Selector: f.selector, Signer: signer}
+		changed = true
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.modTimes = modTimes
+	s.mu.Unlock()
+
+	return changed, nil
+}
+
+// start checks for changed key files every dkim_reload_interval, until the
+// context is done.
+func (s *dkimSigner) start(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			changed, err := s.reload()
+
+			switch {
+			case err != nil:
+				slog.ErrorContext(ctx, "could not reload dkim keys, keeping the previous ones",
+					slog.String("component", "dkim"), slog.Any("error", err))
+			case changed:
+				slog.InfoContext(ctx, "dkim keys reloaded", slog.String("component", "dkim"))
+			}
+		}
+	}()
+}
+
+// sign prepends a DKIM-Signature header to the message, if there's a key for
+// the domain of its From header. Messages which can't be signed are left as
+// they are.
+func (s *dkimSigner) sign(ctx context.Context, env *smtpd.Envelope) {
+	logger := slog.With(slog.String("component", "dkim"))
+
+	domain, err := fromDomain(env.Header)
+	if err != nil {
+		logger.WarnContext(ctx, "not signing message without a valid From header", slog.Any("error", err))
+		return
+	}
+
+	s.mu.RLock()
+	key := s.keys[domain]
+	s.mu.RUnlock()
+
+	if key == nil {
+		logger.DebugContext(ctx, "no dkim key for domain", slog.String("domain", domain))
+		return
+	}
+
+	header, err := dkim.Sign(env.Reader(), key, s.headers, time.Now())
+	if err != nil {
+		logger.ErrorContext(ctx, "could not sign message", slog.String("domain", domain), slog.Any("error", err))
+		return
+	}
+
+	// AddHeader keeps the folding of the signature, and the line ending of
+	// the message
+	name, value, _ := strings.Cut(strings.TrimSuffix(header, "\r\n"), ":")
+	env.AddHeader(name, strings.TrimPrefix(value, " "))
+}
+
+// fromDomain returns the domain of the address in the From header.
+func fromDomain(header textproto.MIMEHeader) (string, error) {
+	addrs, err := mail.Header(header).AddressList("From")
+	if err != nil {
+		return "", err
+	}
+
+	_, domain, ok := strings.Cut(addrs[0].Address, "@")
+	if !ok {
+		return "", fmt.Errorf("no domain in %q", addrs[0].Address)
+	}
+
+	return strings.ToLower(domain), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestDKIMKey writes a new RSA (PKCS #1) or Ed25519 (PKCS #8) key to
+// the file.
+func writeTestDKIMKey(t *testing.T, path string, ed bool) {
+	t.Helper()
+
+	var block *pem.Block
+
+	if ed {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	} else {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	}
+
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+}
+
+func TestDKIMSigner(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+
+	writeTestDKIMKey(t, filepath.Join(dir, "example.com.pem"), false)
+	writeTestDKIMKey(t, filepath.Join(dir, "example.org.pem"), true)
+
+	cfg := &config{
+		dkimKeys: "example.com:s1:" + filepath.Join(dir, "example.com.pem") +
+			" Example.org:s2:" + filepath.Join(dir, "example.org.pem"),
+		dkimHeaders: strings.Join(dkim.DefaultHeaders, " "),
+	}
+	require.NoError(t, validateDKIM(cfg))
+
+	s, err := newDKIMSigner(cfg)
+	require.NoError(t, err)
+
+	sign := func(data string) string {
+		env := testEnvelope("bob@example.com", nil, data)
+		s.sign(ctx, env)
+
+		return envelopeData(t, env)
+	}
+
+	msg := "From: Bob <bob@Example.COM>\nSubject: hello\n\nhello\n"
+
+	signed := sign(msg)
+	require.True(t, strings.HasPrefix(signed, "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=s1;\n"), signed)
+	assert.True(t, strings.HasSuffix(signed, "\n"+msg))
+	assert.NotContains(t, signed, "\r")
+
+	signed = sign("From: alice@example.org\r\n\r\nhello\r\n")
+	assert.True(t, strings.HasPrefix(signed, "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=example.org; s=s2;\r\n"), signed)
+
+	// the signature holds once added to the message
+	pub := s.keys["example.org"].Signer.Public().(ed25519.PublicKey)
+	lookup := func(_ context.Context, _ string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+
+	res := dkim.Verify(ctx, strings.NewReader(signed), lookup, time.Now())
+	require.Len(t, res, 1)
+	assert.Equal(t, dkim.StatusPass, res[0].Status, res[0].Err)
+
+	// messages from other domains, or without From, aren't signed
+	for _, msg := range []string{"From: carol@example.net\n\nhello\n", "Subject: hello\n\nhello\n"} {
+		assert.Equal(t, msg, sign(msg))
+	}
+
+	// changed key files are reloaded
+	changed, err := s.reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	previous, unchanged := s.keys["example.com"], s.keys["example.org"]
+
+	path := filepath.Join(dir, "example.com.pem")
+	writeTestDKIMKey(t, path, true)
+	require.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+	changed, err = s.reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotSame(t, previous, s.keys["example.com"])
+	assert.Same(t, unchanged, s.keys["example.org"])
+
+	// broken key files don't replace working keys
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute)))
+
+	current := s.keys["example.com"]
+
+	_, err = s.reload()
+	require.Error(t, err)
+	assert.Same(t, current, s.keys["example.com"])
+}
+
+func TestValidateDKIM(t *testing.T) {
+	t.Parallel()
+
+	for _, keys := range []string{"example.com", "example.com:s1", "example.com::/key.pem", "a.com:s:/a.pem A.com:s:/b.pem"} {
+		require.Error(t, validateDKIM(&config{dkimKeys: keys, dkimHeaders: "From"}), keys)
+	}
+
+	require.Error(t, validateDKIM(&config{dkimKeys: "example.com:s1:/key.pem", dkimHeaders: "To Subject"}))
+	require.NoError(t, validateDKIM(&config{dkimKeys: "example.com:s1:/key.pem", dkimHeaders: "from To"}))
+}
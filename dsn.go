@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/spool"
+)
+
+// dsnStatusRe matches the enhanced status code (RFC 3463) at the start of a
+// reply text.
+var dsnStatusRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?:\s+|$)`)
+
+// bounce notifies the sender that the message couldn't be delivered to the
+// failed recipients, with a delivery status notification (RFC 3464) sent with
+// a null sender. Null senders never get notifications, which also prevents
+// loops. Notifications are only sent when dsn_enabled is set.
+func (r *relay) bounce(ctx context.Context, sender string, arrival time.Time, data *message, failures []rcptFailure) {
+	if !r.cfg.dsnEnabled {
+		return
+	}
+
+	r.notify(ctx, sender, arrival, data, failures)
+}
+
+// notify sends a delivery status notification regardless of dsn_enabled, for
+// failures the client can't be told about otherwise. The sender is the one the
+// message was received with, before any rewriting. When spooling, the
+// notification is spooled, otherwise it's sent right away.
+func (r *relay) notify(ctx context.Context, sender string, arrival time.Time, data *message, failures []rcptFailure) {
+	if sender == "" || len(failures) == 0 {
+		return
+	}
+
+	logger := slog.With(
+		slog.String("component", "dsn"),
+		slog.String("to", sender),
+		slog.Int("failed", len(failures)),
+	)
+
+	dsn, err := newDSN(r.cfg.hostName, sender, arrival, data.reader(), failures, time.Now())
+	if err != nil {
+		logger.ErrorContext(ctx, "could not build delivery status notification", slog.Any("error", err))
+		return
+	}
+
+	// notifications are redirected like other messages
+	env := &smtpd.Envelope{Recipients: []string{sender}}
+	env.SetData(dsn)
+	r.redirect(ctx, env)
+
+	if r.queue != nil {
+		err = r.queue.Enqueue(ctx, &spool.Message{Recipients: env.Recipients}, env.Reader())
+	} else {
+		err = r.send(ctx, "", env.Recipients, envelopeMessage(env))
+	}
+
+	if err != nil {
+		logger.ErrorContext(ctx, "could not send delivery status notification", slog.Any("error", err))
+		return
+	}
+
+	logger.InfoContext(ctx, "delivery status notification sent")
+}
+
+// failuresOf returns the failure of each recipient from a delivery error.
+func failuresOf(recipients []string, err error) []rcptFailure {
+	var rerr *recipientsError
+	if errors.As(err, &rerr) {
+		return rerr.failed
+	}
+
+	failures := make([]rcptFailure, 0, len(recipients))
+	for _, rcpt := range recipients {
+		failures = append(failures, rcptFailure{rcpt: rcpt, err: err})
+	}
+
+	return failures
+}
+
+// newDSN builds a multipart/report delivery status notification, with a
+// human-readable explanation, the status of each failed recipient, and the
+// headers of the original message.
+func newDSN(hostName, sender string, arrival time.Time, data io.Reader, failures []rcptFailure, now time.Time) ([]byte, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	header := &bytes.Buffer{}
+	fmt.Fprintf(header, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostName)
+	fmt.Fprintf(header, "To: <%s>\r\n", sender)
+	fmt.Fprintf(header, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(header, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(header, "Message-ID: <%s@%s>\r\n", uuid.NewString(), hostName)
+	fmt.Fprintf(header, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(header, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(header, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", w.Boundary())
+
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(text, "This is the mail system at host %s.\r\n\r\n", hostName)
+	fmt.Fprintf(text, "Your message could not be delivered to one or more recipients.\r\n\r\n")
+
+	for _, f := range failures {
+		fmt.Fprintf(text, "<%s>: %s\r\n", f.rcpt, dsnReason(f.err))
+	}
+
+	status, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(status, "Reporting-MTA: dns; %s\r\n", hostName)
+	fmt.Fprintf(status, "Arrival-Date: %s\r\n", arrival.Format(time.RFC1123Z))
+
+	for _, f := range failures {
+		fmt.Fprintf(status, "\r\nFinal-Recipient: rfc822; %s\r\n", f.rcpt)
+		fmt.Fprintf(status, "Action: failed\r\n")
+		fmt.Fprintf(status, "Status: %s\r\n", dsnStatus(f.err))
+
+		var tperr *textproto.Error
+		if errors.As(f.err, &tperr) {
+			fmt.Fprintf(status, "Diagnostic-Code: smtp; %d %s\r\n", tperr.Code, oneLine(tperr.Msg))
+		}
+	}
+
+	headers, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(data)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+
+		_, _ = headers.Write(line)
+		_, _ = headers.Write([]byte("\r\n"))
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(header.Bytes(), body.Bytes()...), nil
+}
+
+// dsnStatus returns the status of a failed recipient: the enhanced status
+// code of the reply if there's one, otherwise a generic permanent failure, or
+// an expired delivery time for temporary failures.
+func dsnStatus(err error) string {
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) {
+		if m := dsnStatusRe.FindStringSubmatch(tperr.Msg); m != nil {
+			return m[1]
+		}
+	}
+
+	if isPermanent(err) {
+		return "5.0.0"
+	}
+
+	return "4.4.7"
+}
+
+// dsnReason returns a human-readable reason for a failure.
+func dsnReason(err error) string {
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) {
+		return fmt.Sprintf("%d %s", tperr.Code, oneLine(tperr.Msg))
+	}
+
+	return "delivery failed: " + oneLine(err.Error())
+}
+
+// oneLine joins the lines of a multiline reply.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
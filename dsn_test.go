@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/catcher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDSN(t *testing.T) {
+	t.Parallel()
+
+	arrival := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	data := []byte("From: bob@example.com\nSubject: hello\n\nsecret body\n")
+
+	dsn, err := newDSN("relay.example.com", "bob@example.com", arrival, bytes.NewReader(data), []rcptFailure{
+		{rcpt: "alice@example.com", err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}},
+		{rcpt: "carol@example.com", err: &textproto.Error{Code: 554, Msg: "Rejected"}},
+		{rcpt: "dave@example.com", err: errors.New("connection refused")},
+	}, arrival.Add(time.Hour))
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(dsn))
+	require.NoError(t, err)
+
+	assert.Equal(t, "<bob@example.com>", msg.Header.Get("To"))
+	assert.Equal(t, "Mail Delivery System <MAILER-DAEMON@relay.example.com>", msg.Header.Get("From"))
+	assert.Equal(t, "auto-replied", msg.Header.Get("Auto-Submitted"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+
+	parts := map[string]string{}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(p)
+		require.NoError(t, err)
+
+		parts[p.Header.Get("Content-Type")] = string(content)
+	}
+
+	require.Len(t, parts, 3)
+	assert.Contains(t, parts["text/plain; charset=utf-8"], "<alice@example.com>: 550 5.1.1 No such user\r\n")
+
+	assert.Equal(t, "Reporting-MTA: dns; relay.example.com\r\n"+
+		"Arrival-Date: Wed, 01 May 2024 10:00:00 +0000\r\n"+
+		"\r\n"+
+		"Final-Recipient: rfc822; alice@example.com\r\n"+
+		"Action: failed\r\n"+
+		"Status: 5.1.1\r\n"+
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n"+
+		"\r\n"+
+		"Final-Recipient: rfc822; carol@example.com\r\n"+
+		"Action: failed\r\n"+
+		"Status: 5.0.0\r\n"+
+		"Diagnostic-Code: smtp; 554 Rejected\r\n"+
+		"\r\n"+
+		"Final-Recipient: rfc822; dave@example.com\r\n"+
+		"Action: failed\r\n"+
+		"Status: 4.4.7\r\n", parts["message/delivery-status"])
+
+	// only the headers of the original message are returned
+	assert.Equal(t, "From: bob@example.com\r\nSubject: hello\r\n", parts["text/rfc822-headers"])
+}
+
+func TestBounce(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	cfg := &config{hostName: "relay.example.com", dsnEnabled: true, catcher: catcher.NewStore(10)}
+	r := &relay{cfg: cfg, remote: catcherDestination{}}
+
+	failures := []rcptFailure{{rcpt: "alice@example.com", err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}}}
+
+	// null senders never get notifications
+	r.bounce(ctx, "", time.Now(), newMessage([]byte("Subject: hello\n\nhello\n")), failures)
+	assert.Empty(t, cfg.catcher.List())
+
+	r.bounce(ctx, "bob@example.com", time.Now(), newMessage([]byte("Subject: hello\n\nhello\n")), failures)
+
+	msgs := cfg.catcher.List()
+	require.Len(t, msgs, 1)
+	assert.Empty(t, msgs[0].Sender)
+	assert.Equal(t, []string{"bob@example.com"}, msgs[0].Recipients)
+	assert.Equal(t, "Undelivered Mail Returned to Sender", msgs[0].Subject)
+
+	// notifications are disabled by default
+	cfg.dsnEnabled = false
+	r.bounce(ctx, "bob@example.com", time.Now(), newMessage([]byte("Subject: hello\n\nhello\n")), failures)
+	assert.Len(t, cfg.catcher.List(), 1)
+}
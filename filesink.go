@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats of the file sinks, as the scheme of their spec.
+const (
+	sinkMaildir = "maildir" // a Maildir, one file per message
+	sinkMbox    = "mbox"    // an mbox file, messages appended to it
+	sinkEML     = "eml"     // a directory of .eml files
+)
+
+// mboxLocks serializes writes to each mbox file, shared by all the relays.
+var mboxLocks sync.Map // path -> *sync.Mutex
+
+// fileDestination writes messages to local files instead of relaying them,
+// turning the relay into a mail catcher for development and tests. The
+// envelope is kept in X-Envelope-From and X-Envelope-To headers.
+type fileDestination struct {
+	format   string
+	path     string
+	hostName string // for Maildir file names
+}
+
+// isFileSink reports whether the upstream spec requests writing messages to
+// local files.
+func isFileSink(spec string) bool {
+	for _, format := range []string{sinkMaildir, sinkMbox, sinkEML} {
+		if strings.HasPrefix(spec, format+"://") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseFileSink parses a file sink spec, like maildir:///var/mail/catcher.
+func parseFileSink(spec string) (format, path string, err error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return "", "", err
+	}
+
+	if parsed.Host != "" || parsed.User != nil || parsed.RawQuery != "" || parsed.Path == "" || parsed.Path == "/" {
+		return "", "", fmt.Errorf("%s:// only accepts an absolute path, like %s:///var/mail/smtprelay", parsed.Scheme, parsed.Scheme)
+	}
+
+	return parsed.Scheme, filepath.Clean(parsed.Path), nil
+}
+
+func newFileDestination(spec string, cfg *config) (*fileDestination, error) {
+	format, path, err := parseFileSink(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &fileDestination{
+		format:   format,
+		path:     path,
+		hostName: strings.NewReplacer("/", "_", ":", "_").Replace(cfg.hostName),
+	}
+
+	dirs := []string{path}
+
+	switch format {
+	case sinkMaildir:
+		dirs = []string{filepath.Join(path, "tmp"), filepath.Join(path, "new"), filepath.Join(path, "cur")}
+	case sinkMbox:
+		dirs = []string{filepath.Dir(path)}
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create %s: %w", format, err)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *fileDestination) start(_ context.Context) {}
+
+func (d *fileDestination) String() string {
+	return d.format + "://" + d.path
+}
+
+// send writes the message, with its envelope, to the sink.
+func (d *fileDestination) send(ctx context.Context, sender string, recipients []string, data *message) error {
+	ctx, span := tracer.Start(ctx, "relay.file",
+		trace.WithAttributes(
+			attribute.String("file.path", d.path),
+			attribute.StringSlice("smtp.recipients", recipients),
+		),
+	)
+	defer span.End()
+
+	msg := withEnvelopeHeaders(sender, recipients, data)
+
+	var err error
+
+	switch d.format {
+	case sinkMaildir:
+		err = d.writeMaildir(msg)
+	case sinkMbox:
+		err = d.appendMbox(sender, msg)
+	default:
+		err = d.writeEML(msg)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		slog.ErrorContext(ctx, "could not store message",
+			slog.String("component", "filesink"),
+			slog.String("path", d.path),
+			slog.Any("error", err),
+		)
+
+		return smtpd.ErrStoreFailed
+	}
+
+	return nil
+}
+
+// withEnvelopeHeaders prepends the X-Envelope-From and X-Envelope-To headers
+// to the message.
+func withEnvelopeHeaders(sender string, recipients []string, data *message) *message {
+	line, _ := bufio.NewReader(data.reader()).ReadSlice('\n')
+	eol := smtpd.LineEnding(line)
+
+	header := "X-Envelope-From: <" + sender + ">" + eol +
+		"X-Envelope-To: " + strings.Join(recipients, ", ") + eol
+
+	return &message{
+		open: func() io.Reader { return io.MultiReader(strings.NewReader(header), data.reader()) },
+		size: int64(len(header)) + data.size,
+	}
+}
+
+// writeMaildir delivers the message to the Maildir, by writing it to tmp and
+// moving it to new once complete.
+func (d *fileDestination) writeMaildir(msg *message) error {
+	name := fmt.Sprintf("%d.%s.%s", time.Now().Unix(), uuid.NewString(), d.hostName)
+
+	return writeAtomically(filepath.Join(d.path, "tmp", name), filepath.Join(d.path, "new", name), msg)
+}
+
+// writeEML writes the message to its own .eml file.
+func (d *fileDestination) writeEML(msg *message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405Z"), uuid.NewString())
+
+	return writeAtomically(filepath.Join(d.path, "."+name+".tmp"), filepath.Join(d.path, name), msg)
+}
+
+// writeAtomically writes the file at tmp, and renames it to path, so readers
+// never see partial files.
+func writeAtomically(tmp, path string, data *message) error {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, data.reader())
+	if err == nil {
+		err = f.Sync()
+	}
+
+	err = errors.Join(err, f.Close())
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+
+	return err
+}
+
+// appendMbox appends the message to the mbox file, in the mboxrd format:
+// lines starting with "From " (after any ">") are escaped with a ">".
+func (d *fileDestination) appendMbox(sender string, msg *message) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+
+	mu, _ := mboxLocks.LoadOrStore(d.path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString("From " + sender + " " + time.Now().UTC().Format(time.ANSIC) + "\n")
+
+	r := bufio.NewReader(msg.reader())
+	last := byte('\n')
+
+	for {
+		line, rerr := r.ReadSlice('\n')
+		if len(line) > 0 && last == '\n' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			_ = w.WriteByte('>')
+		}
+
+		if len(line) > 0 {
+			_, _ = w.Write(line)
+			last = line[len(line)-1]
+		}
+
+		if rerr == nil || errors.Is(rerr, bufio.ErrBufferFull) {
+			continue
+		}
+
+		if !errors.Is(rerr, io.EOF) {
+			err = rerr
+		}
+
+		break
+	}
+
+	if last != '\n' {
+		_ = w.WriteByte('\n')
+	}
+
+	_ = w.WriteByte('\n')
+
+	return errors.Join(err, w.Flush(), f.Close())
+}
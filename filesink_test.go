@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestFileSinks(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+
+	data := []byte("Subject: test\n\nhello\nFrom the relay\n")
+	want := "X-Envelope-From: <bob@example.com>\nX-Envelope-To: alice@example.com, carol@example.com\n" + string(data)
+
+	send := func(spec string) {
+		t.Helper()
+
+		dest, err := newDestination(ctx, &config{hostName: "relay.example.com"}, []string{spec}, map[string]oauth2.TokenSource{})
+		require.NoError(t, err)
+
+		for range 2 {
+			err = dest.send(ctx, "bob@example.com", []string{"alice@example.com", "carol@example.com"}, newMessage(data))
+			require.NoError(t, err)
+		}
+	}
+
+	send("maildir://" + filepath.Join(dir, "Maildir"))
+
+	tmp, err := os.ReadDir(filepath.Join(dir, "Maildir", "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+
+	msgs, err := os.ReadDir(filepath.Join(dir, "Maildir", "new"))
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.True(t, strings.HasSuffix(msgs[0].Name(), ".relay.example.com"), msgs[0].Name())
+
+	got, err := os.ReadFile(filepath.Join(dir, "Maildir", "new", msgs[0].Name()))
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+
+	send("eml://" + filepath.Join(dir, "eml"))
+
+	msgs, err = os.ReadDir(filepath.Join(dir, "eml"))
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.True(t, strings.HasSuffix(msgs[0].Name(), ".eml"), msgs[0].Name())
+
+	got, err = os.ReadFile(filepath.Join(dir, "eml", msgs[0].Name()))
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+
+	send("mbox://" + filepath.Join(dir, "mail", "catcher.mbox"))
+
+	got, err = os.ReadFile(filepath.Join(dir, "mail", "catcher.mbox"))
+	require.NoError(t, err)
+
+	parts := strings.Split(string(got), "\n\nFrom bob@example.com ")
+	require.Len(t, parts, 2)
+	assert.True(t, strings.HasPrefix(parts[0], "From bob@example.com "), parts[0])
+
+	// lines starting with "From " are escaped
+	assert.Contains(t, parts[0], "\nhello\n>From the relay")
+	assert.Contains(t, parts[1], "\nX-Envelope-To: alice@example.com, carol@example.com\n")
+	assert.True(t, strings.HasSuffix(parts[1], ">From the relay\n\n"))
+}
+
+func TestFileSinkErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+
+	for _, spec := range []string{"maildir://", "mbox://host/file", "eml://relative", "maildir:///tmp?x=1"} {
+		_, _, err := parseFileSink(spec)
+		require.Error(t, err, spec)
+	}
+
+	require.Error(t, validateUpstreams([]string{"eml://" + dir, "smtp.example.com:25"}, &config{}))
+
+	// the directory was removed after startup
+	dest, err := newDestination(ctx, &config{}, []string{"eml://" + filepath.Join(dir, "gone")}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "gone")))
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\n")))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 451, tperr.Code)
+}
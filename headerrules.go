@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+)
+
+// headerRule changes the header fields of relayed messages.
+type headerRule struct {
+	action string // remove, add, set or replace
+	name   string // lowercased, with a trailing '*' matching any suffix
+
+	match func(value string) bool // values removed, nil for all
+	re    *regexp.Regexp          // values replaced
+	value string                  // value added or set, or replacement, with templates
+
+	// the rule only applies if cond reports !condNegated, when set
+	cond        func(header map[string][]string) bool
+	condNegated bool
+}
+
+// loadHeaderRules reads a header rules file.
+func loadHeaderRules(path string) ([]*headerRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseHeaderRules(f)
+}
+
+// parseHeaderRules parses header rules, one per line, applied in order:
+//
+//	remove NAME [MATCH]
+//	add NAME VALUE
+//	set NAME VALUE
+//	replace NAME /REGEXP/ REPLACEMENT
+//
+// remove removes the fields named NAME, or only those with a value matching
+// MATCH: a regular expression ("/^internal/"), or "private-ip" for values
+// holding a private, loopback or link-local IP address. add prepends a field,
+// set replaces the fields with a single one, and replace replaces the parts
+// of the values matching the regular expression, which the replacement can
+// refer to the groups of ("$1"). Names of removed and replaced fields can end
+// with '*' to match any suffix ("X-Internal-*").
+//
+// Each rule can end with a condition, "if NAME [MATCH]" or
+// "unless NAME [MATCH]", applying it only if the message has (or hasn't) a
+// field named NAME, with a value matching MATCH if set.
+//
+// Values and replacements can contain the {uuid}, {peer_ip}, {helo}, {user},
+// {sender} and {hostname} templates. Tokens with spaces can be written as Go
+// quoted strings. Empty lines and lines starting with '#' are ignored.
+func parseHeaderRules(r io.Reader) ([]*headerRule, error) {
+	rules := []*headerRule{}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseHeaderRule(line string) (*headerRule, error) {
+	tokens, err := splitTokens(line)
+	if err != nil {
+		return nil, err
+	}
+
+	// split the condition off
+	var cond []string
+
+	for i, token := range tokens {
+		if token == "if" || token == "unless" {
+			tokens, cond = tokens[:i], tokens[i:]
+			break
+		}
+	}
+
+	if len(tokens) < 2 {
+		return nil, errors.New("expected an action and a header name")
+	}
+
+	rule := &headerRule{action: tokens[0], name: strings.ToLower(tokens[1])}
+	args := tokens[2:]
+
+	switch rule.action {
+	case "remove":
+		if len(args) > 1 {
+			return nil, errors.New("expected a header name and an optional match")
+		}
+
+		if len(args) == 1 {
+			rule.match, err = parseHeaderMatch(args[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "add", "set":
+		if len(args) != 1 {
+			return nil, errors.New("expected a header name and a value")
+		}
+
+		if strings.HasSuffix(rule.name, "*") {
+			return nil, fmt.Errorf("%s needs a full header name", rule.action)
+		}
+
+		// keep the name as written
+		rule.name = tokens[1]
+		rule.value = args[0]
+	case "replace":
+		if len(args) != 2 {
+			return nil, errors.New("expected a header name, a regular expression and a replacement")
+		}
+
+		rule.re, err = parseSlashRegexp(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		rule.value = args[1]
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	if !validHeaderName(strings.TrimSuffix(rule.name, "*")) {
+		return nil, fmt.Errorf("invalid header name %q", rule.name)
+	}
+
+	if len(cond) > 0 {
+		if len(cond) < 2 || len(cond) > 3 {
+			return nil, fmt.Errorf("expected a header name and an optional match after %q", cond[0])
+		}
+
+		name := strings.ToLower(cond[1])
+
+		var match func(string) bool
+
+		if len(cond) == 3 {
+			match, err = parseHeaderMatch(cond[2])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rule.condNegated = cond[0] == "unless"
+		rule.cond = func(header map[string][]string) bool {
+			for key, values := range header {
+				if !nameMatches(name, key) {
+					continue
+				}
+
+				for _, value := range values {
+					if match == nil || match(value) {
+						return true
+					}
+				}
+			}
+
+			return false
+		}
+	}
+
+	return rule, nil
+}
+
+// splitTokens splits a line on spaces, unquoting the Go quoted strings in
+// tokens ("a b", or key="a b").
+func splitTokens(line string) ([]string, error) {
+	tokens := []string{}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		token := strings.Builder{}
+
+		for line != "" && !unicode.IsSpace(rune(line[0])) {
+			if line[0] == '"' {
+				quoted, err := strconv.QuotedPrefix(line)
+				if err != nil {
+					return nil, fmt.Errorf("invalid quoted string: %w", err)
+				}
+
+				unquoted, _ := strconv.Unquote(quoted)
+				token.WriteString(unquoted)
+				line = line[len(quoted):]
+
+				continue
+			}
+
+			end := strings.IndexFunc(line, func(r rune) bool { return r == '"' || unicode.IsSpace(r) })
+			if end < 0 {
+				end = len(line)
+			}
+
+			token.WriteString(line[:end])
+			line = line[end:]
+		}
+
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
+
+// parseHeaderMatch parses a match of header values: a regular expression
+// between slashes, or "private-ip".
+func parseHeaderMatch(s string) (func(string) bool, error) {
+	if s == "private-ip" {
+		return hasPrivateIP, nil
+	}
+
+	re, err := parseSlashRegexp(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return re.MatchString, nil
+}
+
+func parseSlashRegexp(s string) (*regexp.Regexp, error) {
+	if len(s) < 2 || !strings.HasPrefix(s, "/") || !strings.HasSuffix(s, "/") {
+		return nil, fmt.Errorf("expected a regular expression between slashes, got %q", s)
+	}
+
+	re, err := regexp.Compile(s[1 : len(s)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %w", s, err)
+	}
+
+	return re, nil
+}
+
+// hasPrivateIP reports whether a header value holds a private, loopback or
+// link-local IP address, as found in Received headers ("[10.0.0.1]",
+// "[IPv6:fd00::1]").
+func hasPrivateIP(value string) bool {
+	value = strings.ReplaceAll(value, "IPv6:", " ")
+
+	words := strings.FieldsFunc(value, func(r rune) bool {
+		return !(r == '.' || r == ':' || unicode.Is(unicode.ASCII_Hex_Digit, r))
+	})
+
+	for _, word := range words {
+		ip, err := netip.ParseAddr(word)
+		if err != nil {
+			continue
+		}
+
+		ip = ip.Unmap()
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nameMatches reports whether a header key matches a lowercased rule name.
+func nameMatches(name, key string) bool {
+	key = strings.ToLower(key)
+
+	if prefix, ok := strings.CutSuffix(name, "*"); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+
+	return key == name
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply applies the rule to the message, expanding templates with vars, and
+// returns the number of fields changed.
+func (rule *headerRule) apply(env *smtpd.Envelope, vars *strings.Replacer) int {
+	if rule.cond != nil && rule.cond(env.Header) == rule.condNegated {
+		return 0
+	}
+
+	changed := 0
+
+	switch rule.action {
+	case "remove":
+		env.RewriteHeader(func(key, value string) (string, bool) {
+			if nameMatches(rule.name, key) && (rule.match == nil || rule.match(value)) {
+				changed++
+				return value, false
+			}
+
+			return value, true
+		})
+	case "add":
+		env.AddHeader(rule.name, vars.Replace(rule.value))
+		changed++
+	case "set":
+		env.SetHeader(rule.name, vars.Replace(rule.value))
+		changed++
+	case "replace":
+		replacement := vars.Replace(rule.value)
+
+		env.RewriteHeader(func(key, value string) (string, bool) {
+			if !nameMatches(rule.name, key) {
+				return value, true
+			}
+
+			newValue := rule.re.ReplaceAllString(value, replacement)
+			if newValue != value {
+				changed++
+			}
+
+			return newValue, true
+		})
+	}
+
+	return changed
+}
+
+// rewriteHeaders applies the header rules to a message.
+func (r *relay) rewriteHeaders(ctx context.Context, id string, peer smtpd.Peer, env *smtpd.Envelope) {
+	if len(r.headerRules) == 0 {
+		return
+	}
+
+	peerIP := ""
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		peerIP = addr.IP.String()
+	}
+
+	vars := strings.NewReplacer(
+		"{uuid}", id,
+		"{peer_ip}", peerIP,
+		"{helo}", peer.HeloName,
+		"{user}", peer.Username,
+		"{sender}", env.Sender,
+		"{hostname}", r.cfg.hostName,
+	)
+
+	changed := 0
+	for _, rule := range r.headerRules {
+		changed += rule.apply(env, vars)
+	}
+
+	slog.DebugContext(ctx, "header rules applied", slog.String("component", "header_rules"),
+		slog.String("uuid", id), slog.Int("changed", changed))
+}
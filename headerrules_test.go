@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseHeaderRules(strings.NewReader(`
+# internal headers
+remove X-Internal-*
+remove Received private-ip
+add X-Relay-Id {uuid}
+add X-Origin "from {helo} [{peer_ip}] as {user}" if X-Mailer /^app/
+set X-Sensitivity Private unless X-Sensitivity
+replace Subject /^\[(\w+)\]/ "($1)"
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 6)
+
+	r := &relay{cfg: &config{hostName: "relay.example.com"}, headerRules: rules}
+
+	env := testEnvelope("bob@example.com", nil,
+		"Received: from app ([10.1.2.3]) by gw;\r\n\tMon, 1 Jan 2024 00:00:00 +0000\r\n"+
+			"Received: from mx.example.net ([198.51.100.7]) by gw; Mon, 1 Jan 2024 00:00:00 +0000\r\n"+
+			"Received: from v6 ([IPv6:fe80::1]) by gw; Mon, 1 Jan 2024 00:00:00 +0000\r\n"+
+			"X-Internal-Trace: abc\r\n"+
+			"x-internal-user: bob\r\n"+
+			"X-Mailer: app 1.0\r\n"+
+			"Subject: [billing] invoice\r\n"+
+			"\r\n"+
+			"X-Internal-Trace: in the body\r\n")
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, HeloName: "app.example.com", Username: "app"}
+
+	r.rewriteHeaders(t.Context(), "1234", peer, env)
+
+	assert.Equal(t, "X-Sensitivity: Private\r\n"+
+		"X-Origin: from app.example.com [192.0.2.1] as app\r\n"+
+		"X-Relay-Id: 1234\r\n"+
+		"Received: from mx.example.net ([198.51.100.7]) by gw; Mon, 1 Jan 2024 00:00:00 +0000\r\n"+
+		"X-Mailer: app 1.0\r\n"+
+		"Subject: (billing) invoice\r\n"+
+		"\r\n"+
+		"X-Internal-Trace: in the body\r\n", envelopeData(t, env))
+	assert.Equal(t, "(billing) invoice", env.Header.Get("Subject"))
+	assert.Empty(t, env.Header.Get("X-Internal-Trace"))
+
+	// conditions
+	env = testEnvelope("", nil, "X-Sensitivity: Personal\r\nX-Mailer: other\r\n\r\nbody\r\n")
+
+	r.rewriteHeaders(t.Context(), "5678", peer, env)
+
+	assert.Equal(t, "X-Relay-Id: 5678\r\nX-Sensitivity: Personal\r\nX-Mailer: other\r\n\r\nbody\r\n", envelopeData(t, env))
+
+	for _, bad := range []string{
+		"remove",
+		"drop X-Foo",
+		"remove X-Foo not-a-match",
+		"remove X-Foo /(/",
+		"add X-Foo",
+		"add X-* value",
+		"set X-Foo a b",
+		"replace Subject foo bar",
+		"replace Subject /foo/",
+		"remove Bad:Name",
+		"remove X-Foo if",
+		`add X-Foo "unterminated`,
+	} {
+		_, err := parseHeaderRules(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestHasPrivateIP(t *testing.T) {
+	t.Parallel()
+
+	for value, want := range map[string]bool{
+		"from a ([10.0.0.1]) by b":               true,
+		"from a (a.internal [172.16.5.4]) by b":  true,
+		"from a ([127.0.0.1]) by b":              true,
+		"from a ([IPv6:fd00::1]) by b":           true,
+		"from a ([::ffff:192.168.1.1]) by b":     true,
+		"from a ([198.51.100.7]) by b":           false,
+		"from a ([IPv6:2001:db8::1]) by b":       false,
+		"by b; Mon, 1 Jan 2024 10:00:00 +0000":   false,
+		"from cafe.example.com (deadbeef) by b;": false,
+	} {
+		assert.Equal(t, want, hasPrivateIP(value), value)
+	}
+}
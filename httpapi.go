@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// Formats of the messages posted to HTTP APIs, as set in remote_http_format.
+const (
+	httpFormatRaw  = "raw"  // the message itself, with the envelope in headers
+	httpFormatJSON = "json" // a JSON envelope holding the message
+)
+
+// httpDestination delivers messages by posting them to an HTTP API, for
+// environments where outgoing SMTP is blocked.
+type httpDestination struct {
+	url    *url.URL // without credentials
+	client *http.Client
+
+	// request returns the request posting the message to the URL
+	request func(ctx context.Context, target, sender string, recipients []string, msg *message) (*http.Request, error)
+
+	// authorize sets the credentials of the request, if any
+	authorize func(req *http.Request) error
+}
+
+// httpEnvelope is the body posted in the json format.
+type httpEnvelope struct {
+	Sender     string   `json:"sender"`
+	Recipients []string `json:"recipients"`
+	Data       []byte   `json:"data"` // base64-encoded
+}
+
+// isHTTP reports whether the upstream spec requests delivery to an HTTP API.
+func isHTTP(spec string) bool {
+	return strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://")
+}
+
+// parseHTTP parses the URL of an HTTP API, and checks the remote_http
+// settings.
+func parseHTTP(spec string, cfg *config) (*url.URL, error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	switch cfg.remoteHTTPFormat {
+	case "", httpFormatRaw, httpFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported remote_http_format %q", cfg.remoteHTTPFormat)
+	}
+
+	return parsed, nil
+}
+
+// newHTTPDestination returns a destination posting messages to the URL. The
+// request is authenticated with, in order of precedence: the credentials in
+// the URL (basic), an OAuth2 token if remote_auth is an OAuth2 method,
+// remote_http_token (bearer), or remote_user and remote_pass (basic).
+func newHTTPDestination(ctx context.Context, spec string, cfg *config, tokenSources map[string]oauth2.TokenSource) (*httpDestination, error) {
+	parsed, err := parseHTTP(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &httpDestination{
+		client:    newHTTPClient(cfg),
+		request:   rawRequest,
+		authorize: func(*http.Request) error { return nil },
+	}
+
+	if cfg.remoteHTTPFormat == httpFormatJSON {
+		d.request = jsonRequest
+	}
+
+	switch {
+	case parsed.User != nil:
+		user := parsed.User.Username()
+		pass, _ := parsed.User.Password()
+		d.authorize = basicAuth(user, pass)
+	case isOAuth2(cfg.remoteAuth):
+		d.authorize = oauth2Auth(ctx, cfg, tokenSources)
+	case cfg.remoteHTTPToken != "":
+		d.authorize = func(req *http.Request) error {
+			req.Header.Set("Authorization", "Bearer "+cfg.remoteHTTPToken)
+			return nil
+		}
+	case cfg.remoteUser != "":
+		d.authorize = basicAuth(cfg.remoteUser, cfg.remotePass)
+	}
+
+	parsed.User = nil
+	d.url = parsed
+
+	return d, nil
+}
+
+// newHTTPClient returns a client for HTTP APIs, using the TLS settings with
+// upstreams. Requests are bounded by remote_data_timeout.
+func newHTTPClient(cfg *config) *http.Client {
+	tlsConfig := remoteTLSConfig(cfg)
+	tlsConfig.ServerName = cfg.remoteTLSServerName
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := cfg.remoteDataTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// isOAuth2 reports whether the remote_auth method uses OAuth2 tokens.
+func isOAuth2(method string) bool {
+	return method == "xoauth2" || method == "xoauth2_client_credentials"
+}
+
+func basicAuth(user, pass string) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		req.SetBasicAuth(user, pass)
+		return nil
+	}
+}
+
+// oauth2Auth returns a function authorizing requests with a token of the
+// remote_auth OAuth2 method, sharing the token source with the upstreams
+// using it.
+func oauth2Auth(ctx context.Context, cfg *config, tokenSources map[string]oauth2.TokenSource) func(req *http.Request) error {
+	if _, ok := tokenSources[cfg.remoteAuth]; !ok {
+		tokenSources[cfg.remoteAuth] = newOAuth2TokenSource(ctx, cfg, cfg.remoteAuth)
+	}
+
+	tokenSource := tokenSources[cfg.remoteAuth]
+
+	return func(req *http.Request) error {
+		token, err := tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("OAuth2 token fetching failed: %w", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+		return nil
+	}
+}
+
+func (d *httpDestination) start(_ context.Context) {}
+
+// String returns the URL of the API, without credentials.
+func (d *httpDestination) String() string {
+	return d.url.String()
+}
+
+// send posts the message to the API. Replies other than 2xx are mapped onto
+// SMTP replies by httpStatusError.
+func (d *httpDestination) send(ctx context.Context, sender string, recipients []string, data *message) error {
+	ctx, span := tracer.Start(ctx, "relay.http",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("url.full", d.url.String()),
+			attribute.StringSlice("smtp.recipients", recipients),
+		),
+	)
+	defer span.End()
+
+	err := d.post(ctx, sender, recipients, data)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+func (d *httpDestination) post(ctx context.Context, sender string, recipients []string, data *message) error {
+	req, err := d.request(ctx, d.url.String(), sender, recipients, data)
+	if err != nil {
+		return err
+	}
+
+	if err := d.authorize(req); err != nil {
+		return &upstreamError{addr: d.url.Host, err: err}
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return &upstreamError{addr: d.url.Host, err: err}
+	}
+	defer resp.Body.Close()
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	// the start of the body usually explains the failure, but may reveal
+	// details of the API, so it's only logged
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	slog.WarnContext(ctx, "HTTP API request failed",
+		slog.String("component", "http"),
+		slog.String("host", d.url.Host),
+		slog.Int("status_code", resp.StatusCode),
+		slog.String("body", strings.TrimSpace(string(body))),
+	)
+
+	return httpStatusError(resp.StatusCode)
+}
+
+// jsonRequest posts an httpEnvelope.
+func jsonRequest(ctx context.Context, target, sender string, recipients []string, msg *message) (*http.Request, error) {
+	data, err := msg.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(httpEnvelope{Sender: sender, Recipients: recipients, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+// rawRequest streams the message itself, with the envelope in headers.
+func rawRequest(ctx context.Context, target, sender string, recipients []string, msg *message) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, msg.reader())
+	if err != nil {
+		return nil, err
+	}
+
+	// so the request can be retried on redirects, and isn't chunked
+	req.ContentLength = msg.size
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(msg.reader()), nil }
+
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Envelope-From", sender)
+
+	for _, rcpt := range recipients {
+		req.Header.Add("X-Envelope-To", rcpt)
+	}
+
+	return req, nil
+}
+
+// httpStatusError maps an HTTP API failure onto an SMTP reply, with a fixed
+// text. Failures of the API itself are temporary, while rejections of the
+// request are permanent.
+func httpStatusError(status int) *textproto.Error {
+	const (
+		failed   = "Upstream API error"
+		rejected = "Upstream API rejected message"
+	)
+
+	switch {
+	case status == http.StatusRequestEntityTooLarge:
+		return &textproto.Error{Code: 552, Msg: "5.3.4 " + rejected}
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &textproto.Error{Code: 451, Msg: "4.7.0 " + failed}
+	case status == http.StatusTooManyRequests:
+		return &textproto.Error{Code: 451, Msg: "4.7.1 " + failed}
+	case status == http.StatusRequestTimeout || status >= 500 || status < 400:
+		return &textproto.Error{Code: 451, Msg: "4.3.0 " + failed}
+	default:
+		return &textproto.Error{Code: 554, Msg: "5.3.0 " + rejected}
+	}
+}
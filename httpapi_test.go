@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// httpRequest is a request received by the test API.
+type httpRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// startTestHTTPAPI starts an HTTPS API replying with the given status, and
+// returns the settings trusting it.
+func startTestHTTPAPI(t *testing.T, status int, reply string) (*httptest.Server, *config, <-chan httpRequest) {
+	t.Helper()
+
+	reqs := make(chan httpRequest, 1)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		reqs <- httpRequest{header: r.Header, body: body}
+
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	return srv, &config{remoteTLS: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots}}, reqs
+}
+
+func TestHTTPDestinationRaw(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv, cfg, reqs := startTestHTTPAPI(t, http.StatusAccepted, "")
+
+	dest, err := newDestination(ctx, cfg, []string{"https://api:s3cret@" + srv.Listener.Addr().String() + "/send"}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	// credentials aren't logged
+	assert.Equal(t, srv.URL+"/send", dest.String())
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com", "carol@example.com"}, newMessage([]byte("Subject: test\r\n\r\nhello\r\n")))
+	require.NoError(t, err)
+
+	req := <-reqs
+	assert.Equal(t, "message/rfc822", req.header.Get("Content-Type"))
+	assert.Equal(t, "bob@example.com", req.header.Get("X-Envelope-From"))
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, req.header.Values("X-Envelope-To"))
+	assert.Equal(t, "Subject: test\r\n\r\nhello\r\n", string(req.body))
+
+	user, pass, ok := (&http.Request{Header: req.header}).BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, "api", user)
+	assert.Equal(t, "s3cret", pass)
+}
+
+func TestHTTPDestinationJSON(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv, cfg, reqs := startTestHTTPAPI(t, http.StatusOK, "")
+	cfg.remoteHTTPFormat = "json"
+	cfg.remoteHTTPToken = "t0ken"
+
+	dest, err := newDestination(ctx, cfg, []string{srv.URL}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\r\n")))
+	require.NoError(t, err)
+
+	req := <-reqs
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equal(t, "Bearer t0ken", req.header.Get("Authorization"))
+
+	var env httpEnvelope
+	require.NoError(t, json.Unmarshal(req.body, &env))
+	assert.Equal(t, httpEnvelope{Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Data: []byte("hello\r\n")}, env)
+
+	// the data is base64-encoded
+	assert.Contains(t, string(req.body), `"data":"aGVsbG8NCg=="`)
+}
+
+func TestHTTPDestinationOAuth2(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv, cfg, reqs := startTestHTTPAPI(t, http.StatusOK, "")
+	cfg.remoteAuth = "xoauth2_client_credentials"
+
+	tokenSources := map[string]oauth2.TokenSource{
+		"xoauth2_client_credentials": oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access"}),
+	}
+
+	dest, err := newDestination(ctx, cfg, []string{srv.URL}, tokenSources)
+	require.NoError(t, err)
+
+	require.NoError(t, dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\r\n"))))
+
+	req := <-reqs
+	assert.Equal(t, "Bearer access", req.header.Get("Authorization"))
+}
+
+func TestHTTPDestinationErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv, cfg, _ := startTestHTTPAPI(t, http.StatusServiceUnavailable, "maintenance\nuntil noon")
+
+	dest, err := newDestination(ctx, cfg, []string{srv.URL}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\r\n")))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 451, tperr.Code)
+	// the body isn't sent to the client
+	assert.Equal(t, "4.3.0 Upstream API error", tperr.Msg)
+
+	// the server isn't trusted without the CA
+	dest, err = newDestination(ctx, &config{}, []string{srv.URL}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\r\n")))
+
+	var uerr *upstreamError
+	require.ErrorAs(t, err, &uerr)
+
+	// APIs are the only upstream
+	_, err = newDestination(ctx, cfg, []string{srv.URL, "smtp.example.com:25"}, map[string]oauth2.TokenSource{})
+	require.Error(t, err)
+	require.Error(t, validateUpstreams([]string{srv.URL, "smtp.example.com:25"}, cfg))
+	require.Error(t, validateUpstreams([]string{srv.URL}, &config{remoteHTTPFormat: "xml"}))
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	t.Parallel()
+
+	for status, want := range map[int]int{
+		http.StatusBadRequest:            554,
+		http.StatusUnprocessableEntity:   554,
+		http.StatusUnauthorized:          451,
+		http.StatusForbidden:             451,
+		http.StatusRequestTimeout:        451,
+		http.StatusRequestEntityTooLarge: 552,
+		http.StatusTooManyRequests:       451,
+		http.StatusInternalServerError:   451,
+		http.StatusBadGateway:            451,
+		http.StatusFound:                 451,
+	} {
+		assert.Equal(t, want, httpStatusError(status).Code, status)
+	}
+}
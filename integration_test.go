@@ -4,13 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"net"
+	"net/http"
 	"net/smtp"
 	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/grafana/smtprelay/v2/internal/catcher"
 	"github.com/grafana/smtprelay/v2/internal/smtpd"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
@@ -18,13 +24,24 @@ import (
 )
 
 type testSMTPServer struct {
+	mu   *sync.Mutex
 	msgs *[]smtpd.Envelope
 	addr string
 }
 
+// messages returns a copy of the received messages, safe to call while the
+// server is receiving.
+func (s *testSMTPServer) messages() []smtpd.Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]smtpd.Envelope{}, *s.msgs...)
+}
+
 func startTestSMTPServer(ctx context.Context, t *testing.T) *testSMTPServer {
 	t.Helper()
 
+	mu := &sync.Mutex{}
 	msgs := &[]smtpd.Envelope{}
 	srv := &smtpd.Server{
 		ConnectionChecker: func(_ context.Context, peer smtpd.Peer) error {
@@ -41,10 +58,26 @@ func startTestSMTPServer(ctx context.Context, t *testing.T) *testSMTPServer {
 		},
 		RecipientChecker: func(_ context.Context, _ smtpd.Peer, addr string) error {
 			t.Logf("RCPT TO %s", addr)
+
+			// lets tests exercise rejected recipients
+			if strings.HasPrefix(addr, "nobody@") {
+				return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+			}
+
 			return nil
 		},
 		Handler: func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
-			t.Logf("DATA\n----\n%s\n----", env.Data)
+			// keep a copy, the message can't be read after returning
+			data, err := env.Bytes()
+			if err != nil {
+				return err
+			}
+
+			env.SetData(data)
+
+			t.Logf("DATA\n----\n%s\n----", data)
+			mu.Lock()
+			defer mu.Unlock()
 			m := append(*msgs, env)
 			*msgs = m
 			return nil
@@ -62,7 +95,7 @@ func startTestSMTPServer(ctx context.Context, t *testing.T) *testSMTPServer {
 		_ = srv.Shutdown(false)
 	})
 
-	return &testSMTPServer{addr: l.Addr().String(), msgs: msgs}
+	return &testSMTPServer{addr: l.Addr().String(), msgs: msgs, mu: mu}
 }
 
 func sendMsg(t *testing.T, addr string, to []string, from, subject string, hdrs textproto.MIMEHeader, body string) error {
@@ -145,7 +178,7 @@ func TestSendMail(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, *srv.msgs, 1)
 
-	r := bufio.NewReader(bytes.NewReader((*srv.msgs)[0].Data))
+	r := bufio.NewReader(strings.NewReader(envelopeData(t, &(*srv.msgs)[0])))
 	msg := textproto.NewReader(r)
 	hdr, err := msg.ReadMIMEHeader()
 	require.NoError(t, err)
@@ -220,3 +253,534 @@ func TestRateLimitByHeader(t *testing.T) {
 	// verify two messages received
 	assert.Len(t, *srv.msgs, 2)
 }
+
+//nolint:paralleltest
+func TestSendMailSpooled(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	spoolDir := t.TempDir()
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.spoolDir = spoolDir
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com", "carol@example.com"},
+		"bob@example.com", "spooled message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(srv.messages()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	msg := srv.messages()[0]
+	assert.Equal(t, "bob@example.com", msg.Sender)
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, msg.Recipients)
+	assert.Equal(t, "spooled message", msg.Header.Get("Subject"))
+	assert.NotEmpty(t, msg.Header.Get("Received"))
+
+	// the spool is emptied once the message is delivered
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(spoolDir)
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+//nolint:paralleltest
+func TestSendMailPartialRecipients(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+	addr := startRelay(ctx, t, srv.addr)
+
+	// one rejected recipient doesn't prevent delivery to the others
+	err := sendMsg(t, addr, []string{"alice@example.com", "nobody@example.com", "bob@example.com"},
+		"dave@example.com", "partial", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, srv.messages(), 2)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, srv.messages()[0].Recipients)
+
+	// the client wasn't told, so the sender is notified even though
+	// dsn_enabled isn't set
+	dsn := srv.messages()[1]
+	assert.Empty(t, dsn.Sender)
+	assert.Equal(t, []string{"dave@example.com"}, dsn.Recipients)
+	assert.Contains(t, envelopeData(t, &dsn), "Final-Recipient: rfc822; nobody@example.com\n")
+
+	// when all recipients are rejected, so is the message
+	err = sendMsg(t, addr, []string{"nobody@example.com"},
+		"dave@example.com", "rejected", textproto.MIMEHeader{}, "hello world")
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 550, tperr.Code)
+	assert.Len(t, srv.messages(), 2)
+}
+
+//nolint:paralleltest
+func TestSendMailBounce(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.spoolDir = t.TempDir()
+		cfg.spoolWorkers = 1
+		cfg.dsnEnabled = true
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com", "nobody@example.com"},
+		"dave@example.com", "bounced", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	// the message, then the notification of the rejected recipient
+	require.Eventually(t, func() bool {
+		return len(srv.messages()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dsn := srv.messages()[1]
+	assert.Empty(t, dsn.Sender)
+	assert.Equal(t, []string{"dave@example.com"}, dsn.Recipients)
+	data := envelopeData(t, &dsn)
+	assert.Contains(t, data, "Final-Recipient: rfc822; nobody@example.com\n")
+	assert.Contains(t, data, "Diagnostic-Code: smtp; 550 5.1.1 No such user\n")
+	assert.Contains(t, data, "Subject: bounced\n")
+}
+
+//nolint:paralleltest
+func TestSendMailBounceRemoteSender(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.spoolDir = t.TempDir()
+		cfg.spoolWorkers = 1
+		cfg.dsnEnabled = true
+		cfg.remoteSender = "relay@example.net"
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com", "nobody@example.com"},
+		"dave@example.com", "bounced", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(srv.messages()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "relay@example.net", srv.messages()[0].Sender)
+
+	// the notification goes to the original sender, not remote_sender
+	dsn := srv.messages()[1]
+	assert.Empty(t, dsn.Sender)
+	assert.Equal(t, []string{"dave@example.com"}, dsn.Recipients)
+}
+
+//nolint:paralleltest
+func TestSendMailToMaildir(t *testing.T) {
+	ctx := t.Context()
+
+	maildir := filepath.Join(t.TempDir(), "Maildir")
+	addr := startRelay(ctx, t, "maildir://"+maildir)
+
+	err := sendMsg(t, addr, []string{"alice@example.com", "bob@example.com"},
+		"dave@example.com", "caught", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	msgs, err := os.ReadDir(filepath.Join(maildir, "new"))
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	f, err := os.Open(filepath.Join(maildir, "new", msgs[0].Name()))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	hdr, err := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	assert.Equal(t, "<dave@example.com>", hdr.Get("X-Envelope-From"))
+	assert.Equal(t, "alice@example.com, bob@example.com", hdr.Get("X-Envelope-To"))
+	assert.Equal(t, "caught", hdr.Get("Subject"))
+	assert.NotEmpty(t, hdr.Get("Received"))
+}
+
+//nolint:paralleltest
+func TestSendMailToCatcher(t *testing.T) {
+	ctx := t.Context()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	metricsAddr := l.Addr().String()
+	_ = l.Close()
+
+	addr := startRelayWithConfig(ctx, t, "catcher://", func(cfg *config) {
+		cfg.metricsListen = metricsAddr
+		cfg.catcher = catcher.NewStore(10)
+	})
+
+	err = sendMsg(t, addr, []string{"alice@example.com", "bob@example.com"},
+		"dave@example.com", "caught", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+metricsAddr+"/catcher/api/messages", nil)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	msgs := []catcher.Message{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&msgs))
+	require.Len(t, msgs, 1)
+
+	assert.Equal(t, "dave@example.com", msgs[0].Sender)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, msgs[0].Recipients)
+	assert.Equal(t, "caught", msgs[0].Subject)
+}
+
+//nolint:paralleltest
+func TestSendMailSRS(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.srsDomain = "relay.example.org"
+		cfg.srsSecret = "secret"
+		cfg.srsMaxAge = 24 * time.Hour
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.net"}, "dave@example.com", "forwarded", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, srv.messages(), 1)
+
+	srsSender := srv.messages()[0].Sender
+	assert.Regexp(t, `^SRS0=.{4}=..=example\.com=dave@relay\.example\.org$`, srsSender)
+
+	// bounces to the SRS address reach the original sender
+	err = sendMsg(t, addr, []string{srsSender}, "", "bounce", textproto.MIMEHeader{}, "undeliverable")
+	require.NoError(t, err)
+
+	require.Len(t, srv.messages(), 2)
+	assert.Equal(t, []string{"dave@example.com"}, srv.messages()[1].Recipients)
+
+	// and forged ones are refused
+	err = sendMsg(t, addr, []string{"SRS0=AAAA=AA=example.com=dave@relay.example.org"}, "", "forged", textproto.MIMEHeader{}, "spam")
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 550, tperr.Code)
+	assert.Len(t, srv.messages(), 2)
+}
+
+//nolint:paralleltest
+func TestSendMailHeaderRules(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	path := filepath.Join(t.TempDir(), "header_rules")
+	require.NoError(t, os.WriteFile(path, []byte("remove Received private-ip\nremove X-Internal-*\nadd X-Relayed-By {hostname}\n"), 0o600))
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.headerRules = path
+		cfg.hostName = "relay.example.com"
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "rules",
+		textproto.MIMEHeader{"X-Internal-Token": {"secret"}}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, srv.messages(), 1)
+
+	hdr := srv.messages()[0].Header
+	assert.Empty(t, hdr.Get("X-Internal-Token"))
+	assert.Equal(t, "rules", hdr.Get("Subject"))
+	assert.Equal(t, "relay.example.com", hdr.Get("X-Relayed-By"))
+
+	// so is the relay's own Received header, with the loopback client IP
+	assert.Empty(t, hdr.Values("Received"))
+}
+
+//nolint:paralleltest
+func TestSendMailRedirected(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.redirectTo = "staging@example.com"
+		cfg.redirectExclude = "internal.example"
+	})
+
+	err := sendMsg(t, addr, []string{"alice@customer.example", "bob@internal.example", "carol@customer.example"},
+		"dave@example.com", "staging", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, srv.messages(), 1)
+
+	msg := srv.messages()[0]
+	assert.Equal(t, []string{"staging@example.com", "bob@internal.example"}, msg.Recipients)
+	assert.Equal(t, []string{"alice@customer.example", "carol@customer.example"}, msg.Header.Values("X-Original-To"))
+	assert.Equal(t, "alice@customer.example, bob@internal.example, carol@customer.example", msg.Header.Get("To"))
+}
+
+//nolint:paralleltest
+func TestSendMailJournaled(t *testing.T) {
+	ctx := t.Context()
+
+	// required reports are sent before delivering the message, others after,
+	// and spooled messages are journaled once delivered by the queue
+	for _, tc := range []struct {
+		required, spooled bool
+	}{
+		{required: false},
+		{required: true},
+		{spooled: true},
+	} {
+		srv := startTestSMTPServer(ctx, t)
+
+		archive := t.TempDir()
+
+		addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+			cfg.journalTo = "archive@example.com"
+			cfg.journalHost = "eml://" + archive
+			cfg.journalRequired = tc.required
+			cfg.remoteSender = "relay@example.net"
+
+			if tc.spooled {
+				cfg.spoolDir = t.TempDir()
+				cfg.spoolWorkers = 1
+			}
+		})
+
+		err := sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "journaled", textproto.MIMEHeader{}, "hello world")
+		require.NoError(t, err)
+
+		var reports []os.DirEntry
+
+		require.Eventually(t, func() bool {
+			reports, err = os.ReadDir(archive)
+			return err == nil && len(reports) == 1
+		}, 5*time.Second, 10*time.Millisecond, "%+v", tc)
+
+		require.Len(t, srv.messages(), 1)
+
+		// reports have the original sender, not remote_sender
+		report, err := os.ReadFile(filepath.Join(archive, reports[0].Name()))
+		require.NoError(t, err)
+		assert.Contains(t, string(report), "Sender: bob@example.com\r\n", "%+v", tc)
+		assert.Contains(t, string(report), "To: alice@example.com\r\n")
+		assert.Contains(t, string(report), "Subject: journaled\r\n")
+	}
+}
+
+//nolint:paralleltest
+func TestSendMailJournalRequired(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	// nothing listens there
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.journalTo = "archive@example.com"
+		cfg.journalHost = l.Addr().String()
+		cfg.journalRequired = true
+	})
+
+	err = sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "journaled", textproto.MIMEHeader{}, "hello world")
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 451, tperr.Code)
+
+	// the message wasn't delivered, so it won't be duplicated when retried
+	assert.Empty(t, srv.messages())
+}
+
+//nolint:paralleltest
+func TestSendMailMirrored(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+	sandbox := startTestSMTPServer(ctx, t)
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.mirrorHost = sandbox.addr
+		cfg.mirrorSample = 100
+		cfg.mirrorMaxPending = 10
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com", "nobody@example.com"},
+		"bob@example.com", "mirrored", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	// the message, then the notification of the rejected recipient
+	require.Len(t, srv.messages(), 2)
+
+	require.Eventually(t, func() bool {
+		return len(sandbox.messages()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	msg := sandbox.messages()[0]
+	assert.Equal(t, "bob@example.com", msg.Sender)
+	assert.Equal(t, []string{"alice@example.com"}, msg.Recipients)
+	assert.Equal(t, envelopeData(t, &srv.messages()[0]), envelopeData(t, &msg))
+}
+
+//nolint:paralleltest
+func TestSendMailMirrorDown(t *testing.T) {
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	// nothing listens there
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.mirrorHost = l.Addr().String()
+		cfg.mirrorSample = 100
+		cfg.mirrorMaxPending = 10
+	})
+
+	err = sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "mirrored", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	assert.Len(t, srv.messages(), 1)
+}
+
+//nolint:paralleltest
+func TestSendMailCircuitBreaker(t *testing.T) {
+	ctx := t.Context()
+
+	// nothing listens there
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	addr := startRelayWithConfig(ctx, t, l.Addr().String(), func(cfg *config) {
+		cfg.circuitBreakerFailures = 2
+		cfg.circuitBreakerWindow = time.Minute
+		cfg.circuitBreakerCooldown = time.Minute
+	})
+
+	var tperr *textproto.Error
+
+	for range 2 {
+		err = sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "down", textproto.MIMEHeader{}, "hello world")
+		require.ErrorAs(t, err, &tperr)
+		assert.Equal(t, smtpd.ErrForwardingFailed.Code, tperr.Code)
+	}
+
+	// the circuit is open, messages are deferred at MAIL FROM
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	err = c.Mail("bob@example.com")
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 451, tperr.Code)
+}
+
+//nolint:paralleltest
+func TestSendMailCircuitBreakerResponseMap(t *testing.T) {
+	ctx := t.Context()
+
+	path := filepath.Join(t.TempDir(), "response_map")
+	require.NoError(t, os.WriteFile(path, []byte(`code=550 -> code=421`+"\n"), 0o600))
+
+	srv := startTestSMTPServer(ctx, t)
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.responseMap = path
+		cfg.circuitBreakerFailures = 2
+		cfg.circuitBreakerWindow = time.Minute
+		cfg.circuitBreakerCooldown = time.Minute
+	})
+
+	var tperr *textproto.Error
+
+	for range 2 {
+		err := sendMsg(t, addr, []string{"nobody@example.com"}, "bob@example.com", "rejected", textproto.MIMEHeader{}, "hello world")
+		require.ErrorAs(t, err, &tperr)
+		assert.Equal(t, 421, tperr.Code)
+	}
+
+	// the upstream replied, mapping its rejections doesn't open the circuit
+	err := sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "delivered", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+}
+
+//nolint:paralleltest
+func TestSendMailResponseMap(t *testing.T) {
+	ctx := t.Context()
+
+	path := filepath.Join(t.TempDir(), "response_map")
+	require.NoError(t, os.WriteFile(path, []byte(`code=550 enhanced=5.1.1 -> retry=true text="Try again later"`+"\n"), 0o600))
+
+	srv := startTestSMTPServer(ctx, t)
+	addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+		cfg.responseMap = path
+	})
+
+	err := sendMsg(t, addr, []string{"nobody@example.com"},
+		"dave@example.com", "mapped", textproto.MIMEHeader{}, "hello world")
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 450, tperr.Code)
+	assert.Equal(t, "4.1.1 Try again later", tperr.Msg)
+	assert.Empty(t, srv.messages())
+}
+
+//nolint:paralleltest
+func TestSendMailSpilled(t *testing.T) {
+	ctx := t.Context()
+
+	body := strings.Repeat("a line of a large message\n", 4096)
+
+	// spooled messages are streamed through the spool too
+	for _, spooled := range []bool{false, true} {
+		dir := t.TempDir()
+
+		srv := startTestSMTPServer(ctx, t)
+		addr := startRelayWithConfig(ctx, t, srv.addr, func(cfg *config) {
+			cfg.spillSize = 1024
+			cfg.spillDir = dir
+
+			if spooled {
+				cfg.spoolDir = t.TempDir()
+				cfg.spoolWorkers = 1
+			}
+		})
+
+		err := sendMsg(t, addr, []string{"alice@example.com"},
+			"bob@example.com", "large message", textproto.MIMEHeader{}, body)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return len(srv.messages()) == 1
+		}, 5*time.Second, 10*time.Millisecond, "spooled: %v", spooled)
+
+		data := envelopeData(t, &srv.messages()[0])
+		assert.Contains(t, data, "Subject: large message\n")
+		assert.True(t, strings.HasSuffix(data, "\n\n"+body))
+
+		// the temporary file is removed once the message is relayed
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
@@ -0,0 +1,120 @@
+// Package catcher implements a bounded in-memory store of the messages sent
+// by the relay, with a web UI and a JSON API to browse them, for
+// non-production environments.
+package catcher
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message is a message kept in the store.
+type Message struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	Size       int       `json:"size"`
+
+	Data []byte `json:"-"`
+}
+
+// Store keeps the most recent messages, up to a maximum number. It is safe
+// for concurrent use.
+type Store struct {
+	max int
+
+	mu   sync.Mutex
+	msgs []*Message // oldest first
+}
+
+// NewStore returns a store keeping up to max messages. (default: 100)
+func NewStore(maxMessages int) *Store {
+	if maxMessages <= 0 {
+		maxMessages = 100
+	}
+
+	return &Store{max: maxMessages}
+}
+
+// Add stores a message, dropping the oldest one if the store is full.
+func (s *Store) Add(sender string, recipients []string, data []byte) *Message {
+	msg := &Message{
+		ID:         uuid.NewString(),
+		ReceivedAt: time.Now(),
+		Sender:     sender,
+		Recipients: slices.Clone(recipients),
+		Subject:    subject(data),
+		Size:       len(data),
+		Data:       slices.Clone(data),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.msgs) >= s.max {
+		clear(s.msgs[:len(s.msgs)-s.max+1])
+		s.msgs = s.msgs[len(s.msgs)-s.max+1:]
+	}
+
+	s.msgs = append(s.msgs, msg)
+
+	return msg
+}
+
+// List returns the stored messages, most recent first.
+func (s *Store) List() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := append(make([]*Message, 0, len(s.msgs)), s.msgs...)
+	slices.Reverse(msgs)
+
+	return msgs
+}
+
+// Get returns the message with the given ID, if it is still stored.
+func (s *Store) Get(id string) (*Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.msgs {
+		if msg.ID == id {
+			return msg, true
+		}
+	}
+
+	return nil, false
+}
+
+// Clear deletes all the messages.
+func (s *Store) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.msgs = nil
+}
+
+// subject returns the decoded subject of the message, if it can be parsed.
+func subject(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	subject := msg.Header.Get("Subject")
+
+	decoded, err := (&mime.WordDecoder{}).DecodeHeader(subject)
+	if err != nil {
+		return subject
+	}
+
+	return decoded
+}
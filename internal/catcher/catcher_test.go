@@ -0,0 +1,177 @@
+package catcher
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const multipartMsg = "From: bob@example.com\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: =?utf-8?q?caf=C3=A9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9 au lait\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>hello</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"AwQ=\r\n" +
+	"--outer--\r\n"
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	s := NewStore(2)
+
+	first := s.Add("bob@example.com", []string{"alice@example.com"}, []byte("Subject: first\r\n\r\nhello\r\n"))
+	assert.Equal(t, "first", first.Subject)
+
+	s.Add("bob@example.com", []string{"alice@example.com"}, []byte("Subject: second\r\n\r\nhello\r\n"))
+	s.Add("bob@example.com", []string{"alice@example.com"}, []byte("Subject: third\r\n\r\nhello\r\n"))
+
+	// the oldest message was dropped
+	msgs := s.List()
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "third", msgs[0].Subject)
+	assert.Equal(t, "second", msgs[1].Subject)
+
+	_, ok := s.Get(first.ID)
+	assert.False(t, ok)
+
+	got, ok := s.Get(msgs[1].ID)
+	require.True(t, ok)
+	assert.Equal(t, msgs[1], got)
+
+	s.Clear()
+	assert.Empty(t, s.List())
+}
+
+func TestParseMessage(t *testing.T) {
+	t.Parallel()
+
+	header, parts, err := parseMessage([]byte(multipartMsg))
+	require.NoError(t, err)
+
+	assert.Equal(t, "alice@example.com", header.Get("To"))
+	require.Len(t, parts, 3)
+
+	assert.Equal(t, "text/plain", parts[0].ContentType)
+	assert.Equal(t, "café au lait", parts[0].Text)
+
+	assert.Equal(t, "text/html", parts[1].ContentType)
+	assert.Equal(t, "<p>hello</p>", parts[1].Text)
+
+	assert.Equal(t, "application/octet-stream", parts[2].ContentType)
+	assert.Equal(t, "data.bin", parts[2].Filename)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4}, parts[2].Content)
+	assert.Empty(t, parts[2].Text)
+
+	// messages without MIME headers are plain text
+	_, parts, err = parseMessage([]byte("Subject: hi\n\nhello\n"))
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	assert.Equal(t, "hello\n", parts[0].Text)
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	s := NewStore(10)
+	msg := s.Add("bob@example.com", []string{"alice@example.com"}, []byte(multipartMsg))
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+
+		resp, err := srv.Client().Get(srv.URL + path)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp, string(body)
+	}
+
+	resp, body := get("/catcher/api/messages")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	list := []Message{}
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, msg.ID, list[0].ID)
+	assert.Equal(t, "café", list[0].Subject)
+	assert.Equal(t, []string{"alice@example.com"}, list[0].Recipients)
+
+	_, body = get("/catcher/api/messages/" + msg.ID)
+
+	d := struct {
+		Message
+
+		Headers map[string][]string `json:"headers"`
+		Parts   []Part              `json:"parts"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &d))
+	assert.Equal(t, "bob@example.com", d.Sender)
+	assert.Equal(t, []string{"bob@example.com"}, d.Headers["From"])
+	require.Len(t, d.Parts, 3)
+	assert.Equal(t, "café au lait", d.Parts[0].Text)
+
+	_, body = get("/catcher/api/messages/" + msg.ID + "/raw")
+	assert.Equal(t, multipartMsg, body)
+
+	resp, body = get("/catcher/api/messages/" + msg.ID + "/parts/2")
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "\x00\x01\x02\x03\x04", body)
+
+	resp, _ = get("/catcher/api/messages/" + msg.ID + "/parts/3")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = get("/catcher/api/messages/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// the web UI escapes the message
+	resp, body = get("/catcher/messages/" + msg.ID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "&lt;p&gt;hello&lt;/p&gt;")
+
+	_, body = get("/catcher/")
+	assert.Contains(t, body, `href="messages/`+msg.ID+`"`)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodDelete, srv.URL+"/catcher/api/messages", nil)
+	require.NoError(t, err)
+
+	resp, err = srv.Client().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, s.List())
+
+	_, body = get("/catcher/api/messages")
+	assert.Equal(t, "[]", strings.TrimSpace(body))
+}
@@ -0,0 +1,198 @@
+package catcher
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+)
+
+// Prefix is the path the handler serves.
+const Prefix = "/catcher/"
+
+// detail is a message with its headers and parts, as returned by the API.
+type detail struct {
+	*Message
+
+	Headers mail.Header `json:"headers"`
+	Parts   []Part      `json:"parts"`
+	Error   string      `json:"error,omitempty"` // if the message couldn't be parsed
+}
+
+// Handler returns the handler of the web UI and the JSON API:
+//
+//	GET    /catcher/                                the list of messages
+//	GET    /catcher/messages/{id}                   a message
+//	GET    /catcher/api/messages                    the list of messages
+//	DELETE /catcher/api/messages                    deletes all messages
+//	GET    /catcher/api/messages/{id}               a message, its headers and parts
+//	GET    /catcher/api/messages/{id}/raw           the source of a message
+//	GET    /catcher/api/messages/{id}/parts/{index} the decoded content of a part
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+Prefix+"{$}", func(w http.ResponseWriter, _ *http.Request) {
+		render(w, listTemplate, s.List())
+	})
+
+	mux.HandleFunc("GET "+Prefix+"messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.detail(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		render(w, messageTemplate, d)
+	})
+
+	mux.HandleFunc("GET "+Prefix+"api/messages", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, s.List())
+	})
+
+	mux.HandleFunc("DELETE "+Prefix+"api/messages", func(w http.ResponseWriter, _ *http.Request) {
+		s.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET "+Prefix+"api/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.detail(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJSON(w, d)
+	})
+
+	mux.HandleFunc("GET "+Prefix+"api/messages/{id}/raw", func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := s.Get(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(msg.Data)
+	})
+
+	mux.HandleFunc("GET "+Prefix+"api/messages/{id}/parts/{index}", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.detail(r.PathValue("id"))
+
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if !ok || err != nil || index < 0 || index >= len(d.Parts) {
+			http.NotFound(w, r)
+			return
+		}
+
+		part := d.Parts[index]
+
+		// parts are served as attachments, so that HTML parts aren't rendered
+		// in the context of the instrumentation server
+		w.Header().Set("Content-Type", part.ContentType)
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, _ = w.Write(part.Content)
+	})
+
+	return mux
+}
+
+// detail returns the message with the given ID, with its headers and parts.
+func (s *Store) detail(id string) (*detail, bool) {
+	msg, ok := s.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	d := &detail{Message: msg, Parts: []Part{}}
+
+	headers, parts, err := parseMessage(msg.Data)
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	if headers != nil {
+		d.Headers = headers
+	}
+
+	if parts != nil {
+		d.Parts = parts
+	}
+
+	return d, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("could not write response", slog.String("component", "catcher"), slog.Any("error", err))
+	}
+}
+
+func render(w http.ResponseWriter, tmpl *template.Template, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := tmpl.Execute(w, data); err != nil {
+		slog.Warn("could not render page", slog.String("component", "catcher"), slog.Any("error", err))
+	}
+}
+
+var funcs = template.FuncMap{
+	"time": func(t time.Time) string { return t.Format(time.DateTime) },
+}
+
+const style = `<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+pre { background: #f6f6f6; padding: 1em; white-space: pre-wrap; }
+</style>`
+
+var listTemplate = template.Must(template.New("list").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>smtprelay mail catcher</title>` + style + `</head>
+<body>
+<h1>Messages</h1>
+<p><button onclick="fetch('api/messages', {method: 'DELETE'}).then(() => location.reload())">Delete all</button></p>
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .}}<tr>
+<td>{{time .ReceivedAt}}</td>
+<td>{{.Sender}}</td>
+<td>{{range $i, $r := .Recipients}}{{if $i}}, {{end}}{{$r}}{{end}}</td>
+<td><a href="messages/{{.ID}}">{{or .Subject "(no subject)"}}</a></td>
+<td>{{.Size}}</td>
+</tr>{{else}}<tr><td colspan="5">No messages</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+var messageTemplate = template.Must(template.New("message").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{or .Subject "(no subject)"}}</title>` + style + `</head>
+<body>
+<p><a href="../">All messages</a> · <a href="../api/messages/{{.ID}}/raw">Source</a></p>
+<h1>{{or .Subject "(no subject)"}}</h1>
+<table>
+<tr><th>Received</th><td>{{time .ReceivedAt}}</td></tr>
+<tr><th>Envelope from</th><td>{{.Sender}}</td></tr>
+<tr><th>Envelope to</th><td>{{range $i, $r := .Recipients}}{{if $i}}, {{end}}{{$r}}{{end}}</td></tr>
+</table>
+{{if .Error}}<p>Could not parse the message: {{.Error}}</p>{{end}}
+<h2>Headers</h2>
+<table>
+{{range $k, $v := .Headers}}{{range $v}}<tr><th>{{$k}}</th><td>{{.}}</td></tr>{{end}}{{end}}
+</table>
+<h2>Parts</h2>
+{{range .Parts}}
+<h3>{{.ContentType}}{{with .Filename}} ({{.}}){{end}}, {{.Size}} bytes · <a href="../api/messages/{{$.ID}}/parts/{{.Index}}">Download</a></h3>
+{{if .Text}}<pre>{{.Text}}</pre>{{end}}
+{{end}}
+</body>
+</html>
+`))
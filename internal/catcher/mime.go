@@ -0,0 +1,144 @@
+package catcher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxDepth bounds the nesting of multipart messages.
+const maxDepth = 10
+
+// Part is a leaf part of a MIME message, with its content decoded.
+type Part struct {
+	Index       int    `json:"index"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int    `json:"size"`
+	Text        string `json:"text,omitempty"` // for text parts
+
+	Content []byte `json:"-"`
+}
+
+// parseMessage returns the headers of the message, and its leaf parts.
+func parseMessage(data []byte) (mail.Header, []Part, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts := []Part{}
+
+	err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, 0, &parts)
+
+	return msg.Header, parts, err
+}
+
+func walkParts(header textproto.MIMEHeader, body io.Reader, depth int, parts *[]Part) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return errors.New("too many nested parts")
+		}
+
+		r := multipart.NewReader(body, params["boundary"])
+
+		for {
+			p, err := r.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			// multipart readers decode quoted-printable already
+			if err := walkParts(p.Header, p, depth+1, parts); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(decode(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("decode part: %w", err)
+	}
+
+	part := Part{
+		Index:       len(*parts),
+		ContentType: mediaType,
+		Filename:    filename(header),
+		Size:        len(content),
+		Content:     content,
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		part.Text = string(content)
+	}
+
+	*parts = append(*parts, part)
+
+	return nil
+}
+
+func decode(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, newlineSkipper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// filename returns the file name of an attachment, if any.
+func filename(header textproto.MIMEHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		return params["name"]
+	}
+
+	return ""
+}
+
+// newlineSkipper drops line breaks, which base64 decoders don't expect.
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (s newlineSkipper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+
+	kept := 0
+
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[kept] = b
+			kept++
+		}
+	}
+
+	return kept, err
+}
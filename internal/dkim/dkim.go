@@ -0,0 +1,354 @@
+// Package dkim implements DKIM signing and verification (RFC 6376) of
+// messages, with RSA and Ed25519 (RFC 8463) keys. Messages are signed with
+// relaxed/relaxed canonicalization.
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders are the header fields signed by default.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Key is a signing key of a domain.
+type Key struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+}
+
+// algorithm returns the signing algorithm of the key, as in the a= tag.
+func (k *Key) algorithm() (string, error) {
+	switch k.Signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", k.Signer)
+	}
+}
+
+// ParseKey parses a PEM-encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8)
+// private key.
+func ParseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// Canonicalization algorithms (RFC 6376, section 3.4).
+const (
+	simple  = "simple"
+	relaxed = "relaxed"
+)
+
+// Sign returns a DKIM-Signature header field signing the given header fields
+// of the message read from r, and its body, ending with a CRLF.
+func Sign(r io.Reader, key *Key, headers []string, now time.Time) (string, error) {
+	return sign(r, key, headers, now, relaxed, relaxed)
+}
+
+func sign(r io.Reader, key *Key, headers []string, now time.Time, headerCanon, bodyCanon string) (string, error) {
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	fields, body, err := splitMessage(r)
+	if err != nil {
+		return "", err
+	}
+
+	bodyHash := sha256.New()
+	canonical := newBodyWriter(bodyCanon, bodyHash, -1)
+
+	if _, err := io.Copy(canonical, body); err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+
+	canonical.Close()
+
+	// fields signed from the bottom up, for each name
+	signed := []string{}
+	used := map[string]int{}
+
+	for _, name := range headers {
+		lower := strings.ToLower(name)
+		if used[lower] < countFields(fields, lower) {
+			used[lower]++
+
+			signed = append(signed, lower)
+		}
+	}
+
+	tags := fmt.Sprintf(" v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, headerCanon, bodyCanon, key.Domain, key.Selector, now.Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash.Sum(nil)))
+
+	hash := sha256.New()
+	hash.Write(signedHeaders(headerCanon, fields, signed))
+	hash.Write(bytes.TrimSuffix(canonicalHeader(headerCanon, "DKIM-Signature", tags), []byte("\r\n")))
+
+	var sig []byte
+
+	switch key.Signer.(type) {
+	case ed25519.PrivateKey:
+		sig, err = key.Signer.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	default:
+		sig, err = key.Signer.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+
+	return "DKIM-Signature:" + tags + fold(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// fold splits a base64 value over several lines.
+func fold(value string) string {
+	const width = 64
+
+	lines := []string{}
+	for len(value) > width {
+		lines = append(lines, value[:width])
+		value = value[width:]
+	}
+
+	return strings.Join(append(lines, value), "\r\n\t")
+}
+
+// field is a header field, as in the message.
+type field struct {
+	name  string
+	value string // as folded in the message
+}
+
+// splitMessage reads the header fields of the message, and returns them with
+// a reader of its body. Lines may end with CRLF or LF.
+func splitMessage(r io.Reader) ([]field, io.Reader, error) {
+	br := bufio.NewReader(r)
+	fields := []field{}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("read header: %w", err)
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			return fields, br, nil
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += "\r\n" + line
+		} else {
+			name, value, _ := strings.Cut(line, ":")
+			fields = append(fields, field{name: name, value: value})
+		}
+
+		if err != nil {
+			return fields, br, nil
+		}
+	}
+}
+
+func countFields(fields []field, key string) int {
+	n := 0
+
+	for _, f := range fields {
+		if strings.EqualFold(strings.TrimSpace(f.name), key) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// signedHeaders returns the canonicalized header fields listed in h=: for
+// each occurrence of a name, the next instance of the field from the bottom.
+func signedHeaders(canon string, fields []field, names []string) []byte {
+	buf := []byte{}
+	used := map[string]int{}
+
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		skip := used[key]
+		used[key]++
+
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !strings.EqualFold(strings.TrimSpace(fields[i].name), key) {
+				continue
+			}
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			buf = append(buf, canonicalHeader(canon, fields[i].name, fields[i].value)...)
+
+			break
+		}
+	}
+
+	return buf
+}
+
+// canonicalHeader canonicalizes a header field. The simple algorithm keeps
+// it as is, while the relaxed one lowercases the name, and unfolds the value
+// with whitespace runs reduced to a space.
+func canonicalHeader(canon, name, value string) []byte {
+	if canon == simple {
+		return []byte(name + ":" + value + "\r\n")
+	}
+
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+
+	return []byte(strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n")
+}
+
+// bodyWriter canonicalizes the body written to it, with CRLF line endings
+// and without trailing empty lines, and writes the first limit bytes of the
+// result to w, or all of them if limit is negative. The relaxed algorithm
+// also reduces whitespace runs to a space, and removes trailing whitespace.
+// With the simple algorithm, an empty body is a single CRLF.
+type bodyWriter struct {
+	canon string
+	w     io.Writer
+	limit int64
+
+	n     int64  // size of the canonical body
+	line  []byte // incomplete line
+	empty int    // empty lines not written yet
+}
+
+func newBodyWriter(canon string, w io.Writer, limit int64) *bodyWriter {
+	return &bodyWriter{canon: canon, w: w, limit: limit}
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.line = append(b.line, p...)
+			break
+		}
+
+		b.line = append(b.line, p[:i]...)
+		b.writeLine()
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// Close writes the last line, if incomplete.
+func (b *bodyWriter) Close() {
+	if len(b.line) > 0 {
+		b.writeLine()
+	}
+
+	if b.canon == simple && b.n == 0 {
+		b.write([]byte("\r\n"))
+	}
+}
+
+func (b *bodyWriter) writeLine() {
+	line := bytes.TrimSuffix(b.line, []byte("\r"))
+	if b.canon != simple {
+		line = bytes.TrimRight([]byte(collapseWSP(string(line))), " ")
+	}
+
+	b.line = b.line[:0]
+
+	if len(line) == 0 {
+		b.empty++
+		return
+	}
+
+	for ; b.empty > 0; b.empty-- {
+		b.write([]byte("\r\n"))
+	}
+
+	b.write(line)
+	b.write([]byte("\r\n"))
+}
+
+func (b *bodyWriter) write(p []byte) {
+	n := int64(len(p))
+
+	if b.limit >= 0 {
+		p = p[:min(n, max(b.limit-b.n, 0))]
+	}
+
+	_, _ = b.w.Write(p)
+	b.n += n
+}
+
+func collapseWSP(s string) string {
+	b := strings.Builder{}
+	space := false
+
+	for i := range len(s) {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
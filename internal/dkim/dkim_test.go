@@ -0,0 +1,165 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalization(t *testing.T) {
+	t.Parallel()
+
+	// RFC 6376, section 3.4.5
+	fields, r, err := splitMessage(strings.NewReader("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	require.NoError(t, err)
+	require.Len(t, fields, 2)
+
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	assert.Equal(t, "a:X\r\nb:Y Z\r\n", string(signedHeaders(relaxed, fields, []string{"a", "b"})))
+	assert.Equal(t, " C\r\nD E\r\n", string(canonicalBody(relaxed, body)))
+
+	assert.Equal(t, "A: X\r\nB : Y\t\r\n\tZ  \r\n", string(signedHeaders(simple, fields, []string{"a", "b"})))
+	assert.Equal(t, " C \r\nD \t E\r\n", string(canonicalBody(simple, body)))
+
+	// an empty body canonicalizes to nothing, or a CRLF
+	assert.Empty(t, canonicalBody(relaxed, []byte("\r\n\r\n")))
+	assert.Equal(t, "\r\n", string(canonicalBody(simple, nil)))
+
+	// RFC 8463, appendix A
+	hash := sha256.Sum256(canonicalBody(relaxed, []byte("Hi.\n\nWe lost the game.  Are you hungry yet?\n\nJoe.\n")))
+	assert.Equal(t, "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=", base64.StdEncoding.EncodeToString(hash[:]))
+
+	// lines can be written in parts, and the canonical body truncated
+	buf := &bytes.Buffer{}
+	w := newBodyWriter(relaxed, buf, 7)
+
+	for _, part := range []string{" C", " \r", "\nD \t", " E\r\n\r\n", "\r\n"} {
+		_, err = w.Write([]byte(part))
+		require.NoError(t, err)
+	}
+
+	w.Close()
+	assert.Equal(t, " C\r\nD E", buf.String())
+	assert.Equal(t, int64(9), w.n)
+}
+
+// canonicalBody returns the canonical body.
+func canonicalBody(canon string, body []byte) []byte {
+	buf := &bytes.Buffer{}
+
+	w := newBodyWriter(canon, buf, -1)
+	_, _ = w.Write(body)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func TestSignedHeaders(t *testing.T) {
+	t.Parallel()
+
+	fields, _, err := splitMessage(strings.NewReader("Received: first\nReceived: second\nFrom: bob\n\n"))
+	require.NoError(t, err)
+
+	// instances are signed from the bottom up, and missing ones are ignored
+	assert.Equal(t, "received:second\r\nreceived:first\r\n",
+		string(signedHeaders(relaxed, fields, []string{"Received", "Received", "Received"})))
+}
+
+func TestParseKey(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	key, err := ParseKey(pkcs1)
+	require.NoError(t, err)
+	assert.True(t, rsaKey.Equal(key))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	key, err = ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	assert.True(t, edKey.Equal(key))
+
+	_, err = ParseKey([]byte("not a key"))
+	require.Error(t, err)
+}
+
+func TestSign(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	data := []byte("Received: from somewhere\n" +
+		"From: Bob <bob@example.com>\n" +
+		"To: alice@example.com\n" +
+		"Subject: a  folded\n\tsubject\n" +
+		"\n" +
+		"hello  world \n\n\n")
+
+	// the same message, as canonicalized
+	signedData := "from:Bob <bob@example.com>\r\nsubject:a folded subject\r\nto:alice@example.com\r\n"
+	bodyHash := sha256.Sum256([]byte("hello world\r\n"))
+
+	for _, signer := range []crypto.Signer{rsaKey, edKey} {
+		key := &Key{Domain: "example.com", Selector: "s1", Signer: signer}
+
+		header, err := Sign(bytes.NewReader(data), key, []string{"From", "Subject", "To", "Cc"}, time.Unix(1700000000, 0))
+		require.NoError(t, err)
+
+		require.True(t, strings.HasPrefix(header, "DKIM-Signature: "))
+		require.True(t, strings.HasSuffix(header, "\r\n"))
+
+		value := strings.TrimPrefix(header, "DKIM-Signature: ")
+		assert.Contains(t, value, "c=relaxed/relaxed; d=example.com; s=s1;")
+		assert.Contains(t, value, "t=1700000000; h=from:subject:to;")
+		assert.Contains(t, value, "bh="+base64.StdEncoding.EncodeToString(bodyHash[:])+";")
+
+		// verify the signature, over the header with an empty b= tag
+		i := strings.LastIndex(value, "\tb=")
+		require.Positive(t, i)
+
+		unsigned, sig := value[:i+len("\tb=")], value[i+len("\tb="):]
+
+		raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sig), ""))
+		require.NoError(t, err)
+
+		hash := sha256.New()
+		hash.Write([]byte(signedData))
+		hash.Write(bytes.TrimSuffix(canonicalHeader(relaxed, "DKIM-Signature", unsigned), []byte("\r\n")))
+
+		switch signer := signer.(type) {
+		case *rsa.PrivateKey:
+			assert.Contains(t, value, "a=rsa-sha256;")
+			require.NoError(t, rsa.VerifyPKCS1v15(&signer.PublicKey, crypto.SHA256, hash.Sum(nil), raw))
+		case ed25519.PrivateKey:
+			assert.Contains(t, value, "a=ed25519-sha256;")
+			assert.True(t, ed25519.Verify(signer.Public().(ed25519.PublicKey), hash.Sum(nil), raw))
+		}
+	}
+}
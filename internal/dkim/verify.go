@@ -0,0 +1,366 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignatures bounds the number of signatures verified per message.
+const maxSignatures = 5
+
+// Status is the result of a signature verification, as reported in
+// Authentication-Results headers (RFC 8601).
+type Status string
+
+const (
+	StatusNone      Status = "none"      // the message isn't signed
+	StatusPass      Status = "pass"      // the signature is valid
+	StatusFail      Status = "fail"      // the signature or body hash doesn't match
+	StatusTempError Status = "temperror" // the key couldn't be looked up
+	StatusPermError Status = "permerror" // the signature or key is invalid
+)
+
+// Result is the result of the verification of a signature.
+type Result struct {
+	Status   Status
+	Domain   string // signing domain, from the d= tag
+	Selector string
+	Err      error // why the signature didn't pass
+}
+
+// LookupTXT looks up the TXT records of a name, like net.Resolver.LookupTXT.
+type LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+// Verify verifies the DKIM signatures of the message read from r, looking up
+// keys with lookup. It returns a result per signature, or none if the message
+// isn't signed. The body is read once, and hashed for all the signatures.
+func Verify(ctx context.Context, r io.Reader, lookup LookupTXT, now time.Time) []Result {
+	fields, body, err := splitMessage(r)
+	if err != nil {
+		return []Result{{Status: StatusTempError, Err: err}}
+	}
+
+	results := []Result{}
+	sigs := []*signature{}
+	hashers := []io.Writer{}
+
+	for _, f := range fields {
+		if !strings.EqualFold(strings.TrimSpace(f.name), "DKIM-Signature") {
+			continue
+		}
+
+		if len(results) == maxSignatures {
+			break
+		}
+
+		sig, res := parseSignature(f, now)
+		if sig != nil {
+			hashers = append(hashers, sig.body)
+		}
+
+		results = append(results, res)
+		sigs = append(sigs, sig)
+	}
+
+	if len(hashers) > 0 {
+		_, err = io.Copy(io.MultiWriter(hashers...), body)
+	}
+
+	for i, sig := range sigs {
+		switch {
+		case sig == nil:
+			// already failed
+		case err != nil:
+			results[i] = failed(results[i], StatusTempError, "read body: %w", err)
+		default:
+			results[i] = sig.verify(ctx, fields, lookup)
+		}
+	}
+
+	return results
+}
+
+// signature is a DKIM-Signature header field, whose body hash is computed
+// while the body is read.
+type signature struct {
+	field       field
+	res         Result
+	tags        map[string]string
+	headerCanon string
+	signed      []string // header fields, from the h= tag
+	value       []byte   // from the b= tag
+	length      int64    // from the l= tag, -1 if unset
+	bodyHash    []byte   // from the bh= tag
+	hash        hash.Hash
+	body        *bodyWriter
+}
+
+// parseSignature checks the tags of a DKIM-Signature header field. It returns
+// the signature, or nil and the result if it can't pass.
+func parseSignature(f field, now time.Time) (*signature, Result) {
+	tags := parseTags(f.value)
+	res := Result{Domain: tags["d"], Selector: tags["s"]}
+
+	fail := func(status Status, format string, args ...any) (*signature, Result) {
+		return nil, failed(res, status, format, args...)
+	}
+
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return fail(StatusPermError, "missing %s= tag", tag)
+		}
+	}
+
+	if tags["v"] != "1" {
+		return fail(StatusPermError, "unsupported version %q", tags["v"])
+	}
+
+	signed := strings.Split(strings.ToLower(tags["h"]), ":")
+	if !slices.Contains(signed, "from") {
+		return fail(StatusPermError, "From isn't signed")
+	}
+
+	if x, ok := tags["x"]; ok {
+		expiry, err := timestamp(x)
+		if err != nil {
+			return fail(StatusPermError, "invalid x= tag: %w", err)
+		}
+
+		if now.After(expiry) {
+			return fail(StatusFail, "signature expired")
+		}
+	}
+
+	headerCanon, bodyCanon, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return fail(StatusPermError, "%w", err)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fail(StatusPermError, "invalid b= tag: %w", err)
+	}
+
+	bodyHash, err := base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return fail(StatusPermError, "invalid bh= tag: %w", err)
+	}
+
+	if tags["a"] != "rsa-sha256" && tags["a"] != "ed25519-sha256" {
+		return fail(StatusPermError, "unsupported algorithm %q", tags["a"])
+	}
+
+	length := int64(-1)
+
+	if l, ok := tags["l"]; ok {
+		length, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			return fail(StatusPermError, "invalid l= tag %q", l)
+		}
+	}
+
+	sig := &signature{
+		field:       f,
+		res:         res,
+		tags:        tags,
+		headerCanon: headerCanon,
+		signed:      signed,
+		value:       value,
+		length:      length,
+		bodyHash:    bodyHash,
+		hash:        sha256.New(),
+	}
+	sig.body = newBodyWriter(bodyCanon, sig.hash, length)
+
+	return sig, res
+}
+
+// verify verifies the signature, once the body was hashed.
+func (sig *signature) verify(ctx context.Context, fields []field, lookup LookupTXT) Result {
+	sig.body.Close()
+
+	key, status, err := lookupKey(ctx, lookup, sig.tags["s"]+"._domainkey."+sig.tags["d"], sig.tags["a"])
+	if err != nil {
+		return failed(sig.res, status, "%w", err)
+	}
+
+	if sig.length > sig.body.n {
+		return failed(sig.res, StatusPermError, "invalid l= tag %q", sig.tags["l"])
+	}
+
+	if !bytes.Equal(sig.hash.Sum(nil), sig.bodyHash) {
+		return failed(sig.res, StatusFail, "body hash doesn't match")
+	}
+
+	h := sha256.New()
+	h.Write(signedHeaders(sig.headerCanon, fields, sig.signed))
+	h.Write(bytes.TrimSuffix(canonicalHeader(sig.headerCanon, sig.field.name, stripSignature(sig.field.value)), []byte("\r\n")))
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), sig.value)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, h.Sum(nil), sig.value) {
+			err = errors.New("ed25519: verification error")
+		}
+	}
+
+	if err != nil {
+		return failed(sig.res, StatusFail, "signature doesn't match: %w", err)
+	}
+
+	res := sig.res
+	res.Status = StatusPass
+
+	return res
+}
+
+// failed returns res with a status and its cause.
+func failed(res Result, status Status, format string, args ...any) Result {
+	res.Status = status
+	res.Err = fmt.Errorf(format, args...)
+
+	return res
+}
+
+// lookupKey looks up the public key of a selector, and checks it can be used
+// with the algorithm.
+func lookupKey(ctx context.Context, lookup LookupTXT, name, algorithm string) (crypto.PublicKey, Status, error) {
+	records, err := lookup(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, StatusPermError, fmt.Errorf("no key at %s", name)
+		}
+
+		return nil, StatusTempError, fmt.Errorf("key lookup: %w", err)
+	}
+
+	if len(records) != 1 {
+		return nil, StatusPermError, fmt.Errorf("%d key records at %s", len(records), name)
+	}
+
+	tags := parseTags(records[0])
+
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, StatusPermError, fmt.Errorf("unsupported key version %q", v)
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+
+	if !strings.HasPrefix(algorithm, keyType+"-") {
+		return nil, StatusPermError, fmt.Errorf("%s key can't verify %s signatures", keyType, algorithm)
+	}
+
+	if tags["p"] == "" {
+		return nil, StatusPermError, errors.New("key revoked")
+	}
+
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, StatusPermError, fmt.Errorf("invalid key: %w", err)
+	}
+
+	if keyType == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, StatusPermError, errors.New("invalid ed25519 key")
+		}
+
+		return ed25519.PublicKey(der), "", nil
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		// some records hold PKCS #1 keys
+		if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, StatusPermError, fmt.Errorf("invalid rsa key: %w", err)
+		}
+	}
+
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok || rsaKey.N.BitLen() < 1024 {
+		return nil, StatusPermError, errors.New("invalid rsa key")
+	}
+
+	return rsaKey, "", nil
+}
+
+// parseCanonicalization parses a c= tag, which defaults to simple/simple.
+func parseCanonicalization(value string) (headerCanon, bodyCanon string, err error) {
+	headerCanon, bodyCanon, _ = strings.Cut(value, "/")
+
+	if headerCanon == "" {
+		headerCanon = simple
+	}
+
+	if bodyCanon == "" {
+		bodyCanon = simple
+	}
+
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != simple && c != relaxed {
+			return "", "", fmt.Errorf("unsupported canonicalization %q", value)
+		}
+	}
+
+	return headerCanon, bodyCanon, nil
+}
+
+// stripSignature returns the value of a DKIM-Signature header with an empty
+// b= tag, as it was signed.
+func stripSignature(value string) string {
+	tags := strings.Split(value, ";")
+
+	for i, tag := range tags {
+		if name, _, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(name) == "b" {
+			tags[i] = name + "="
+		}
+	}
+
+	return strings.Join(tags, ";")
+}
+
+// parseTags parses a tag-list, like the value of a DKIM-Signature header,
+// without the whitespace in values.
+func parseTags(value string) map[string]string {
+	tags := map[string]string{}
+
+	for tag := range strings.SplitSeq(value, ";") {
+		name, val, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(val), "")
+	}
+
+	return tags
+}
+
+// timestamp parses the value of a t= or x= tag.
+func timestamp(value string) (time.Time, error) {
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(sec, 0), nil
+}
@@ -0,0 +1,148 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLookup returns a LookupTXT serving the given records.
+func testLookup(records map[string]string) LookupTXT {
+	return func(_ context.Context, name string) ([]string, error) {
+		if name == "tempfail._domainkey.example.com" {
+			return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+		}
+
+		record, ok := records[name]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+
+		return []string{record}, nil
+	}
+}
+
+func keyRecord(t *testing.T, signer crypto.Signer) string {
+	t.Helper()
+
+	if pub, ok := signer.Public().(ed25519.PublicKey); ok {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	require.NoError(t, err)
+
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	now := time.Unix(1700000000, 0)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	lookup := testLookup(map[string]string{
+		"rsa._domainkey.example.com":     keyRecord(t, rsaKey),
+		"ed._domainkey.example.com":      keyRecord(t, edKey),
+		"revoked._domainkey.example.com": "v=DKIM1; p=",
+	})
+
+	data := "From: Bob <bob@example.com>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: a  folded\r\n\tsubject\r\n" +
+		"\r\n" +
+		"hello  world \r\n"
+
+	for _, tc := range []struct {
+		selector string
+		signer   crypto.Signer
+		canon    string
+	}{
+		{"rsa", rsaKey, relaxed},
+		{"rsa", rsaKey, simple},
+		{"ed", edKey, relaxed},
+		{"ed", edKey, simple},
+	} {
+		key := &Key{Domain: "example.com", Selector: tc.selector, Signer: tc.signer}
+
+		header, err := sign(strings.NewReader(data), key, DefaultHeaders, now, tc.canon, tc.canon)
+		require.NoError(t, err)
+
+		results := Verify(ctx, strings.NewReader(header+data), lookup, now)
+		require.Len(t, results, 1)
+		require.Equal(t, StatusPass, results[0].Status, results[0].Err)
+		assert.Equal(t, "example.com", results[0].Domain)
+		assert.Equal(t, tc.selector, results[0].Selector)
+
+		// relaxed canonicalization survives whitespace changes, but not simple
+		rewrapped := strings.Replace(header+data, "a  folded\r\n\tsubject", "a folded subject", 1)
+
+		status := Verify(ctx, strings.NewReader(rewrapped), lookup, now)[0].Status
+		if tc.canon == relaxed {
+			assert.Equal(t, StatusPass, status)
+		} else {
+			assert.Equal(t, StatusFail, status)
+		}
+
+		// changes to signed headers or the body break the signature
+		for _, tampered := range []string{
+			strings.Replace(header+data, "Bob <bob", "Eve <bob", 1),
+			strings.Replace(header+data, "hello", "jello", 1),
+		} {
+			assert.Equal(t, StatusFail, Verify(ctx, strings.NewReader(tampered), lookup, now)[0].Status)
+		}
+	}
+
+	// messages without signatures have no results
+	assert.Empty(t, Verify(ctx, strings.NewReader(data), lookup, now))
+
+	key := &Key{Domain: "example.com", Selector: "rsa", Signer: rsaKey}
+	header, err := Sign(strings.NewReader(data), key, DefaultHeaders, now)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		header string
+		status Status
+	}{
+		{strings.Replace(header, "s=rsa;", "s=unknown;", 1), StatusPermError},
+		{strings.Replace(header, "s=rsa;", "s=tempfail;", 1), StatusTempError},
+		{strings.Replace(header, "s=rsa;", "s=revoked;", 1), StatusPermError},
+		{strings.Replace(header, "s=rsa;", "s=ed;", 1), StatusPermError},
+		{strings.Replace(header, "v=1;", "v=2;", 1), StatusPermError},
+		{strings.Replace(header, "h=from:", "h=", 1), StatusPermError},
+		{strings.Replace(header, "t=", "x=1600000000; t=", 1), StatusFail},
+	} {
+		result := Verify(ctx, strings.NewReader(tc.header+data), lookup, now)[0]
+		assert.Equal(t, tc.status, result.Status, tc.header)
+		assert.Error(t, result.Err)
+	}
+
+	// lookup errors other than NXDOMAIN are temporary
+	failing := func(context.Context, string) ([]string, error) { return nil, errors.New("boom") }
+	assert.Equal(t, StatusTempError, Verify(ctx, strings.NewReader(header+data), failing, now)[0].Status)
+}
+
+func TestStripSignature(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, " v=1; bh=abc;\r\n\tb=", stripSignature(" v=1; bh=abc;\r\n\tb=c2ln\r\n\tbmF0dXJl"))
+	assert.Equal(t, " b=; v=1", stripSignature(" b=c2ln; v=1"))
+}
@@ -0,0 +1,226 @@
+// Package dmarc implements DMARC policy evaluation (RFC 7489): whether the
+// domain of the From header is aligned with a domain authenticated by SPF or
+// DKIM, and which policy its owner asks receivers to apply otherwise.
+//
+// The pct tag is ignored, and policies always apply to all failing messages.
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Status is the result of a DMARC evaluation, as reported in
+// Authentication-Results headers (RFC 8601).
+type Status string
+
+const (
+	StatusNone      Status = "none"      // the domain has no DMARC record
+	StatusPass      Status = "pass"      // an aligned identifier passed
+	StatusFail      Status = "fail"      // no aligned identifier passed
+	StatusTempError Status = "temperror" // the record couldn't be looked up
+	StatusPermError Status = "permerror" // the record is invalid
+)
+
+// Policy is the disposition requested for failing messages.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Record is a DMARC record.
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy // defaults to Policy
+	StrictDKIM      bool   // adkim=s
+	StrictSPF       bool   // aspf=s
+}
+
+// Result is the result of a DMARC evaluation.
+type Result struct {
+	Status Status
+	Domain string // the From domain
+	Policy Policy // the policy applying to the message, if it failed
+	Err    error  // why the evaluation didn't pass
+}
+
+// LookupTXT looks up the TXT records of a name, like net.Resolver.LookupTXT.
+type LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+// Identifiers are the domains authenticated for a message.
+type Identifiers struct {
+	SPF  string   // the domain which passed SPF, if any
+	DKIM []string // the domains of the passing DKIM signatures
+}
+
+// Check evaluates the DMARC policy of the From domain, given the domains
+// authenticated for the message.
+func Check(ctx context.Context, lookup LookupTXT, from string, ids Identifiers) Result {
+	from = strings.ToLower(strings.TrimSuffix(from, "."))
+	res := Result{Domain: from}
+
+	org := OrganizationalDomain(from)
+
+	record, err := lookupRecord(ctx, lookup, from)
+	policy := Policy("")
+
+	if err == nil {
+		policy = record.Policy
+	} else if errors.Is(err, errNoRecord) && org != from {
+		// fall back to the record of the organizational domain
+		record, err = lookupRecord(ctx, lookup, org)
+		if err == nil {
+			policy = record.SubdomainPolicy
+		}
+	}
+
+	switch {
+	case errors.Is(err, errNoRecord):
+		res.Status, res.Err = StatusNone, err
+		return res
+	case errors.Is(err, errTemporary):
+		res.Status, res.Err = StatusTempError, err
+		return res
+	case err != nil:
+		res.Status, res.Err = StatusPermError, err
+		return res
+	}
+
+	if aligned(from, ids.SPF, record.StrictSPF) {
+		res.Status = StatusPass
+		return res
+	}
+
+	for _, domain := range ids.DKIM {
+		if aligned(from, domain, record.StrictDKIM) {
+			res.Status = StatusPass
+			return res
+		}
+	}
+
+	res.Status, res.Policy = StatusFail, policy
+	res.Err = fmt.Errorf("no authenticated domain aligned with %s", from)
+
+	return res
+}
+
+var (
+	errNoRecord  = errors.New("no dmarc record")
+	errTemporary = errors.New("dmarc record lookup failed")
+)
+
+// lookupRecord looks up and parses the DMARC record of a domain.
+func lookupRecord(ctx context.Context, lookup LookupTXT, domain string) (*Record, error) {
+	txts, err := lookup(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w for %s", errNoRecord, domain)
+		}
+
+		return nil, fmt.Errorf("%w for %s: %w", errTemporary, domain, err)
+	}
+
+	records := []string{}
+
+	for _, txt := range txts {
+		if v, _, _ := strings.Cut(txt, ";"); strings.EqualFold(strings.ReplaceAll(v, " ", ""), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) != 1 {
+		// several records are ignored, like none (RFC 7489, section 6.6.3)
+		return nil, fmt.Errorf("%w for %s", errNoRecord, domain)
+	}
+
+	record, err := ParseRecord(records[0])
+	if err != nil {
+		return nil, fmt.Errorf("dmarc record of %s: %w", domain, err)
+	}
+
+	return record, nil
+}
+
+// ParseRecord parses a DMARC record, like "v=DMARC1; p=reject".
+func ParseRecord(txt string) (*Record, error) {
+	record := &Record{}
+
+	for tag := range strings.SplitSeq(txt, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.ToLower(strings.TrimSpace(value))
+
+		switch name {
+		case "p", "sp":
+			policy := Policy(value)
+			if policy != PolicyNone && policy != PolicyQuarantine && policy != PolicyReject {
+				return nil, fmt.Errorf("invalid %s= policy %q", name, value)
+			}
+
+			if name == "p" {
+				record.Policy = policy
+			} else {
+				record.SubdomainPolicy = policy
+			}
+		case "adkim", "aspf":
+			if value != "r" && value != "s" {
+				return nil, fmt.Errorf("invalid %s= alignment %q", name, value)
+			}
+
+			if name == "adkim" {
+				record.StrictDKIM = value == "s"
+			} else {
+				record.StrictSPF = value == "s"
+			}
+		}
+	}
+
+	if record.Policy == "" {
+		return nil, errors.New("missing p= policy")
+	}
+
+	if record.SubdomainPolicy == "" {
+		record.SubdomainPolicy = record.Policy
+	}
+
+	return record, nil
+}
+
+// aligned reports whether an authenticated domain is aligned with the From
+// domain: the same domain in strict mode, or the same organizational domain
+// in relaxed mode.
+func aligned(from, domain string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+
+	if strict {
+		return domain == from
+	}
+
+	return OrganizationalDomain(domain) == OrganizationalDomain(from)
+}
+
+// OrganizationalDomain returns the registered domain of a domain, according
+// to the public suffix list, like example.com for mail.example.com.
+func OrganizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
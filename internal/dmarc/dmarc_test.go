@@ -0,0 +1,89 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecord(t *testing.T) {
+	t.Parallel()
+
+	record, err := ParseRecord("v=DMARC1; p=Reject; adkim=s; rua=mailto:dmarc@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &Record{Policy: PolicyReject, SubdomainPolicy: PolicyReject, StrictDKIM: true}, record)
+
+	record, err = ParseRecord("v=DMARC1;p=none;sp=quarantine;aspf=s")
+	require.NoError(t, err)
+	assert.Equal(t, &Record{Policy: PolicyNone, SubdomainPolicy: PolicyQuarantine, StrictSPF: true}, record)
+
+	for _, bad := range []string{"v=DMARC1", "v=DMARC1; p=discard", "v=DMARC1; p=none; adkim=x"} {
+		_, err := ParseRecord(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	records := map[string][]string{
+		"_dmarc.example.com":        {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.example":     {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.broken.example":     {"v=DMARC1; p=maybe"},
+		"_dmarc.twice.example":      {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.unrelated.example":  {"google-site-verification=abc"},
+		"_dmarc.example.co.uk":      {"v=DMARC1; p=reject"},
+		"_dmarc.sub.strict.example": {"v=DMARC1; p=none"},
+	}
+
+	lookup := func(_ context.Context, name string) ([]string, error) {
+		if name == "_dmarc.tempfail.example" {
+			return nil, errors.New("timeout")
+		}
+
+		if txt, ok := records[name]; ok {
+			return txt, nil
+		}
+
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	for _, tc := range []struct {
+		from   string
+		ids    Identifiers
+		status Status
+		policy Policy
+	}{
+		{"example.com", Identifiers{SPF: "example.com"}, StatusPass, ""},
+		{"example.com", Identifiers{SPF: "bounces.example.com"}, StatusPass, ""},
+		{"Mail.Example.COM", Identifiers{DKIM: []string{"other.example", "example.com"}}, StatusPass, ""},
+		{"example.com", Identifiers{SPF: "other.example", DKIM: []string{"other.example"}}, StatusFail, PolicyReject},
+		{"mail.example.com", Identifiers{}, StatusFail, PolicyQuarantine}, // sp= of the organizational domain
+		{"strict.example", Identifiers{DKIM: []string{"strict.example"}}, StatusPass, ""},
+		{"strict.example", Identifiers{SPF: "mail.strict.example"}, StatusFail, PolicyQuarantine},
+		{"sub.strict.example", Identifiers{}, StatusFail, PolicyNone},
+		{"example.co.uk", Identifiers{SPF: "other.co.uk"}, StatusFail, PolicyReject},
+		{"mail.example.co.uk", Identifiers{SPF: "example.co.uk"}, StatusPass, ""},
+		{"unknown.example", Identifiers{}, StatusNone, ""},
+		{"unrelated.example", Identifiers{}, StatusNone, ""},
+		{"twice.example", Identifiers{}, StatusNone, ""},
+		{"broken.example", Identifiers{}, StatusPermError, ""},
+		{"tempfail.example", Identifiers{}, StatusTempError, ""},
+	} {
+		result := Check(t.Context(), lookup, tc.from, tc.ids)
+		assert.Equal(t, tc.status, result.Status, "%s: %v", tc.from, result.Err)
+		assert.Equal(t, tc.policy, result.Policy, tc.from)
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "example.com", OrganizationalDomain("a.b.example.com"))
+	assert.Equal(t, "example.co.uk", OrganizationalDomain("mail.example.co.uk"))
+	assert.Equal(t, "localhost", OrganizationalDomain("localhost"))
+}
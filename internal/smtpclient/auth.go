@@ -0,0 +1,334 @@
+package smtpclient
+
+import (
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // CRAM-MD5 is defined with MD5
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ServerInfo records information about the server, passed to Auth mechanisms.
+type ServerInfo struct {
+	Name string   // server name
+	TLS  bool     // whether the connection uses TLS
+	Auth []string // advertised authentication mechanisms
+}
+
+// Auth is implemented by SMTP authentication mechanisms. It is the same
+// interface as net/smtp.Auth.
+type Auth interface {
+	// Start begins an authentication with a server. It returns the name of
+	// the authentication protocol and optionally data to include in the
+	// initial AUTH message sent to the server.
+	Start(server *ServerInfo) (proto string, toServer []byte, err error)
+
+	// Next continues the authentication. The server has just sent the
+	// fromServer data. If more is true, the server expects a response, which
+	// Next should return as toServer; otherwise Next should return
+	// toServer == nil.
+	Next(fromServer []byte, more bool) (toServer []byte, err error)
+}
+
+// checkPlaintext checks that credentials can be sent in the clear to the
+// server: over TLS connections, or to localhost.
+func checkPlaintext(server *ServerInfo, host string) error {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return errors.New("unencrypted connection")
+	}
+
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+
+	return nil
+}
+
+type plainAuth struct {
+	identity, username, password string
+	host                         string
+}
+
+// PlainAuth returns an Auth implementing the PLAIN mechanism (RFC 4616). The
+// credentials are only sent over TLS connections, or to localhost.
+func PlainAuth(identity, username, password, host string) Auth {
+	return &plainAuth{identity, username, password, host}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkPlaintext(server, a.host); err != nil {
+		return "", nil, err
+	}
+
+	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+
+	return "PLAIN", resp, nil
+}
+
+func (a *plainAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+
+	return nil, nil
+}
+
+type loginAuth struct {
+	username, password string
+	host               string
+}
+
+// LoginAuth returns an Auth implementing the obsolete LOGIN mechanism, still
+// required by some servers. Like PLAIN, the credentials are only sent over TLS
+// connections, or to localhost.
+func LoginAuth(username, password, host string) Auth {
+	return &loginAuth{username, password, host}
+}
+
+func (a *loginAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkPlaintext(server, a.host); err != nil {
+		return "", nil, err
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+	}
+}
+
+type cramMD5Auth struct {
+	username, secret string
+}
+
+// CRAMMD5Auth returns an Auth implementing the CRAM-MD5 mechanism (RFC 2195).
+// The secret isn't sent to the server, but can be guessed from the exchange.
+func CRAMMD5Auth(username, secret string) Auth {
+	return &cramMD5Auth{username, secret}
+}
+
+func (a *cramMD5Auth) Start(_ *ServerInfo) (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	d := hmac.New(md5.New, []byte(a.secret))
+	d.Write(fromServer)
+
+	return []byte(a.username + " " + hex.EncodeToString(d.Sum(nil))), nil
+}
+
+type scramAuth struct {
+	username, password string
+
+	nonce       string // client nonce, random unless set by tests
+	clientFirst string // client-first-message-bare
+	serverSig   []byte // expected server signature, once the proof is sent
+	verified    bool
+}
+
+// SCRAMSHA256Auth returns an Auth implementing the SCRAM-SHA-256 mechanism
+// (RFC 7677), without channel binding. Neither the password nor an equivalent
+// of it is sent to the server, and the server proves it knows the password
+// too.
+func SCRAMSHA256Auth(username, password string) Auth {
+	return &scramAuth{username: username, password: password}
+}
+
+func (a *scramAuth) Start(_ *ServerInfo) (string, []byte, error) {
+	if a.nonce == "" {
+		a.nonce = rand.Text()
+	}
+
+	// no channel binding: gs2-header "n,,", c=biws below
+	a.clientFirst = "n=" + scramEscape(a.username) + ",r=" + a.nonce
+
+	return "SCRAM-SHA-256", []byte("n,," + a.clientFirst), nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	switch {
+	case a.serverSig == nil && more:
+		return a.clientFinal(string(fromServer))
+	case a.serverSig != nil && !a.verified:
+		if err := a.verify(string(fromServer)); err != nil {
+			return nil, err
+		}
+
+		if more {
+			// the server final message was a challenge, it expects an
+			// empty response
+			return []byte{}, nil
+		}
+
+		return nil, nil
+	case !more && a.verified:
+		return nil, nil
+	default:
+		return nil, errors.New("unexpected server challenge")
+	}
+}
+
+// clientFinal answers the server-first-message with the client proof.
+func (a *scramAuth) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("invalid SCRAM server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid SCRAM salt")
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("invalid SCRAM iteration count")
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, a.password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(salted, "Server Key")
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := a.clientFirst + "," + serverFirst + "," + withoutProof
+
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	a.serverSig = scramHMAC(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server signature in the server-final-message.
+func (a *scramAuth) verify(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(sig, a.serverSig) {
+		return errors.New("invalid SCRAM server signature")
+	}
+
+	a.verified = true
+
+	return nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+
+	return h.Sum(nil)
+}
+
+// scramEscape escapes a SCRAM user name (RFC 5802 section 5.1).
+func scramEscape(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// scramAttributes parses the comma-separated attributes of a SCRAM message.
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+
+	for attr := range strings.SplitSeq(msg, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok && len(k) == 1 {
+			attrs[k] = v
+		}
+	}
+
+	return attrs
+}
+
+type autoAuth struct {
+	username, password string
+	host               string
+
+	mech Auth // selected once the mechanisms offered are known
+}
+
+// authPreference lists the mechanisms chosen by AutoAuth, strongest first.
+var authPreference = []string{"SCRAM-SHA-256", "CRAM-MD5", "PLAIN", "LOGIN"}
+
+// AutoAuth returns an Auth using the strongest mechanism the server offers
+// among SCRAM-SHA-256, CRAM-MD5, PLAIN and LOGIN. PLAIN and LOGIN are only
+// used over TLS connections, or with localhost.
+func AutoAuth(username, password, host string) Auth {
+	return &autoAuth{username: username, password: password, host: host}
+}
+
+func (a *autoAuth) Start(server *ServerInfo) (string, []byte, error) {
+	plaintext := checkPlaintext(server, a.host) == nil
+
+	for _, name := range authPreference {
+		if !slices.ContainsFunc(server.Auth, func(m string) bool { return strings.EqualFold(m, name) }) {
+			continue
+		}
+
+		switch name {
+		case "SCRAM-SHA-256":
+			a.mech = SCRAMSHA256Auth(a.username, a.password)
+		case "CRAM-MD5":
+			a.mech = CRAMMD5Auth(a.username, a.password)
+		case "PLAIN":
+			if !plaintext {
+				continue
+			}
+
+			a.mech = PlainAuth("", a.username, a.password, a.host)
+		case "LOGIN":
+			if !plaintext {
+				continue
+			}
+
+			a.mech = LoginAuth(a.username, a.password, a.host)
+		}
+
+		return a.mech.Start(server)
+	}
+
+	return "", nil, fmt.Errorf("no supported authentication mechanism offered (%s)", strings.Join(server.Auth, " "))
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.mech.Next(fromServer, more)
+}
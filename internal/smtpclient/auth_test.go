@@ -0,0 +1,155 @@
+package smtpclient
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginAuth(t *testing.T) {
+	t.Parallel()
+
+	a := LoginAuth("alice", "secret", "smtp.example.com")
+
+	_, _, err := a.Start(&ServerInfo{Name: "smtp.example.com"})
+	require.ErrorContains(t, err, "unencrypted")
+
+	mech, resp, err := a.Start(&ServerInfo{Name: "smtp.example.com", TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, "LOGIN", mech)
+	assert.Nil(t, resp)
+
+	resp, err = a.Next([]byte("Username:"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", string(resp))
+
+	resp, err = a.Next([]byte("Password:"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(resp))
+
+	resp, err = a.Next([]byte("2.7.0 Authentication successful"), false)
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+
+	_, err = a.Next([]byte("Something else:"), true)
+	require.Error(t, err)
+}
+
+func TestCRAMMD5Auth(t *testing.T) {
+	t.Parallel()
+
+	// RFC 2195 example
+	a := CRAMMD5Auth("tim", "tanstaaftanstaaf")
+
+	mech, _, err := a.Start(&ServerInfo{Name: "smtp.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "CRAM-MD5", mech)
+
+	resp, err := a.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "tim b913a602c7eda7a495b4e6e7334d3890", string(resp))
+}
+
+func TestSCRAMSHA256Auth(t *testing.T) {
+	t.Parallel()
+
+	// RFC 7677 example
+	a := SCRAMSHA256Auth("user", "pencil")
+	a.(*scramAuth).nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	mech, resp, err := a.Start(&ServerInfo{Name: "smtp.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "SCRAM-SHA-256", mech)
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(resp))
+
+	resp, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(resp))
+
+	// the server proves it knows the password too
+	resp, err = a.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{}, resp)
+
+	resp, err = a.Next([]byte("2.7.0 Authentication successful"), false)
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+
+	// a server not knowing the password is rejected
+	a = SCRAMSHA256Auth("user", "pencil")
+	a.(*scramAuth).nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	_, _, err = a.Start(&ServerInfo{})
+	require.NoError(t, err)
+
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	require.NoError(t, err)
+
+	_, err = a.Next([]byte("v=AAAA"), true)
+	require.ErrorContains(t, err, "server signature")
+
+	// the server nonce must extend the client one
+	a = SCRAMSHA256Auth("user", "pencil")
+
+	_, _, err = a.Start(&ServerInfo{})
+	require.NoError(t, err)
+
+	_, err = a.Next([]byte("r=bogus,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	require.ErrorContains(t, err, "nonce")
+}
+
+func TestAutoAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		offered []string
+		tls     bool
+		want    string
+	}{
+		{offered: []string{"PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-256"}, want: "SCRAM-SHA-256"},
+		{offered: []string{"login", "cram-md5"}, want: "CRAM-MD5"},
+		{offered: []string{"LOGIN", "PLAIN"}, tls: true, want: "PLAIN"},
+		{offered: []string{"LOGIN", "XOAUTH2"}, tls: true, want: "LOGIN"},
+		// credentials aren't sent in the clear
+		{offered: []string{"LOGIN", "PLAIN"}},
+		{offered: []string{"XOAUTH2"}, tls: true},
+	} {
+		a := AutoAuth("alice", "secret", "smtp.example.com")
+
+		mech, _, err := a.Start(&ServerInfo{Name: "smtp.example.com", TLS: tc.tls, Auth: tc.offered})
+		if tc.want == "" {
+			require.Error(t, err, tc.offered)
+			continue
+		}
+
+		require.NoError(t, err, tc.offered)
+		assert.Equal(t, tc.want, mech, tc.offered)
+	}
+}
+
+func TestAuthExchange(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	challenge := base64.StdEncoding.EncodeToString([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+
+	addr, cmds := startScriptedServer(t, "220 hello",
+		"250-hi\r\n250 AUTH CRAM-MD5 LOGIN",
+		"334 "+challenge,
+		"235 2.7.0 Authentication successful",
+	)
+
+	c, err := Dial(ctx, addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	require.NoError(t, c.Auth(ctx, AutoAuth("tim", "tanstaaftanstaaf", "127.0.0.1")))
+
+	<-cmds
+	assert.Equal(t, "AUTH CRAM-MD5\r\n", <-cmds)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("tim b913a602c7eda7a495b4e6e7334d3890"))+"\r\n", <-cmds)
+}
@@ -0,0 +1,577 @@
+// Package smtpclient implements a context-aware SMTP client, with per-phase
+// timeouts, structured errors and tracing.
+package smtpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/grafana/smtprelay/v2/internal/smtpclient")
+
+// Timeouts bounds the duration of each phase of an SMTP session. Zero values
+// use the defaults. A deadline in the context takes precedence when earlier.
+type Timeouts struct {
+	Dial    time.Duration // Connecting, and reading the greeting. (default: 30s)
+	TLS     time.Duration // STARTTLS command and handshake. (default: 30s)
+	Auth    time.Duration // Authentication exchange. (default: 30s)
+	Command time.Duration // Other commands, like EHLO, MAIL and RCPT. (default: 5m)
+	Data    time.Duration // Sending the message and reading the reply. (default: 10m)
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Dial <= 0 {
+		t.Dial = 30 * time.Second
+	}
+
+	if t.TLS <= 0 {
+		t.TLS = 30 * time.Second
+	}
+
+	if t.Auth <= 0 {
+		t.Auth = 30 * time.Second
+	}
+
+	if t.Command <= 0 {
+		t.Command = 5 * time.Minute
+	}
+
+	if t.Data <= 0 {
+		t.Data = 10 * time.Minute
+	}
+
+	return t
+}
+
+// Config configures a Client.
+type Config struct {
+	ServerName string // Name of the server, for TLS and authentication. (default: the host of the address)
+	LocalName  string // Name sent in EHLO/HELO. (default: "localhost")
+	Timeouts   Timeouts
+
+	// TLS, if set, is negotiated right after connecting (implicit TLS, as
+	// used on port 465). Use StartTLS to upgrade plaintext connections.
+	TLS *tls.Config
+}
+
+// Client is an SMTP client session. All operations are bounded by their phase
+// timeout and interrupted when their context is cancelled, in which case the
+// connection can't be used anymore.
+type Client struct {
+	addr       string
+	serverName string
+	localName  string
+	timeouts   Timeouts
+
+	conn net.Conn
+	text *textproto.Conn
+	tls  bool
+	ext  map[string]string // supported extensions, with their parameters
+	auth []string          // supported authentication mechanisms
+
+	messages  int       // messages sent
+	idleSince time.Time // when the session was returned to its pool
+}
+
+// Dial connects to the SMTP server at addr, reads its greeting and introduces
+// itself.
+func Dial(ctx context.Context, addr string, cfg Config) (*Client, error) {
+	c := &Client{
+		addr:       addr,
+		serverName: cfg.ServerName,
+		localName:  cfg.LocalName,
+		timeouts:   cfg.Timeouts.withDefaults(),
+	}
+
+	if c.serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, newError(PhaseDial, err)
+		}
+
+		c.serverName = host
+	}
+
+	if c.localName == "" {
+		c.localName = "localhost"
+	}
+
+	if err := c.dial(ctx); err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS != nil {
+		if err := c.handshake(ctx, cfg.TLS); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+
+	err := c.phase(ctx, PhaseGreeting, c.timeouts.Dial, func(context.Context) error {
+		_, _, err := c.text.ReadResponse(220)
+		return err
+	})
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	if err := c.hello(ctx); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) dial(ctx context.Context) error {
+	ctx, span := c.startSpan(ctx, PhaseDial)
+	defer span.End()
+
+	dialer := &net.Dialer{Timeout: c.timeouts.Dial}
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return c.fail(span, newError(PhaseDial, err))
+	}
+
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+
+	return nil
+}
+
+func (c *Client) startSpan(ctx context.Context, phase Phase) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "smtp.client."+string(phase),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.ServerAddress(c.serverName)),
+	)
+}
+
+func (c *Client) fail(span trace.Span, err *Error) error {
+	if err.Code != 0 {
+		span.SetAttributes(traceutil.StatusCode(err.Code))
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	return err
+}
+
+// phase runs fn in its own span, with the connection deadline set from the
+// phase timeout. The connection is interrupted if ctx is cancelled.
+func (c *Client) phase(ctx context.Context, phase Phase, timeout time.Duration, fn func(ctx context.Context) error) error {
+	ctx, span := c.startSpan(ctx, phase)
+	defer span.End()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	conn := c.conn
+	_ = conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	err := fn(ctx)
+	if err == nil {
+		return nil
+	}
+
+	var tperr *textproto.Error
+	if cerr := ctx.Err(); cerr != nil && !errors.As(err, &tperr) {
+		err = cerr
+	}
+
+	return c.fail(span, newError(phase, err))
+}
+
+// cmd sends a command and reads the reply, expecting the given code (see
+// textproto.Conn.ReadResponse).
+func (c *Client) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	return c.text.ReadResponse(expectCode)
+}
+
+// hello sends EHLO, falling back to HELO for servers rejecting it.
+func (c *Client) hello(ctx context.Context) error {
+	return c.phase(ctx, PhaseHello, c.timeouts.Command, func(context.Context) error {
+		_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+
+		var tperr *textproto.Error
+		if errors.As(err, &tperr) && tperr.Code >= 500 {
+			c.ext = nil
+			_, _, err = c.cmd(250, "HELO %s", c.localName)
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c.ext = map[string]string{}
+		c.auth = nil
+
+		lines := strings.Split(msg, "\n")
+		for _, line := range lines[1:] {
+			k, v, _ := strings.Cut(line, " ")
+			c.ext[strings.ToUpper(k)] = v
+		}
+
+		if mechs, ok := c.ext["AUTH"]; ok {
+			c.auth = strings.Fields(mechs)
+		}
+
+		return nil
+	})
+}
+
+// Extension reports whether the server supports an extension, and returns its
+// parameters.
+func (c *Client) Extension(ext string) (bool, string) {
+	if c.ext == nil {
+		return false, ""
+	}
+
+	param, ok := c.ext[strings.ToUpper(ext)]
+
+	return ok, param
+}
+
+// TLS reports whether the connection uses TLS.
+func (c *Client) TLS() bool {
+	return c.tls
+}
+
+// StartTLS upgrades the connection to TLS, and introduces itself again.
+func (c *Client) StartTLS(ctx context.Context, config *tls.Config) error {
+	err := c.phase(ctx, PhaseTLS, c.timeouts.TLS, func(ctx context.Context) error {
+		if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+			return err
+		}
+
+		return c.upgrade(ctx, config)
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.hello(ctx)
+}
+
+// handshake negotiates implicit TLS.
+func (c *Client) handshake(ctx context.Context, config *tls.Config) error {
+	return c.phase(ctx, PhaseTLS, c.timeouts.TLS, func(ctx context.Context) error {
+		return c.upgrade(ctx, config)
+	})
+}
+
+func (c *Client) upgrade(ctx context.Context, config *tls.Config) error {
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	c.tls = true
+
+	return nil
+}
+
+// Auth authenticates with the given mechanism.
+func (c *Client) Auth(ctx context.Context, a Auth) error {
+	return c.phase(ctx, PhaseAuth, c.timeouts.Auth, func(context.Context) error {
+		encoding := base64.StdEncoding
+
+		mech, resp, err := a.Start(&ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.auth})
+		if err != nil {
+			return err
+		}
+
+		resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+
+		code, msg64, err := c.cmd(0, "%s", strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+
+		for err == nil {
+			var msg []byte
+
+			switch code {
+			case 334:
+				msg, err = encoding.DecodeString(msg64)
+			case 235:
+				// the last message isn't base64 because it isn't a challenge
+				msg = []byte(msg64)
+			default:
+				err = &textproto.Error{Code: code, Msg: msg64}
+			}
+
+			if err == nil {
+				resp, err = a.Next(msg, code == 334)
+			}
+
+			if err != nil {
+				if code == 334 {
+					// abort the exchange, the original error is what matters
+					_, _, _ = c.cmd(501, "*")
+				}
+
+				break
+			}
+
+			if resp == nil {
+				break
+			}
+
+			resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+			encoding.Encode(resp64, resp)
+			code, msg64, err = c.cmd(0, "%s", resp64)
+		}
+
+		return err
+	})
+}
+
+// Mail starts a mail transaction. The size of the message is announced to
+// servers supporting the SIZE extension (RFC 1870), and messages larger than
+// their limit are rejected without being sent. A zero size isn't announced.
+func (c *Client) Mail(ctx context.Context, from string, size int) error {
+	return c.phase(ctx, PhaseMail, c.timeouts.Command, func(context.Context) error {
+		cmd, err := c.mailCmd(from, size)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = c.cmd(250, "%s", cmd)
+
+		return err
+	})
+}
+
+// mailCmd returns the MAIL command for a message of the given size, or an
+// error if the sender is invalid or the message exceeds the limit of the
+// server.
+func (c *Client) mailCmd(from string, size int) (string, error) {
+	if err := validateAddress(from); err != nil {
+		return "", err
+	}
+
+	cmd := "MAIL FROM:<" + from + ">"
+
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+
+	if ok, param := c.Extension("SIZE"); ok && size > 0 {
+		if limit, err := strconv.Atoi(param); err == nil && limit > 0 && size > limit {
+			return "", &textproto.Error{Code: 552, Msg: fmt.Sprintf("5.3.4 Message size exceeds the server limit of %d bytes", limit)}
+		}
+
+		cmd += " SIZE=" + strconv.Itoa(size)
+	}
+
+	return cmd, nil
+}
+
+// Rcpt adds a recipient to the mail transaction.
+func (c *Client) Rcpt(ctx context.Context, to string) error {
+	return c.phase(ctx, PhaseRcpt, c.timeouts.Command, func(ctx context.Context) error {
+		trace.SpanFromContext(ctx).SetAttributes(traceutil.Recipients([]string{to}))
+
+		if err := validateAddress(to); err != nil {
+			return err
+		}
+
+		_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+		return err
+	})
+}
+
+// Envelope starts a mail transaction for the given recipients, like Mail
+// followed by Rcpt for each of them. With servers supporting PIPELINING
+// (RFC 2920), the commands are sent at once and their replies read
+// afterwards, saving a round trip per recipient.
+//
+// The reply of the server to each recipient is returned in order, nil for
+// accepted ones. The error is set if the transaction couldn't be started, or
+// if the session failed.
+func (c *Client) Envelope(ctx context.Context, from string, size int, to []string) ([]error, error) {
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		if err := c.Mail(ctx, from, size); err != nil {
+			return nil, err
+		}
+
+		errs := make([]error, len(to))
+
+		for i, rcpt := range to {
+			errs[i] = c.Rcpt(ctx, rcpt)
+			if errs[i] != nil && !isReply(errs[i]) {
+				return nil, errs[i]
+			}
+		}
+
+		return errs, nil
+	}
+
+	errs := make([]error, len(to))
+
+	err := c.phase(ctx, PhaseMail, c.timeouts.Command, func(ctx context.Context) error {
+		trace.SpanFromContext(ctx).SetAttributes(traceutil.Recipients(to))
+
+		cmd, err := c.mailCmd(from, size)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.text.W, "%s\r\n", cmd)
+
+		for i, rcpt := range to {
+			// invalid recipients are rejected without being sent
+			if errs[i] = validateAddress(rcpt); errs[i] != nil {
+				errs[i] = newError(PhaseRcpt, errs[i])
+				continue
+			}
+
+			fmt.Fprintf(c.text.W, "RCPT TO:<%s>\r\n", rcpt)
+		}
+
+		if err := c.text.W.Flush(); err != nil {
+			return err
+		}
+
+		// every reply is read, even when MAIL fails, to stay in sync
+		_, _, mailErr := c.text.ReadResponse(250)
+		if mailErr != nil && !isReply(mailErr) {
+			return mailErr
+		}
+
+		for i := range to {
+			if errs[i] != nil {
+				continue
+			}
+
+			_, _, err := c.text.ReadResponse(25)
+			if err != nil && !isReply(err) {
+				return err
+			}
+
+			if err != nil {
+				errs[i] = newError(PhaseRcpt, err)
+			}
+		}
+
+		return mailErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return errs, nil
+}
+
+// isReply reports whether err is a reply of the server, rather than a
+// failure of the session.
+// validateAddress rejects addresses which would inject commands, as they
+// contain line breaks.
+func validateAddress(addr string) error {
+	if strings.ContainsAny(addr, "\r\n") {
+		return &textproto.Error{Code: 501, Msg: "5.1.7 Address must not contain CR or LF"}
+	}
+
+	return nil
+}
+
+func isReply(err error) bool {
+	var tperr *textproto.Error
+	return errors.As(err, &tperr)
+}
+
+// Data streams the message read from r, and waits for the server to accept
+// it.
+func (c *Client) Data(ctx context.Context, r io.Reader) error {
+	return c.phase(ctx, PhaseData, c.timeouts.Data, func(context.Context) error {
+		if _, _, err := c.cmd(354, "DATA"); err != nil {
+			return err
+		}
+
+		w := c.text.DotWriter()
+		if _, err := io.Copy(w, r); err != nil {
+			_ = w.Close()
+			return err
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		if _, _, err := c.text.ReadResponse(250); err != nil {
+			return err
+		}
+
+		c.messages++
+
+		return nil
+	})
+}
+
+// Reset aborts the current mail transaction.
+func (c *Client) Reset(ctx context.Context) error {
+	return c.phase(ctx, PhaseReset, c.timeouts.Command, func(context.Context) error {
+		_, _, err := c.cmd(250, "RSET")
+		return err
+	})
+}
+
+// Noop checks that the server is still responding.
+func (c *Client) Noop(ctx context.Context) error {
+	return c.phase(ctx, PhaseNoop, c.timeouts.Command, func(context.Context) error {
+		_, _, err := c.cmd(250, "NOOP")
+		return err
+	})
+}
+
+// Quit ends the session, and closes the connection.
+func (c *Client) Quit(ctx context.Context) error {
+	err := c.phase(ctx, PhaseQuit, c.timeouts.Command, func(context.Context) error {
+		_, _, err := c.cmd(221, "QUIT")
+		return err
+	})
+
+	_ = c.Close()
+
+	return err
+}
+
+// Close closes the connection, without ending the session.
+func (c *Client) Close() error {
+	return c.text.Close()
+}
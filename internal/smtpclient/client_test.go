@@ -0,0 +1,513 @@
+package smtpclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer starts an SMTP server, returning its address.
+func startServer(t *testing.T, srv *smtpd.Server) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = srv.Serve(t.Context(), l)
+	}()
+
+	return l.Addr().String()
+}
+
+// startScriptedServer starts a server replying to each command with the next
+// of the given lines, after sending the greeting. Commands received are sent
+// to the returned channel.
+func startScriptedServer(t *testing.T, greeting string, replies ...string) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	cmds := make(chan string, 100)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if greeting != "" {
+			_, _ = conn.Write([]byte(greeting + "\r\n"))
+		}
+
+		r := bufio.NewReader(conn)
+		for _, reply := range replies {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			cmds <- line
+
+			_, _ = conn.Write([]byte(reply + "\r\n"))
+		}
+
+		// ignore further commands until the client hangs up
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String(), cmds
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	mu := sync.Mutex{}
+	envs := []smtpd.Envelope{}
+	data := []string{}
+
+	addr := startServer(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			b, err := env.Bytes()
+			if err != nil {
+				return err
+			}
+
+			envs = append(envs, env)
+			data = append(data, string(b))
+
+			return nil
+		},
+	})
+
+	c, err := Dial(ctx, addr, Config{LocalName: "client.example.com"})
+	require.NoError(t, err)
+
+	ok, size := c.Extension("size")
+	assert.True(t, ok)
+	assert.Equal(t, "10240000", size)
+	assert.False(t, c.TLS())
+
+	require.NoError(t, c.Mail(ctx, "bob@example.com", 100))
+	require.NoError(t, c.Rcpt(ctx, "alice@example.com"))
+	require.NoError(t, c.Data(ctx, strings.NewReader("Subject: test\r\n\r\n.hello\r\n")))
+	require.NoError(t, c.Noop(ctx))
+	require.NoError(t, c.Quit(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, envs, 1)
+	assert.Equal(t, "bob@example.com", envs[0].Sender)
+	assert.Equal(t, []string{"alice@example.com"}, envs[0].Recipients)
+	// the leading dot survives dot-stuffing
+	assert.Contains(t, data[0], "\n.hello\n")
+}
+
+func TestErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	addr := startServer(t, &smtpd.Server{
+		RecipientChecker: func(_ context.Context, _ smtpd.Peer, _ string) error {
+			return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+		},
+	})
+
+	c, err := Dial(ctx, addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	require.NoError(t, c.Mail(ctx, "bob@example.com", 0))
+
+	err = c.Rcpt(ctx, "nobody@example.com")
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseRcpt, cerr.Phase)
+	assert.Equal(t, 550, cerr.Code)
+	assert.Equal(t, "5.1.1", cerr.EnhancedCode)
+	assert.Equal(t, "No such user", cerr.Message)
+	assert.False(t, cerr.Temporary())
+
+	// replies still unwrap to textproto errors
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, "5.1.1 No such user", tperr.Msg)
+
+	_, err = Dial(ctx, "127.0.0.1:1", Config{})
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseDial, cerr.Phase)
+	assert.Zero(t, cerr.Code)
+	assert.True(t, cerr.Temporary())
+}
+
+// startTurnServer starts a server accepting all recipients but nobody@, and
+// counting round trips: replies are only sent once all the commands received
+// so far were handled.
+func startTurnServer(t *testing.T, pipelining bool) (string, *atomic.Int32) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	turns := &atomic.Int32{}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		w := bufio.NewWriter(conn)
+
+		_, _ = w.WriteString("220 hello\r\n")
+		_ = w.Flush()
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch verb, _, _ := strings.Cut(strings.TrimSpace(line), " "); {
+			case verb == "EHLO" && pipelining:
+				_, _ = w.WriteString("250-hi\r\n250 PIPELINING\r\n")
+			case strings.Contains(line, "nobody@"):
+				_, _ = w.WriteString("550 5.1.1 No such user\r\n")
+			default:
+				_, _ = w.WriteString("250 ok\r\n")
+			}
+
+			if r.Buffered() == 0 {
+				_ = w.Flush()
+
+				turns.Add(1)
+			}
+		}
+	}()
+
+	return l.Addr().String(), turns
+}
+
+func TestEnvelopePipelining(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	to := []string{"alice@example.com", "nobody@example.com", "carol@example.com"}
+
+	for _, tc := range []struct {
+		pipelining bool
+		turns      int32
+	}{
+		{pipelining: true, turns: 1},
+		{pipelining: false, turns: 4},
+	} {
+		addr, turns := startTurnServer(t, tc.pipelining)
+
+		c, err := Dial(ctx, addr, Config{})
+		require.NoError(t, err)
+
+		before := turns.Load()
+
+		errs, err := c.Envelope(ctx, "bob@example.com", 0, to)
+		require.NoError(t, err)
+		require.Len(t, errs, 3)
+
+		assert.NoError(t, errs[0])
+		assert.NoError(t, errs[2])
+
+		var cerr *Error
+		require.ErrorAs(t, errs[1], &cerr)
+		assert.Equal(t, PhaseRcpt, cerr.Phase)
+		assert.Equal(t, 550, cerr.Code)
+
+		assert.Equal(t, tc.turns, turns.Load()-before, "pipelining: %v", tc.pipelining)
+
+		_ = c.Close()
+	}
+}
+
+func TestEnvelopeRejectedSender(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	addr := startServer(t, &smtpd.Server{
+		SenderChecker: func(_ context.Context, _ smtpd.Peer, _ string) error {
+			return &textproto.Error{Code: 553, Msg: "5.7.1 Sender denied"}
+		},
+	})
+
+	c, err := Dial(ctx, addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	ok, _ := c.Extension("PIPELINING")
+	require.True(t, ok)
+
+	_, err = c.Envelope(ctx, "bob@example.com", 0, []string{"alice@example.com", "carol@example.com"})
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseMail, cerr.Phase)
+	assert.Equal(t, 553, cerr.Code)
+
+	// the replies to the recipients were read, the session is still in sync
+	require.NoError(t, c.Noop(ctx))
+}
+
+func TestInvalidAddresses(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	mu := sync.Mutex{}
+	rcpts := []string{}
+
+	addr := startServer(t, &smtpd.Server{
+		RecipientChecker: func(_ context.Context, _ smtpd.Peer, addr string) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			rcpts = append(rcpts, addr)
+
+			return nil
+		},
+	})
+
+	c, err := Dial(ctx, addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	injected := "bob@example.com>\r\nRCPT TO:<eve@example.com"
+
+	var cerr *Error
+
+	err = c.Mail(ctx, injected, 0)
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseMail, cerr.Phase)
+	assert.Equal(t, 501, cerr.Code)
+
+	_, err = c.Envelope(ctx, injected, 0, []string{"alice@example.com"})
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseMail, cerr.Phase)
+
+	errs, err := c.Envelope(ctx, "bob@example.com", 0, []string{"alice@example.com", injected})
+	require.NoError(t, err)
+	require.NoError(t, errs[0])
+	require.ErrorAs(t, errs[1], &cerr)
+	assert.Equal(t, PhaseRcpt, cerr.Phase)
+	assert.Equal(t, 501, cerr.Code)
+
+	err = c.Rcpt(ctx, injected)
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseRcpt, cerr.Phase)
+
+	// nothing was injected, and the session is still in sync
+	require.NoError(t, c.Noop(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{"alice@example.com"}, rcpts)
+}
+
+func TestSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	addr := startServer(t, &smtpd.Server{MaxMessageSize: 10})
+
+	c, err := Dial(ctx, addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	err = c.Mail(ctx, "bob@example.com", 11)
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseMail, cerr.Phase)
+	assert.Equal(t, 552, cerr.Code)
+
+	require.NoError(t, c.Mail(ctx, "bob@example.com", 10))
+}
+
+func TestHeloFallback(t *testing.T) {
+	t.Parallel()
+
+	addr, cmds := startScriptedServer(t, "220 hello",
+		"502 EHLO not supported",
+		"250 hi",
+	)
+
+	c, err := Dial(t.Context(), addr, Config{LocalName: "client.example.com"})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	assert.Equal(t, "EHLO client.example.com\r\n", <-cmds)
+	assert.Equal(t, "HELO client.example.com\r\n", <-cmds)
+
+	ok, _ := c.Extension("PIPELINING")
+	assert.False(t, ok)
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	// the server never sends its greeting
+	addr, _ := startScriptedServer(t, "")
+
+	start := time.Now()
+
+	_, err := Dial(t.Context(), addr, Config{Timeouts: Timeouts{Dial: 100 * time.Millisecond}})
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseGreeting, cerr.Phase)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	var nerr net.Error
+	require.ErrorAs(t, err, &nerr)
+	assert.True(t, nerr.Timeout())
+}
+
+func TestContextCancel(t *testing.T) {
+	t.Parallel()
+
+	// the server never replies to MAIL
+	addr, _ := startScriptedServer(t, "220 hello", "250 hi")
+
+	c, err := Dial(t.Context(), addr, Config{})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err = c.Mail(ctx, "bob@example.com", 0)
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseMail, cerr.Phase)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, and a pool
+// trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+func TestImplicitTLS(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	cert, roots := testCertificate(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	})
+	require.NoError(t, err)
+
+	secure := make(chan bool, 1)
+	srv := &smtpd.Server{
+		Handler: func(_ context.Context, peer smtpd.Peer, _ smtpd.Envelope) error {
+			secure <- peer.TLS != nil
+			return nil
+		},
+	}
+
+	go func() {
+		_ = srv.Serve(ctx, l)
+	}()
+
+	addr := l.Addr().String()
+
+	c, err := Dial(ctx, addr, Config{TLS: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots, ServerName: "127.0.0.1"}})
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	assert.True(t, c.TLS())
+
+	require.NoError(t, sendWith(ctx, c))
+	assert.True(t, <-secure)
+
+	// the certificate isn't trusted by default
+	_, err = Dial(ctx, addr, Config{TLS: &tls.Config{MinVersion: tls.VersionTLS12, ServerName: "127.0.0.1"}})
+
+	var cerr *Error
+	require.ErrorAs(t, err, &cerr)
+	assert.Equal(t, PhaseTLS, cerr.Phase)
+}
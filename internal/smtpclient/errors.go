@@ -0,0 +1,72 @@
+package smtpclient
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+)
+
+// Phase is a step of an SMTP session.
+type Phase string
+
+const (
+	PhaseDial     Phase = "dial"
+	PhaseGreeting Phase = "greeting"
+	PhaseHello    Phase = "hello"
+	PhaseTLS      Phase = "starttls"
+	PhaseAuth     Phase = "auth"
+	PhaseMail     Phase = "mail"
+	PhaseRcpt     Phase = "rcpt"
+	PhaseData     Phase = "data"
+	PhaseReset    Phase = "rset"
+	PhaseNoop     Phase = "noop"
+	PhaseQuit     Phase = "quit"
+)
+
+// Error is returned by all the client operations. It holds the phase of the
+// session the error occurred in, and the reply of the server if there was
+// one. For replies, Unwrap returns a *textproto.Error.
+type Error struct {
+	Phase        Phase
+	Code         int    // reply code, 0 if no reply was received
+	EnhancedCode string // enhanced status code (RFC 3463) of the reply, like "5.1.1", if any
+	Message      string // reply text, without the enhanced status code
+	Err          error
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("smtp %s: %d %s", e.Phase, e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("smtp %s: %v", e.Phase, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the error is transient: either no reply was
+// received, or the reply is a 4xx one.
+func (e *Error) Temporary() bool {
+	return e.Code < 500
+}
+
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?:\s+|$)`)
+
+// newError wraps err, which happened during the given phase.
+func newError(phase Phase, err error) *Error {
+	e := &Error{Phase: phase, Err: err}
+
+	if tperr, ok := err.(*textproto.Error); ok {
+		e.Code = tperr.Code
+		e.Message = tperr.Msg
+
+		if m := enhancedCodeRe.FindStringSubmatch(tperr.Msg); m != nil {
+			e.EnhancedCode = m[1]
+			e.Message = tperr.Msg[len(m[0]):]
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,251 @@
+package smtpclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when getting a session from a closed pool.
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// PoolConfig configures a Pool.
+type PoolConfig struct {
+	Size        int           // Max sessions open at once, in use or idle. (default: 4)
+	MaxIdleTime time.Duration // Idle sessions are closed after this long. (default: 1m)
+	MaxMessages int           // Sessions are closed after sending this many messages. (default: 100)
+
+	// Dial opens a new session, ready to start a mail transaction.
+	Dial func(ctx context.Context) (*Client, error)
+
+	// OnChange is called with the change of the number of sessions in use and
+	// idle, whenever they change. It can be left empty.
+	OnChange func(activeDelta, idleDelta int)
+}
+
+// Pool is a bounded pool of sessions, reused across mail transactions.
+type Pool struct {
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	idle   []*Client // most recently used last
+	active int
+	closed bool
+	wait   chan struct{} // closed when a session is released
+}
+
+// NewPool returns a pool of sessions opened with cfg.Dial.
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.Size <= 0 {
+		cfg.Size = 4
+	}
+
+	if cfg.MaxIdleTime <= 0 {
+		cfg.MaxIdleTime = time.Minute
+	}
+
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = 100
+	}
+
+	if cfg.OnChange == nil {
+		cfg.OnChange = func(int, int) {}
+	}
+
+	return &Pool{cfg: cfg, wait: make(chan struct{})}
+}
+
+// Get returns an idle session after checking it's still working, or opens a
+// new one. It blocks while the pool is full. The session must be returned
+// with Put.
+func (p *Pool) Get(ctx context.Context) (*Client, error) {
+	for {
+		p.mu.Lock()
+
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		p.pruneLocked()
+
+		if n := len(p.idle); n > 0 {
+			c := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.active++
+			p.mu.Unlock()
+
+			p.cfg.OnChange(1, -1)
+
+			// the previous transaction may have failed, and the server may
+			// have hung up since
+			if err := c.Reset(ctx); err != nil {
+				_ = c.Close()
+				p.release()
+
+				if ctx.Err() != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			return c, nil
+		}
+
+		if p.active < p.cfg.Size {
+			p.active++
+			p.mu.Unlock()
+
+			p.cfg.OnChange(1, 0)
+
+			c, err := p.cfg.Dial(ctx)
+			if err != nil {
+				p.release()
+				return nil, err
+			}
+
+			return c, nil
+		}
+
+		wait := p.wait
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put returns a session to the pool, given the error of the last operation
+// made with it. The session is kept for reuse unless the error means it is
+// broken, or it has sent too many messages.
+func (p *Pool) Put(c *Client, err error) {
+	if !reusable(err) || c.messages >= p.cfg.MaxMessages {
+		_ = c.Close()
+		p.release()
+
+		return
+	}
+
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+
+		_ = c.Close()
+		p.release()
+
+		return
+	}
+
+	c.idleSince = time.Now()
+	p.idle = append(p.idle, c)
+	p.active--
+	p.wakeLocked()
+	p.mu.Unlock()
+
+	p.cfg.OnChange(-1, 1)
+}
+
+// reusable reports whether a session can still be used after the error.
+// Replies other than 421 leave the session working.
+func reusable(err error) bool {
+	if err == nil {
+		return true
+	}
+
+	var cerr *Error
+
+	return errors.As(err, &cerr) && cerr.Code != 0 && cerr.Code != 421
+}
+
+// release accounts for a session in use being closed.
+func (p *Pool) release() {
+	p.mu.Lock()
+	p.active--
+	p.wakeLocked()
+	p.mu.Unlock()
+
+	p.cfg.OnChange(-1, 0)
+}
+
+func (p *Pool) wakeLocked() {
+	close(p.wait)
+	p.wait = make(chan struct{})
+}
+
+// pruneLocked closes the sessions which have been idle for too long.
+func (p *Pool) pruneLocked() {
+	deadline := time.Now().Add(-p.cfg.MaxIdleTime)
+	kept := p.idle[:0]
+
+	for _, c := range p.idle {
+		if c.idleSince.Before(deadline) {
+			_ = c.Close()
+			p.cfg.OnChange(0, -1)
+
+			continue
+		}
+
+		kept = append(kept, c)
+	}
+
+	clear(p.idle[len(kept):])
+	p.idle = kept
+}
+
+// Run closes idle sessions once they expire, until ctx is cancelled, and then
+// closes the pool.
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.MaxIdleTime / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.pruneLocked()
+			p.mu.Unlock()
+		case <-ctx.Done():
+			p.Close()
+			return
+		}
+	}
+}
+
+// Close closes the idle sessions, and the sessions in use once they are
+// returned.
+func (p *Pool) Close() {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.wakeLocked()
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = c.Quit(ctx)
+
+		cancel()
+		p.cfg.OnChange(0, -1)
+	}
+}
+
+// Stats returns the number of sessions in use and idle.
+func (p *Pool) Stats() (active, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.active, len(p.idle)
+}
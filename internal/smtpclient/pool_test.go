@@ -0,0 +1,171 @@
+package smtpclient
+
+import (
+	"context"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(t *testing.T, cfg PoolConfig) (*Pool, *atomic.Int32) {
+	t.Helper()
+
+	addr := startServer(t, &smtpd.Server{})
+
+	dials := &atomic.Int32{}
+	cfg.Dial = func(ctx context.Context) (*Client, error) {
+		dials.Add(1)
+		return Dial(ctx, addr, Config{})
+	}
+
+	pool := NewPool(cfg)
+	t.Cleanup(pool.Close)
+
+	return pool, dials
+}
+
+func sendWith(ctx context.Context, c *Client) error {
+	if err := c.Mail(ctx, "bob@example.com", 0); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(ctx, "alice@example.com"); err != nil {
+		return err
+	}
+
+	return c.Data(ctx, strings.NewReader("hello\r\n"))
+}
+
+func TestPoolReuse(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	pool, dials := newTestPool(t, PoolConfig{MaxMessages: 3})
+
+	for range 5 {
+		c, err := pool.Get(ctx)
+		require.NoError(t, err)
+
+		err = sendWith(ctx, c)
+		require.NoError(t, err)
+
+		pool.Put(c, err)
+	}
+
+	// a new session is opened after 3 messages
+	assert.Equal(t, int32(2), dials.Load())
+
+	active, idle := pool.Stats()
+	assert.Equal(t, 0, active)
+	assert.Equal(t, 1, idle)
+
+	// sessions are kept after a rejection, but not after a network error
+	c, err := pool.Get(ctx)
+	require.NoError(t, err)
+	pool.Put(c, newError(PhaseRcpt, &textproto.Error{Code: 550, Msg: "no"}))
+
+	c, err = pool.Get(ctx)
+	require.NoError(t, err)
+	pool.Put(c, newError(PhaseData, context.DeadlineExceeded))
+
+	_, idle = pool.Stats()
+	assert.Equal(t, 0, idle)
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestPoolBounded(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	changes := &atomic.Int32{}
+	pool, dials := newTestPool(t, PoolConfig{
+		Size: 1,
+		OnChange: func(activeDelta, idleDelta int) {
+			changes.Add(int32(activeDelta + idleDelta))
+		},
+	})
+
+	c, err := pool.Get(ctx)
+	require.NoError(t, err)
+
+	// the pool is full, Get waits until the session is returned
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err = pool.Get(waitCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	got := make(chan *Client)
+
+	go func() {
+		c, err := pool.Get(ctx)
+		assert.NoError(t, err)
+
+		got <- c
+	}()
+
+	pool.Put(c, nil)
+
+	c2 := <-got
+	assert.Same(t, c, c2)
+	assert.Equal(t, int32(1), dials.Load())
+
+	pool.Put(c2, nil)
+	pool.Close()
+
+	_, err = pool.Get(ctx)
+	require.ErrorIs(t, err, ErrPoolClosed)
+
+	// all sessions are accounted for as closed
+	assert.Zero(t, changes.Load())
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	pool, dials := newTestPool(t, PoolConfig{MaxIdleTime: 50 * time.Millisecond})
+
+	c, err := pool.Get(ctx)
+	require.NoError(t, err)
+	pool.Put(c, nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	c, err = pool.Get(ctx)
+	require.NoError(t, err)
+	pool.Put(c, nil)
+
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestPoolBrokenSession(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	pool, dials := newTestPool(t, PoolConfig{})
+
+	c, err := pool.Get(ctx)
+	require.NoError(t, err)
+	pool.Put(c, nil)
+
+	// the server hung up while the session was idle
+	require.NoError(t, c.conn.Close())
+
+	c, err = pool.Get(ctx)
+	require.NoError(t, err)
+	require.NoError(t, sendWith(ctx, c))
+	pool.Put(c, nil)
+
+	assert.Equal(t, int32(2), dials.Load())
+}
@@ -0,0 +1,111 @@
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// errSpillFailed is returned when a body can't be spilled to disk.
+var errSpillFailed = errors.New("could not spill message body")
+
+// body is the body of a message, held in memory up to a threshold, and
+// spilled to a temporary file past it. It's written once, then read with
+// independent readers.
+type body struct {
+	threshold int64  // -1 to never spill
+	dir       string // of the temporary file, os.TempDir() if empty
+
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+func newBody(threshold int64, dir string) *body {
+	return &body{threshold: threshold, dir: dir}
+}
+
+func (b *body) Write(p []byte) (int, error) {
+	if b.file == nil && b.threshold >= 0 && b.size+int64(len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file == nil {
+		b.mem = append(b.mem, p...)
+		b.size += int64(len(p))
+
+		return len(p), nil
+	}
+
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", errSpillFailed, err)
+	}
+
+	return n, nil
+}
+
+// spill moves the body to a temporary file.
+func (b *body) spill() error {
+	f, err := os.CreateTemp(b.dir, "smtpd-body-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSpillFailed, err)
+	}
+
+	if _, err := f.Write(b.mem); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+
+		return fmt.Errorf("%w: %w", errSpillFailed, err)
+	}
+
+	b.file = f
+	b.mem = nil
+
+	return nil
+}
+
+// reader returns a reader of the body, from its start. Readers can be used
+// concurrently.
+func (b *body) reader() io.Reader {
+	if b == nil {
+		return bytes.NewReader(nil)
+	}
+
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+
+	return bytes.NewReader(b.mem)
+}
+
+// Len returns the size of the body.
+func (b *body) Len() int64 {
+	if b == nil {
+		return 0
+	}
+
+	return b.size
+}
+
+// Close removes the temporary file, if the body was spilled.
+func (b *body) Close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+
+	err := b.file.Close()
+
+	if rerr := os.Remove(b.file.Name()); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) && err == nil {
+		err = rerr
+	}
+
+	return err
+}
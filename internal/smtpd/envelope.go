@@ -1,23 +1,128 @@
 package smtpd
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/textproto"
+	"strings"
 	"time"
 )
 
-// Envelope holds a message, its headers and recipients. The Header field is
-// read-only and updates to it are not reflected in Data.
+// maxHeaderSize bounds the size of the raw header held in memory, like
+// Postfix's header_size_limit. The rest of larger headers is read with the
+// body, and left as is by the methods changing the header.
+const maxHeaderSize = 256 << 10
+
+// Envelope holds a message, its headers and recipients. The message is held
+// as its raw header, in memory, and its body, which the server spills to a
+// temporary file when it's large: Reader streams the message, and Bytes
+// loads it in memory. The Header field mirrors the raw header: the methods
+// changing the header keep it up to date, but direct updates to it are not
+// reflected in the message.
 type Envelope struct {
 	Sender     string
 	Recipients []string
 	Header     textproto.MIMEHeader
-	Data       []byte
+
+	header []byte // raw, with the blank line ending it, if any
+	body   *body
+}
+
+// SetData replaces the message with data.
+func (env *Envelope) SetData(data []byte) {
+	end, offset := len(data), 0
+
+	for line := range bytes.Lines(data) {
+		offset += len(line)
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			end = offset
+			break
+		}
+	}
+
+	env.header = data[:end:end]
+	env.body = &body{threshold: -1, mem: data[end:], size: int64(len(data) - end)}
+	env.parseHeader()
 }
 
-// AddReceivedLine prepends a Received header to the Data
+// readData reads the message from r: its header line by line, then its body
+// into b.
+func (env *Envelope) readData(r io.Reader, b *body) error {
+	br := bufio.NewReader(r)
+	header := []byte{}
+	lineStart := 0
+
+	env.body = b
+
+	for len(header) < maxHeaderSize {
+		chunk, err := br.ReadSlice('\n')
+		header = append(header, chunk...)
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// a long line, read on
+			continue
+		}
+
+		if errors.Is(err, io.EOF) {
+			// the message is only a header
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(bytes.TrimRight(header[lineStart:], "\r\n")) == 0 {
+			break
+		}
+
+		lineStart = len(header)
+	}
+
+	env.header = header
+	env.parseHeader()
+
+	_, err := br.WriteTo(b)
+
+	return err
+}
+
+// Reader returns a reader of the message, from its start. Readers are
+// independent, and can be used concurrently, but not after the message was
+// changed, or the server's Handler returned.
+func (env *Envelope) Reader() io.Reader {
+	return io.MultiReader(bytes.NewReader(env.header), env.body.reader())
+}
+
+// Size returns the size of the message.
+func (env *Envelope) Size() int64 {
+	return int64(len(env.header)) + env.body.Len()
+}
+
+// Bytes returns the message, read in memory.
+func (env *Envelope) Bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, env.Size()))
+
+	if _, err := buf.ReadFrom(env.Reader()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Close releases the message body. The server closes the envelopes it hands
+// off to its Handler once it returns.
+func (env *Envelope) Close() error {
+	return env.body.Close()
+}
+
+// AddReceivedLine prepends a Received header to the message.
 func (env *Envelope) AddReceivedLine(peer Peer) {
 	tlsDetails := ""
 
@@ -59,9 +164,167 @@ func (env *Envelope) AddReceivedLine(peer Peer) {
 		time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700 (MST)"),
 	)))
 
-	env.Data = append(env.Data, line...)
+	env.header = append(line, env.header...)
+	env.parseHeader()
+}
+
+// AddHeader prepends a header field to the message. Line breaks in the value
+// are kept as folding whitespace; values without any are folded if long.
+func (env *Envelope) AddHeader(key, value string) {
+	env.header = append(formatField(key, value, LineEnding(env.header)), env.header...)
+	env.parseHeader()
+}
+
+// SetHeader replaces the header fields with the given key with a single one,
+// where the first one was, or prepends it if there's none.
+func (env *Envelope) SetHeader(key, value string) {
+	found := false
+
+	env.RewriteHeader(func(k, v string) (string, bool) {
+		if k != textproto.CanonicalMIMEHeaderKey(key) {
+			return v, true
+		}
+
+		if found {
+			return v, false
+		}
+
+		found = true
+
+		return value, true
+	})
+
+	if !found {
+		env.AddHeader(key, value)
+	}
+}
+
+// DelHeader removes the header fields with the given key.
+func (env *Envelope) DelHeader(key string) {
+	env.RewriteHeader(func(k, v string) (string, bool) {
+		return v, k != textproto.CanonicalMIMEHeaderKey(key)
+	})
+}
+
+// RewriteHeader calls fn with the canonical key and the unfolded value of
+// each header field of the message, in order. fn returns the new value of the
+// field, and whether to keep it. Fields with unchanged values are kept as
+// they are.
+func (env *Envelope) RewriteHeader(fn func(key, value string) (string, bool)) {
+	out := make([]byte, 0, len(env.header))
+	rest := env.header
+	changed := false
+
+	for _, raw := range headerFields(env.header) {
+		rest = rest[len(raw):]
+
+		name, value, ok := bytes.Cut(raw, []byte(":"))
+		if !ok || len(bytes.TrimSpace(name)) == 0 || raw[0] == ' ' || raw[0] == '\t' {
+			// not a field, keep it as is
+			out = append(out, raw...)
+			continue
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))
+		unfolded := unfold(value)
+
+		newValue, keep := fn(key, unfolded)
+
+		switch {
+		case !keep:
+			changed = true
+		case newValue != unfolded:
+			out = append(out, formatField(string(bytes.TrimSpace(name)), newValue, LineEnding(raw))...)
+			changed = true
+		default:
+			out = append(out, raw...)
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	env.header = append(out, rest...)
+	env.parseHeader()
+}
+
+// parseHeader updates Header from the raw header.
+func (env *Envelope) parseHeader() {
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(env.header))).ReadMIMEHeader()
+	env.Header = header
+}
+
+// formatField formats a header field, ending with eol.
+func formatField(key, value, eol string) []byte {
+	var field []byte
+
+	if strings.ContainsAny(value, "\r\n") {
+		// keep the line breaks, as folding whitespace
+		lines := strings.FieldsFunc(value, func(r rune) bool { return r == '\r' || r == '\n' })
+		for i, line := range lines[1:] {
+			if line[0] != ' ' && line[0] != '\t' {
+				lines[i+1] = "\t" + line
+			}
+		}
+
+		field = []byte(key + ": " + strings.Join(lines, "\r\n") + "\r\n")
+	} else {
+		field = wrap([]byte(key + ": " + value + "\r\n"))
+	}
+
+	if eol != "\r\n" {
+		field = bytes.ReplaceAll(field, []byte("\r\n"), []byte(eol))
+	}
+
+	return field
+}
+
+// LineEnding returns the line ending of the first line of data, CRLF by
+// default, to add header fields consistent with the message.
+func LineEnding(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i == 0 || i > 0 && data[i-1] != '\r' {
+		return "\n"
+	}
+
+	return "\r\n"
+}
+
+// headerFields splits the header of a message into its raw fields, with
+// their continuation lines and line endings.
+func headerFields(data []byte) [][]byte {
+	fields := [][]byte{}
+	start := 0
+
+	for line := range bytes.Lines(data) {
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+
+		end := start + len(line)
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] = data[start-len(fields[len(fields)-1]) : end]
+		} else {
+			fields = append(fields, data[start:end])
+		}
+
+		start = end
+	}
+
+	return fields
+}
+
+// unfold returns a header field value without its folding whitespace, like
+// textproto.Reader.ReadMIMEHeader.
+func unfold(value []byte) string {
+	lines := []string{}
+
+	for line := range bytes.Lines(value) {
+		if trimmed := strings.TrimSpace(string(line)); trimmed != "" {
+			lines = append(lines, trimmed)
+		}
+	}
 
-	// Move the new Received line up front
-	copy(env.Data[len(line):], env.Data[0:len(env.Data)-len(line)])
-	copy(env.Data, line)
+	return strings.Join(lines, " ")
 }
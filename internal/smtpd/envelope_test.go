@@ -0,0 +1,144 @@
+package smtpd_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeHeader(t *testing.T) {
+	t.Parallel()
+
+	env := newEnvelope("Subject: hello\r\n" +
+		"X-Internal-Id: 42\r\n" +
+		"To: alice@example.com,\r\n" +
+		"\tbob@example.com\r\n" +
+		"x-internal-id: 43\r\n" +
+		"\r\n" +
+		"X-Not-A-Header: body\r\n")
+
+	env.AddHeader("X-Relay", "relay.example.com")
+	assert.Equal(t, "X-Relay: relay.example.com\r\nSubject: hello\r\n", envData(t, env)[:44])
+	assert.Equal(t, "relay.example.com", env.Header.Get("X-Relay"))
+
+	env.SetHeader("x-internal-id", "99")
+	assert.Equal(t, []string{"99"}, env.Header.Values("X-Internal-Id"))
+	assert.Contains(t, envData(t, env), "hello\r\nX-Internal-Id: 99\r\nTo:")
+
+	env.SetHeader("X-New", "new")
+	assert.Equal(t, "new", env.Header.Get("X-New"))
+
+	// values are unfolded, and unchanged fields are kept as they are
+	values := []string{}
+	env.RewriteHeader(func(key, value string) (string, bool) {
+		values = append(values, key+"="+value)
+
+		if key == "Subject" {
+			return "[ext] " + value, true
+		}
+
+		return value, true
+	})
+	assert.Equal(t, []string{
+		"X-New=new",
+		"X-Relay=relay.example.com",
+		"Subject=hello",
+		"X-Internal-Id=99",
+		"To=alice@example.com, bob@example.com",
+	}, values)
+	assert.Equal(t, "[ext] hello", env.Header.Get("Subject"))
+	assert.Contains(t, envData(t, env), "To: alice@example.com,\r\n\tbob@example.com\r\n")
+
+	env.DelHeader("X-INTERNAL-ID")
+	env.DelHeader("To")
+	env.DelHeader("X-Not-A-Header")
+	assert.Equal(t, "X-New: new\r\n"+
+		"X-Relay: relay.example.com\r\n"+
+		"Subject: [ext] hello\r\n"+
+		"\r\n"+
+		"X-Not-A-Header: body\r\n", envData(t, env))
+	assert.Empty(t, env.Header.Get("To"))
+}
+
+func TestEnvelopeHeaderFolding(t *testing.T) {
+	t.Parallel()
+
+	// the line endings of the message are kept
+	env := newEnvelope("Subject: hello\n\nbody\n")
+
+	long := strings.TrimSpace(strings.Repeat("word ", 30))
+
+	env.AddHeader("X-Long", long)
+	env.AddHeader("X-Multi", "first\r\nsecond\n\n third")
+	env.SetHeader("Subject", "bye\r\nInjected: header")
+
+	assert.NotContains(t, envData(t, env), "\r")
+	assert.Contains(t, envData(t, env), "X-Multi: first\n\tsecond\n third\n")
+	assert.Contains(t, envData(t, env), "Subject: bye\n\tInjected: header\n")
+	assert.Empty(t, env.Header.Get("Injected"))
+
+	assert.Contains(t, envData(t, env), "word\n\tword")
+	assert.Equal(t, long, env.Header.Get("X-Long"))
+	assert.Equal(t, "first second third", env.Header.Get("X-Multi"))
+}
+
+func TestEnvelopeAddReceivedLine(t *testing.T) {
+	t.Parallel()
+
+	env := newEnvelope("Subject: hello\r\n\r\nbody\r\n")
+
+	env.AddReceivedLine(smtpd.Peer{
+		Addr:       &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+		HeloName:   "client.example.com",
+		Protocol:   smtpd.ESMTP,
+		ServerName: "relay.example.com",
+	})
+
+	require.Len(t, env.Header.Values("Received"), 1)
+	assert.True(t, strings.HasPrefix(env.Header.Get("Received"), "from client.example.com ([192.0.2.1]) by relay.example.com with ESMTP;"))
+	assert.Equal(t, "hello", env.Header.Get("Subject"))
+}
+
+func TestEnvelopeSetData(t *testing.T) {
+	t.Parallel()
+
+	// messages without a header, or a body
+	for _, data := range []string{"\r\nbody\r\n", "Subject: hello\r\n", "hello"} {
+		env := newEnvelope(data)
+		assert.Equal(t, data, envData(t, env))
+		assert.Equal(t, int64(len(data)), env.Size())
+	}
+
+	env := newEnvelope("Subject: hello\r\n\r\nSubject: body\r\n")
+	env.DelHeader("Subject")
+	assert.Equal(t, "\r\nSubject: body\r\n", envData(t, env))
+}
+
+func newEnvelope(data string) *smtpd.Envelope {
+	env := &smtpd.Envelope{}
+	env.SetData([]byte(data))
+
+	return env
+}
+
+func envData(t *testing.T, env *smtpd.Envelope) string {
+	t.Helper()
+
+	data, err := env.Bytes()
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestLineEnding(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "\r\n", smtpd.LineEnding([]byte("Subject: hello\r\n\r\nhello\n")))
+	assert.Equal(t, "\n", smtpd.LineEnding([]byte("Subject: hello\n\r\nhello\r\n")))
+	assert.Equal(t, "\n", smtpd.LineEnding([]byte("\n")))
+	assert.Equal(t, "\r\n", smtpd.LineEnding([]byte("Subject: hello")))
+}
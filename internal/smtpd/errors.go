@@ -8,7 +8,10 @@ var (
 	ErrRateLimitExceeded = &textproto.Error{Code: 421, Msg: "Rate limit exceeded. Try again later."}
 	ErrRecipientDenied   = &textproto.Error{Code: 451, Msg: "Denied recipient address"}
 	ErrRecipientInvalid  = &textproto.Error{Code: 451, Msg: "Invalid recipient address"}
+	ErrDNSFailed         = &textproto.Error{Code: 451, Msg: "Temporary DNS failure. Try again later."}
 	ErrSenderDenied      = &textproto.Error{Code: 451, Msg: "sender address not allowed"}
+	ErrSpoolFailed       = &textproto.Error{Code: 451, Msg: "Could not queue message. Try again later."}
+	ErrStoreFailed       = &textproto.Error{Code: 451, Msg: "Could not store message. Try again later."}
 	ErrTooManyRecipients = &textproto.Error{Code: 452, Msg: "Too many recipients"}
 
 	ErrLineTooLong           = &textproto.Error{Code: 500, Msg: "Line too long"}
@@ -31,6 +34,8 @@ var (
 	ErrAuthRequired          = &textproto.Error{Code: 530, Msg: "Authentication required."}
 	ErrAuthInvalid           = &textproto.Error{Code: 535, Msg: "Authentication credentials invalid"}
 	ErrBadHandshake          = &textproto.Error{Code: 550, Msg: "Handshake error"}
+	ErrDomainNotFound        = &textproto.Error{Code: 550, Msg: "Recipient domain not found"}
 	ErrTooBig                = &textproto.Error{Code: 552, Msg: "Message exceeded maximum size"}
 	ErrForwardingFailed      = &textproto.Error{Code: 554, Msg: "Forwarding failed"}
+	ErrNullMX                = &textproto.Error{Code: 556, Msg: "Recipient domain does not accept mail"}
 )
@@ -296,19 +296,21 @@ func (session *session) handleDATA(ctx context.Context, _ command) {
 	session.reply(354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 	_ = session.conn.SetDeadline(time.Now().Add(session.server.DataTimeout))
 
-	data := &bytes.Buffer{}
 	reader := textproto.NewReader(session.reader).DotReader()
+	data := &io.LimitedReader{R: reader, N: int64(session.server.MaxMessageSize)}
 
-	_, err := io.CopyN(data, reader, int64(session.server.MaxMessageSize))
-	if errors.Is(err, io.EOF) {
-		// EOF was reached before MaxMessageSize
-		// Accept and deliver message
-		session.envelope.Data = data.Bytes()
+	body := newBody(int64(session.server.SpillSize), session.server.SpillDir)
+	defer body.Close()
 
-		// re-read to get the MIME header (if any)
-		header, _ := textproto.NewReader(bufio.NewReader(data)).ReadMIMEHeader()
-		session.envelope.Header = header
+	err := session.envelope.readData(data, body)
+	if err != nil && !errors.Is(err, errSpillFailed) {
+		// Network error, ignore
+		return
+	}
 
+	if err == nil && data.N > 0 {
+		// EOF was reached before MaxMessageSize
+		// Accept and deliver message
 		err = session.deliver(ctx)
 		if err != nil {
 			session.error(err)
@@ -318,19 +320,23 @@ func (session *session) handleDATA(ctx context.Context, _ command) {
 
 		session.reset()
 		return
-	} else if err != nil {
-		// Other network error, ignore
-		return
 	}
 
 	// Discard the rest and report an error.
-	_, err = io.Copy(io.Discard, reader)
-	if err != nil {
+	if _, cerr := io.Copy(io.Discard, reader); cerr != nil {
 		// Network error, ignore
 		return
 	}
 
-	session.error(fmt.Errorf("%w (max %d bytes)", ErrTooBig, session.server.MaxMessageSize))
+	if err != nil {
+		session.logf("%v", err)
+		session.error(ErrStoreFailed)
+	} else {
+		session.error(&textproto.Error{
+			Code: ErrTooBig.Code,
+			Msg:  fmt.Sprintf("%s (max %d bytes)", ErrTooBig.Msg, session.server.MaxMessageSize),
+		})
+	}
 
 	session.reset()
 }
@@ -35,9 +35,13 @@ type Server struct {
 	MaxMessageSize int // Max message size in bytes. (default: 10240000)
 	MaxRecipients  int // Max RCPT TO calls for each envelope. (default: 100)
 
+	SpillSize int    // Size in bytes past which message bodies are spilled to a temporary file, use -1 to disable. (default: 1048576)
+	SpillDir  string // Directory of the temporary files. (default: os.TempDir())
+
 	// New e-mails are handed off to this function.
 	// Can be left empty for a NOOP server.
 	// If an error is returned, it will be reported in the SMTP session.
+	// The message can't be read anymore once it returns.
 	Handler func(ctx context.Context, peer Peer, env Envelope) error
 
 	// Enable various checks during the SMTP session.
@@ -192,7 +196,10 @@ func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
 
 	l = &onceCloseListener{Listener: l}
 	defer l.Close()
+
+	srv.mu.Lock()
 	srv.listener = &l
+	srv.mu.Unlock()
 
 	var limiter chan struct{}
 
@@ -314,6 +321,10 @@ func (srv *Server) configureDefaults() {
 		srv.MaxRecipients = 100
 	}
 
+	if srv.SpillSize == 0 {
+		srv.SpillSize = 1 << 20
+	}
+
 	if srv.ReadTimeout == 0 {
 		srv.ReadTimeout = time.Second * 60
 	}
@@ -343,6 +354,10 @@ func (session *session) serve(ctx context.Context) {
 	ctx, span := tracer.Start(ctx, "smtpd.serve")
 	defer span.End()
 
+	// anything started on behalf of the session is cancelled when it ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	defer session.close()
 
 	ctx = context.WithValue(ctx, localAddrContextKey, session.conn.LocalAddr())
@@ -407,9 +422,22 @@ func (session *session) welcome(ctx context.Context) {
 	session.reply(220, session.server.WelcomeMessage)
 }
 
+// reply writes a reply, as a multi-line reply if message has several lines,
+// like the replies of upstream servers joined by net/textproto.
 func (session *session) reply(code int, message string) {
-	session.logf("sending: %d %s", code, message)
-	_, _ = fmt.Fprintf(session.writer, "%d %s\r\n", code, message)
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		line = strings.ReplaceAll(strings.TrimSuffix(line, "\r"), "\r", " ")
+
+		session.logf("sending: %03d%s%s", code, sep, line)
+		_, _ = fmt.Fprintf(session.writer, "%03d%s%s\r\n", code, sep, line)
+	}
+
 	session.flush()
 }
 
@@ -422,11 +450,9 @@ func (session *session) flush() {
 func (session *session) error(err error) {
 	var smtpdError *textproto.Error
 	if errors.As(err, &smtpdError) {
-		// session.reply(smtpdError.Code, err.Error())
-		// the error code will be prefixed in the error message
-		session.logf("sending: %s", err)
-		_, _ = fmt.Fprintf(session.writer, "%s\r\n", err)
-		session.flush()
+		// not using err.Error(), which quotes the message and includes the
+		// text of wrapping errors, not meant for the client
+		session.reply(smtpdError.Code, smtpdError.Msg)
 	} else {
 		session.reply(502, err.Error())
 	}
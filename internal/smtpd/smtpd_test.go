@@ -1,11 +1,13 @@
 package smtpd_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/smtp"
@@ -124,7 +126,7 @@ func cmd(c *textproto.Conn, expectedCode int, format string, args ...interface{}
 	return err
 }
 
-func runserver(t *testing.T, server *smtpd.Server) (addr string, closer func()) {
+func runserver(t testing.TB, server *smtpd.Server) (addr string, closer func()) {
 	t.Helper()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -483,6 +485,50 @@ func TestRecipientCheck(t *testing.T) {
 	require.Error(t, err, "RCPT succeeded despite RecipientCheck")
 }
 
+func TestMultilineError(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		RecipientChecker: func(_ context.Context, _ smtpd.Peer, _ string) error {
+			// net/textproto joins the lines of multi-line replies with "\n"
+			return fmt.Errorf("sendMail: route: %w", &textproto.Error{
+				Code: 550,
+				Msg:  "5.1.1 line one\n5.1.1 line two\r",
+			})
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	readLine := func() string {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		return line
+	}
+
+	assert.Contains(t, readLine(), "220 ")
+
+	for _, c := range []string{"HELO localhost", "MAIL FROM:<sender@example.org>"} {
+		_, err = fmt.Fprintf(conn, "%s\r\n", c)
+		require.NoError(t, err)
+		assert.Contains(t, readLine(), "250 ")
+	}
+
+	_, err = fmt.Fprintf(conn, "RCPT TO:<recipient@example.net>\r\n")
+	require.NoError(t, err)
+
+	assert.Equal(t, "550-5.1.1 line one\r\n", readLine())
+	assert.Equal(t, "550 5.1.1 line two\r\n", readLine())
+}
+
 func TestMaxMessageSize(t *testing.T) {
 	t.Parallel()
 
@@ -510,6 +556,11 @@ func TestMaxMessageSize(t *testing.T) {
 	err = wc.Close()
 	require.Error(t, err, "Allowed message larger than 5 bytes to pass.")
 
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 552, tperr.Code)
+	assert.Equal(t, "Message exceeded maximum size (max 5 bytes)", tperr.Msg)
+
 	err = c.Quit()
 	require.NoError(t, err)
 }
@@ -525,7 +576,9 @@ func TestHandler(t *testing.T) {
 			assert.Equal(t, "sender@example.org", env.Sender)
 			assert.Len(t, env.Recipients, 1)
 			assert.Equal(t, "recipient@example.net", env.Recipients[0])
-			assert.Equal(t, body+"\n", string(env.Data))
+			data, err := env.Bytes()
+			require.NoError(t, err)
+			assert.Equal(t, body+"\n", string(data))
 			assert.Equal(t, expectedHeader, env.Header)
 
 			return nil
@@ -553,6 +606,46 @@ func TestHandler(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestHandlerSpilled(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	body := "Subject: large\r\n\r\n" + strings.Repeat("This is the email body\r\n", 100)
+
+	addr, closer := runserver(t, &smtpd.Server{
+		SpillSize: 64,
+		SpillDir:  dir,
+		Handler: func(_ context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+			files, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, files, 1)
+
+			env.AddReceivedLine(peer)
+			assert.Equal(t, "large", env.Header.Get("Subject"))
+
+			data, err := io.ReadAll(env.Reader())
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(data), "Received: "))
+			// the DATA reader turns CRLF line endings into LF
+			assert.True(t, strings.HasSuffix(string(data), strings.ReplaceAll(body, "\r\n", "\n")))
+			assert.Equal(t, int64(len(data)), env.Size())
+
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	err := smtp.SendMail(addr, nil, "sender@example.org", []string{"recipient@example.net"}, []byte(body))
+	require.NoError(t, err)
+
+	// the temporary file is removed once the message is handled
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
 func TestRejectHandler(t *testing.T) {
 	t.Parallel()
 
@@ -907,7 +1000,8 @@ func TestEnvelopeReceived(t *testing.T) {
 		Hostname: "foobar.example.net",
 		Handler: func(_ context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
 			env.AddReceivedLine(peer)
-			if !bytes.HasPrefix(env.Data, []byte("Received: from localhost ([127.0.0.1]) by foobar.example.net with ESMTP;")) {
+			data, err := env.Bytes()
+			if err != nil || !bytes.HasPrefix(data, []byte("Received: from localhost ([127.0.0.1]) by foobar.example.net with ESMTP;")) {
 				t.Fatal("Wrong received line.")
 			}
 			return nil
@@ -1432,3 +1526,53 @@ func TestServe_Context(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+// BenchmarkDATA measures the memory used to receive a 10 MB message, and
+// stream it to a handler, with its body held in memory or spilled to disk.
+func BenchmarkDATA(b *testing.B) {
+	msg := []byte("Subject: large\r\n\r\n" + strings.Repeat(strings.Repeat("x", 998)+"\r\n", 10<<10))
+
+	for _, bc := range []struct {
+		name      string
+		spillSize int
+	}{
+		{name: "memory", spillSize: -1},
+		{name: "spilled", spillSize: 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			addr, closer := runserver(b, &smtpd.Server{
+				MaxMessageSize: 20 << 20,
+				SpillSize:      bc.spillSize,
+				SpillDir:       b.TempDir(),
+				Handler: func(_ context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+					env.AddReceivedLine(peer)
+
+					_, err := io.Copy(io.Discard, env.Reader())
+
+					return err
+				},
+			})
+			defer closer()
+
+			c, err := smtp.Dial(addr)
+			require.NoError(b, err)
+
+			defer c.Close()
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+
+			for b.Loop() {
+				require.NoError(b, c.Mail("sender@example.org"))
+				require.NoError(b, c.Rcpt("recipient@example.net"))
+
+				wc, err := c.Data()
+				require.NoError(b, err)
+
+				_, err = wc.Write(msg)
+				require.NoError(b, err)
+				require.NoError(b, wc.Close())
+			}
+		})
+	}
+}
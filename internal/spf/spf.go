@@ -0,0 +1,526 @@
+// Package spf implements Sender Policy Framework checks (RFC 7208), which
+// tell whether a host is allowed to send mail for a domain.
+//
+// The ptr mechanism, deprecated by the RFC, never matches, and the exp
+// modifier is ignored.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxLookups bounds the number of DNS-querying terms evaluated in a check
+// (RFC 7208, section 4.6.4).
+const maxLookups = 10
+
+// maxMXHosts bounds the number of hosts looked up for an mx mechanism.
+const maxMXHosts = 10
+
+// Result is the result of an SPF check, as reported in Authentication-Results
+// headers (RFC 8601).
+type Result string
+
+const (
+	None      Result = "none"      // the domain has no SPF record
+	Neutral   Result = "neutral"   // the domain makes no assertion about the host
+	Pass      Result = "pass"      // the host is allowed to send for the domain
+	Fail      Result = "fail"      // the host isn't allowed to send for the domain
+	SoftFail  Result = "softfail"  // the host probably isn't allowed to send for the domain
+	TempError Result = "temperror" // a DNS lookup failed
+	PermError Result = "permerror" // the SPF record is invalid
+)
+
+// Resolver looks up the DNS records needed for SPF checks. It is satisfied by
+// *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Check checks whether the host at ip may send mail from sender, which
+// introduced itself as helo. When the sender is empty (a bounce), the HELO
+// name is checked instead. It returns the checked domain with the result,
+// and an error explaining results other than pass.
+func Check(ctx context.Context, r Resolver, ip net.IP, sender, helo string) (Result, string, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+
+	local, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		local, domain = "postmaster", sender
+	}
+
+	if local == "" {
+		local = "postmaster"
+	}
+
+	c := &checker{
+		resolver: r,
+		ip:       ip,
+		sender:   local + "@" + domain,
+		helo:     helo,
+	}
+
+	result, err := c.check(ctx, strings.ToLower(domain))
+
+	return result, strings.ToLower(domain), err
+}
+
+// checker holds the state of a check, shared by included records.
+type checker struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+// record looks up the SPF record of a domain.
+func (c *checker) record(ctx context.Context, domain string) (string, Result, error) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", None, fmt.Errorf("no spf record for %s", domain)
+		}
+
+		return "", TempError, fmt.Errorf("spf record lookup for %s: %w", domain, err)
+	}
+
+	records := []string{}
+
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", None, fmt.Errorf("no spf record for %s", domain)
+	case 1:
+		return records[0], "", nil
+	default:
+		return "", PermError, fmt.Errorf("%d spf records for %s", len(records), domain)
+	}
+}
+
+// check evaluates the SPF record of a domain.
+func (c *checker) check(ctx context.Context, domain string) (Result, error) {
+	record, result, err := c.record(ctx, domain)
+	if err != nil {
+		return result, err
+	}
+
+	redirect := ""
+
+	for _, term := range strings.Fields(record)[1:] {
+		// modifiers are name=value, with an alphanumeric name
+		if name, value, ok := strings.Cut(term, "="); ok && isName(name) {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+
+			continue
+		}
+
+		qualifier := Pass
+
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+
+		matched, result, err := c.match(ctx, domain, term)
+		if err != nil {
+			return result, err
+		}
+
+		if matched {
+			if qualifier != Pass {
+				return qualifier, fmt.Errorf("%s matched %s in the spf record of %s", c.ip, term, domain)
+			}
+
+			return Pass, nil
+		}
+	}
+
+	if redirect == "" {
+		return Neutral, fmt.Errorf("no match for %s in the spf record of %s", c.ip, domain)
+	}
+
+	if err := c.count(); err != nil {
+		return PermError, err
+	}
+
+	target, err := c.target(redirect, domain)
+	if err != nil {
+		return PermError, err
+	}
+
+	result, err = c.check(ctx, target)
+	if result == None {
+		return PermError, fmt.Errorf("redirect to %s: %w", target, err)
+	}
+
+	return result, err
+}
+
+// match evaluates a mechanism, without its qualifier.
+func (c *checker) match(ctx context.Context, domain, term string) (bool, Result, error) {
+	name, arg, _ := strings.Cut(term, ":")
+	if i := strings.Index(name, "/"); i >= 0 {
+		// a/24 and mx/24 have a CIDR length but no domain
+		name, arg = name[:i], arg+name[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, "", nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			arg += map[string]string{"ip4": "/32", "ip6": "/128"}[strings.ToLower(name)]
+		}
+
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil || (strings.EqualFold(name, "ip4") != (ipNet.IP.To4() != nil)) {
+			return false, PermError, fmt.Errorf("invalid %s mechanism in the spf record of %s", term, domain)
+		}
+
+		return ipNet.Contains(c.ip), "", nil
+	case "include":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+
+		result, err := c.check(ctx, target)
+
+		switch result {
+		case Pass:
+			return true, "", nil
+		case Fail, SoftFail, Neutral:
+			return false, "", nil
+		case TempError:
+			return false, TempError, err
+		default:
+			return false, PermError, fmt.Errorf("include of %s: %w", target, err)
+		}
+	case "a", "mx":
+		host, v4, v6, err := splitCIDR(arg)
+		if err != nil {
+			return false, PermError, fmt.Errorf("invalid %s mechanism in the spf record of %s", term, domain)
+		}
+
+		if host == "" {
+			host = domain
+		}
+
+		target, err := c.lookupTarget(host, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+
+		hosts := []string{target}
+
+		if strings.EqualFold(name, "mx") {
+			mxs, err := c.resolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, TempError, fmt.Errorf("mx lookup for %s: %w", target, err)
+			}
+
+			if len(mxs) > maxMXHosts {
+				return false, PermError, fmt.Errorf("too many mx hosts for %s", target)
+			}
+
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, TempError, fmt.Errorf("address lookup for %s: %w", host, err)
+			}
+
+			for _, addr := range addrs {
+				if cidrContains(addr.IP, c.ip, v4, v6) {
+					return true, "", nil
+				}
+			}
+		}
+
+		return false, "", nil
+	case "exists":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, TempError, fmt.Errorf("address lookup for %s: %w", target, err)
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, "", nil
+			}
+		}
+
+		return false, "", nil
+	case "ptr":
+		// deprecated, and too expensive to be worth supporting
+		if err := c.count(); err != nil {
+			return false, PermError, err
+		}
+
+		return false, "", nil
+	default:
+		return false, PermError, fmt.Errorf("unknown mechanism %s in the spf record of %s", term, domain)
+	}
+}
+
+// count counts a DNS-querying term against the lookup limit.
+func (c *checker) count() error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return fmt.Errorf("more than %d dns lookups", maxLookups)
+	}
+
+	return nil
+}
+
+// lookupTarget counts a DNS-querying term against the lookup limit, and
+// returns its expanded target domain.
+func (c *checker) lookupTarget(spec, domain string) (string, error) {
+	if err := c.count(); err != nil {
+		return "", err
+	}
+
+	return c.target(spec, domain)
+}
+
+// target returns the expanded domain-spec of a term.
+func (c *checker) target(spec, domain string) (string, error) {
+	target, err := c.expand(spec, domain)
+	if err != nil {
+		return "", err
+	}
+
+	if target == "" {
+		return "", errors.New("empty domain")
+	}
+
+	return strings.ToLower(strings.TrimSuffix(target, ".")), nil
+}
+
+// expand expands the macros of a domain-spec (RFC 7208, section 7).
+func (c *checker) expand(spec, domain string) (string, error) {
+	b := strings.Builder{}
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 == len(spec) {
+			return "", fmt.Errorf("invalid macro in %q", spec)
+		}
+
+		i++
+
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro in %q", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("invalid macro in %q", spec)
+		}
+
+		value, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", fmt.Errorf("invalid macro in %q: %w", spec, err)
+		}
+
+		b.WriteString(value)
+
+		i += end
+	}
+
+	return b.String(), nil
+}
+
+// macro expands a macro, like "ir" in "%{ir}".
+func (c *checker) macro(macro, domain string) (string, error) {
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+
+	var value string
+
+	switch macro[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = local
+	case 'o', 'O':
+		value = senderDomain
+	case 'd', 'D':
+		value = domain
+	case 'h', 'H':
+		value = c.helo
+	case 'v', 'V':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'i', 'I':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			// dotted nibbles
+			nibbles := make([]string, 0, 32)
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+			}
+
+			value = strings.Join(nibbles, ".")
+		}
+	default:
+		return "", fmt.Errorf("unknown macro letter %q", macro[0])
+	}
+
+	// transformers: keep the rightmost digits parts, reversed with r, split
+	// on the delimiters (dots by default)
+	rest := macro[1:]
+
+	digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+	keep := 0
+
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("invalid transformer in %q", macro)
+		}
+
+		keep = n
+	}
+
+	rest = rest[digits:]
+
+	reverse := false
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		reverse, rest = true, rest[1:]
+	}
+
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid delimiters in %q", macro)
+		}
+
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+// splitCIDR splits the argument of an a or mx mechanism into its domain-spec
+// and IPv4 and IPv6 prefix lengths, like "example.com/24//64".
+func splitCIDR(arg string) (host string, v4, v6 int, err error) {
+	v4, v6 = 32, 128
+
+	host, cidr6, ok := strings.Cut(arg, "//")
+	if ok {
+		if v6, err = strconv.Atoi(cidr6); err != nil || v6 < 0 || v6 > 128 {
+			return "", 0, 0, fmt.Errorf("invalid prefix length %q", cidr6)
+		}
+	}
+
+	host, cidr4, ok := strings.Cut(host, "/")
+	if ok {
+		if v4, err = strconv.Atoi(cidr4); err != nil || v4 < 0 || v4 > 32 {
+			return "", 0, 0, fmt.Errorf("invalid prefix length %q", cidr4)
+		}
+	}
+
+	return host, v4, v6, nil
+}
+
+// cidrContains reports whether ip is in the network of addr with the prefix
+// length of its family.
+func cidrContains(addr, ip net.IP, v4, v6 int) bool {
+	if addr4, ip4 := addr.To4(), ip.To4(); addr4 != nil || ip4 != nil {
+		if addr4 == nil || ip4 == nil {
+			return false
+		}
+
+		mask := net.CIDRMask(v4, 32)
+
+		return addr4.Mask(mask).Equal(ip4.Mask(mask))
+	}
+
+	mask := net.CIDRMask(v6, 128)
+
+	return addr.Mask(mask).Equal(ip.Mask(mask))
+}
+
+// isName reports whether s is a modifier name.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		isLetter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isLetter && (r < '0' || r > '9') && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,208 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver serves records from maps. Names without records are reported
+// as not found, unless listed in temporary.
+type fakeResolver struct {
+	txt       map[string][]string
+	ip        map[string][]string
+	mx        map[string][]string
+	temporary map[string]bool
+}
+
+func (f *fakeResolver) err(name string) error {
+	if f.temporary[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := f.txt[name]; ok {
+		return txt, nil
+	}
+
+	return nil, f.err(name)
+}
+
+func (f *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := f.ip[host]
+	if !ok {
+		return nil, f.err(host)
+	}
+
+	addrs := []net.IPAddr{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addrs, nil
+}
+
+func (f *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := f.mx[name]
+	if !ok {
+		return nil, f.err(name)
+	}
+
+	mxs := []*net.MX{}
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+
+	return mxs, nil
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	loop := map[string][]string{}
+	for i := range 12 {
+		loop[fmt.Sprintf("loop%d.example", i)] = []string{fmt.Sprintf("v=spf1 include:loop%d.example -all", i+1)}
+	}
+
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":       {"some verification token", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:web.example.com/28 mx include:_spf.example.net -all"},
+			"_spf.example.net":  {"v=spf1 ip4:203.0.113.7 ~all"},
+			"soft.example":      {"v=spf1 ~all"},
+			"neutral.example":   {"v=spf1 ?all"},
+			"nomatch.example":   {"v=spf1 ip4:192.0.2.1"},
+			"redirect.example":  {"v=spf1 redirect=example.com"},
+			"dangling.example":  {"v=spf1 redirect=nowhere.example"},
+			"exists.example":    {"v=spf1 exists:%{ir}.%{l1r-}.allow.example -all"},
+			"twice.example":     {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":    {"v=spf1 bogus:x -all"},
+			"badip.example":     {"v=spf1 ip4:2001:db8::1 -all"},
+			"tempinc.example":   {"v=spf1 include:temporary.example -all"},
+			"helo.example":      {"v=spf1 a -all"},
+			"bare-a.example":    {"v=spf1 a/24 -all"},
+			"ptr.example":       {"v=spf1 ptr -all"},
+			"mixed.example":     {"v=spf1 ip4:192.0.2.1 -ip4:192.0.2.0/24 +all"},
+			"other.example.com": {"V=SPF1 +all"},
+		},
+		ip: map[string][]string{
+			"web.example.com":             {"198.51.100.17"},
+			"mx1.example.com.":            {"2001:db9::25"},
+			"1.2.0.192.bob.allow.example": {"127.0.0.2"},
+			"helo.example":                {"192.0.2.99"},
+			"bare-a.example":              {"198.51.100.1"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx1.example.com."},
+		},
+		temporary: map[string]bool{"temporary.example": true, "tempfail.example": true},
+	}
+
+	for name, lookups := range loop {
+		r.txt[name] = lookups
+	}
+
+	r.txt["loop11.example"] = []string{"v=spf1 +all"}
+
+	for _, tc := range []struct {
+		ip     string
+		sender string
+		want   Result
+	}{
+		{"192.0.2.10", "bob@example.com", Pass},
+		{"2001:db8:ffff::1", "bob@example.com", Pass},
+		{"198.51.100.30", "bob@example.com", Pass}, // a:web.example.com/28
+		{"198.51.100.64", "bob@example.com", Fail}, // outside the /28
+		{"2001:db9::25", "bob@example.com", Pass},  // mx
+		{"2001:db9::26", "bob@example.com", Fail},
+		{"203.0.113.7", "bob@example.com", Pass}, // include
+		{"203.0.113.8", "bob@example.com", Fail}, // include's ~all doesn't match
+		{"203.0.113.8", "bob@Example.COM", Fail},
+		{"203.0.113.8", "bob@soft.example", SoftFail},
+		{"203.0.113.8", "bob@neutral.example", Neutral},
+		{"203.0.113.8", "bob@nomatch.example", Neutral},
+		{"192.0.2.10", "bob@redirect.example", Pass},
+		{"203.0.113.8", "bob@redirect.example", Fail},
+		{"203.0.113.8", "bob@dangling.example", PermError},
+		{"192.0.2.1", "bob@exists.example", Pass},
+		{"192.0.2.2", "bob@exists.example", Fail},
+		{"192.0.2.1", "bob@twice.example", PermError},
+		{"192.0.2.1", "bob@broken.example", PermError},
+		{"192.0.2.1", "bob@badip.example", PermError},
+		{"192.0.2.1", "bob@tempinc.example", TempError},
+		{"192.0.2.1", "bob@tempfail.example", TempError},
+		{"192.0.2.1", "bob@unknown.example", None},
+		{"198.51.100.200", "bob@bare-a.example", Pass},
+		{"192.0.2.1", "bob@ptr.example", Fail},
+		{"192.0.2.1", "bob@mixed.example", Pass},
+		{"192.0.2.2", "bob@mixed.example", Fail},
+		{"192.0.2.1", "bob@other.example.com", Pass},
+		{"192.0.2.1", "bob@loop0.example", PermError}, // too many lookups
+		{"192.0.2.1", "bob@loop5.example", Pass},
+	} {
+		result, _, err := Check(t.Context(), r, net.ParseIP(tc.ip), tc.sender, "client.example")
+		assert.Equal(t, tc.want, result, "%s from %s: %v", tc.sender, tc.ip, err)
+
+		if result == Pass {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+
+	// null senders are checked against the HELO name
+	result, domain, err := Check(t.Context(), r, net.ParseIP("192.0.2.99"), "", "helo.example")
+	require.NoError(t, err)
+	assert.Equal(t, Pass, result)
+	assert.Equal(t, "helo.example", domain)
+}
+
+func TestExpand(t *testing.T) {
+	t.Parallel()
+
+	c := &checker{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+
+	// RFC 7208, section 7.4
+	for spec, want := range map[string]string{
+		"%{s}":                          "strong-bad@email.example.com",
+		"%{o}":                          "email.example.com",
+		"%{d}":                          "email.example.com",
+		"%{d4}":                         "email.example.com",
+		"%{d3}":                         "email.example.com",
+		"%{d2}":                         "example.com",
+		"%{d1}":                         "com",
+		"%{dr}":                         "com.example.email",
+		"%{d2r}":                        "example.email",
+		"%{l}":                          "strong-bad",
+		"%{l-}":                         "strong.bad",
+		"%{lr}":                         "strong-bad",
+		"%{lr-}":                        "bad.strong",
+		"%{l1r-}":                       "strong",
+		"%{ir}.%{v}._spf.%{d2}":         "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":          "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp.%{d2}":   "3.2.0.192.in-addr.strong.lp.example.com",
+		"%{d2}.trusted-domains.example": "example.com.trusted-domains.example",
+		"%{h}%%%_%-":                    "mx.example.org% %20",
+	} {
+		got, err := c.expand(spec, "email.example.com")
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, got, spec)
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+
+	got, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", got)
+
+	for _, bad := range []string{"%", "%{", "%{x}", "%{d0}", "%{}", "%a"} {
+		_, err := c.expand(bad, "example.com")
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,382 @@
+// Package spool implements a durable on-disk message queue, with a pool of
+// workers delivering queued messages and retrying temporary failures with
+// exponential backoff.
+package spool
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/grafana/smtprelay/v2/internal/spool")
+
+// Message is a message held in the queue. Its data stays on disk, and is only
+// opened while the message is being delivered. Sender is the envelope sender
+// it's delivered with, and OriginalSender the one it was received with, before
+// any rewriting.
+type Message struct {
+	ID             string            `json:"id"`
+	Sender         string            `json:"sender"`
+	OriginalSender string            `json:"original_sender"`
+	Recipients     []string          `json:"recipients"`
+	TraceContext   map[string]string `json:"trace_context,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	Attempts       int               `json:"attempts"`
+	NextAttempt    time.Time         `json:"next_attempt"`
+	LastError      string            `json:"last_error,omitempty"`
+
+	data *os.File // open while the message is being delivered
+	size int64
+}
+
+// Data returns a reader of the message data, from its start. It can be called
+// several times, and the readers used concurrently, while the message is being
+// delivered, including from Failed; the data is empty otherwise.
+func (m *Message) Data() io.Reader {
+	if m.data == nil {
+		return strings.NewReader("")
+	}
+
+	return io.NewSectionReader(m.data, 0, m.size)
+}
+
+// Size returns the size of the message data, while it's being delivered.
+func (m *Message) Size() int64 {
+	return m.size
+}
+
+// Queue is a durable message queue backed by a directory.
+//
+//nolint:govet
+type Queue struct {
+	Dir        string        // Directory holding the queued messages.
+	Workers    int           // Number of concurrent deliveries. (default: 4)
+	MaxAge     time.Duration // Give up on messages older than this. (default: 24h)
+	MinBackoff time.Duration // Delay before the first retry. (default: 1m)
+	MaxBackoff time.Duration // Maximum delay between retries. (default: 1h)
+
+	// Deliver is called for every delivery attempt. Errors are considered
+	// temporary, unless they are (or wrap) a *textproto.Error with a 5xx code.
+	// When the message was delivered to some recipients only, Deliver can
+	// narrow msg.Recipients down to the others before returning an error, so
+	// they alone are retried.
+	Deliver func(ctx context.Context, msg *Message) error
+
+	// Failed is optionally called when a message is dropped from the queue
+	// without being delivered, either because delivery failed permanently or
+	// because the message became older than MaxAge.
+	Failed func(ctx context.Context, msg *Message, err error)
+
+	store    store
+	mu       sync.Mutex
+	pending  messageHeap
+	inflight int
+	wake     chan struct{}
+}
+
+// Open creates the queue directory if needed, and loads any messages left in
+// it by a previous run.
+func (q *Queue) Open() error {
+	q.configureDefaults()
+
+	q.store = store{dir: q.Dir}
+	if err := q.store.init(); err != nil {
+		return err
+	}
+
+	msgs, err := q.store.list()
+	if err != nil {
+		return fmt.Errorf("load queued messages: %w", err)
+	}
+
+	q.mu.Lock()
+	for _, msg := range msgs {
+		heap.Push(&q.pending, msg)
+	}
+	q.mu.Unlock()
+
+	return nil
+}
+
+func (q *Queue) configureDefaults() {
+	if q.Workers <= 0 {
+		q.Workers = 4
+	}
+
+	if q.MaxAge == 0 {
+		q.MaxAge = 24 * time.Hour
+	}
+
+	if q.MinBackoff == 0 {
+		q.MinBackoff = time.Minute
+	}
+
+	if q.MaxBackoff == 0 {
+		q.MaxBackoff = time.Hour
+	}
+
+	q.wake = make(chan struct{}, 1)
+}
+
+// Len returns the number of messages in the queue, including the ones being
+// delivered.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending) + q.inflight
+}
+
+// Enqueue durably stores the message, with the data read from data, and
+// schedules it for immediate delivery. The data is streamed to disk rather
+// than held in memory. The trace context of ctx is saved with the message, so
+// deliveries can be traced as part of the original request. When Enqueue
+// returns without an error, the message is safely on disk.
+func (q *Queue) Enqueue(ctx context.Context, msg *Message, data io.Reader) error {
+	m := *msg
+
+	if m.ID == "" {
+		m.ID = uuid.NewString()
+	}
+
+	now := time.Now()
+	m.CreatedAt = now
+	m.NextAttempt = now
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	m.TraceContext = carrier
+
+	if err := q.store.save(&m, data); err != nil {
+		return err
+	}
+
+	q.schedule(&m)
+
+	return nil
+}
+
+// Run delivers queued messages until ctx is cancelled. Deliveries in progress
+// are allowed to finish before Run returns.
+func (q *Queue) Run(ctx context.Context) {
+	work := make(chan *Message)
+
+	wg := sync.WaitGroup{}
+	for range q.Workers {
+		wg.Go(func() {
+			for msg := range work {
+				q.attempt(context.WithoutCancel(ctx), msg)
+			}
+		})
+	}
+
+	defer wg.Wait()
+	defer close(work)
+
+	for {
+		msg, wait := q.next()
+		if msg != nil {
+			select {
+			case work <- msg:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next pops the next message due for delivery. If no message is due yet, it
+// returns how long to wait for the next one.
+func (q *Queue) next() (*Message, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil, time.Hour
+	}
+
+	wait := time.Until(q.pending[0].NextAttempt)
+	if wait > 0 {
+		return nil, wait
+	}
+
+	q.inflight++
+
+	return heap.Pop(&q.pending).(*Message), 0
+}
+
+func (q *Queue) schedule(msg *Message) {
+	q.mu.Lock()
+	heap.Push(&q.pending, msg)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) done() {
+	q.mu.Lock()
+	q.inflight--
+	q.mu.Unlock()
+}
+
+func (q *Queue) attempt(ctx context.Context, msg *Message) {
+	defer q.done()
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.TraceContext))
+	ctx, span := tracer.Start(ctx, "spool.deliver",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("spool.message_id", msg.ID),
+			attribute.Int("spool.attempt", msg.Attempts+1),
+		),
+	)
+	defer span.End()
+
+	// rescheduled once its data is closed, so no other worker can open it
+	// in the meantime
+	if q.deliver(ctx, msg) {
+		q.schedule(msg)
+	}
+}
+
+// deliver makes a delivery attempt, with the message data open, and reports
+// whether the message must be retried.
+func (q *Queue) deliver(ctx context.Context, msg *Message) bool {
+	span := trace.SpanFromContext(ctx)
+
+	logger := slog.With(
+		slog.String("component", "spool"),
+		slog.String("uuid", msg.ID),
+		slog.Int("attempt", msg.Attempts+1),
+	)
+
+	if err := q.store.openData(msg); err != nil {
+		logger.ErrorContext(ctx, "dropping unreadable message", slog.Any("error", err))
+		q.drop(ctx, msg, err)
+
+		return false
+	}
+	defer q.store.closeData(msg)
+
+	msg.Attempts++
+
+	err := q.Deliver(ctx, msg)
+	if err == nil {
+		if rerr := q.store.remove(msg.ID); rerr != nil {
+			logger.ErrorContext(ctx, "could not remove delivered message", slog.Any("error", rerr))
+		}
+
+		return false
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	switch {
+	case permanent(err):
+		logger.WarnContext(ctx, "delivery failed permanently", slog.Any("error", err))
+		q.drop(ctx, msg, err)
+
+		return false
+	case time.Since(msg.CreatedAt) >= q.MaxAge:
+		err = fmt.Errorf("giving up after %d attempts: %w", msg.Attempts, err)
+		logger.WarnContext(ctx, "message expired", slog.Any("error", err))
+		q.drop(ctx, msg, err)
+
+		return false
+	}
+
+	msg.LastError = err.Error()
+	msg.NextAttempt = time.Now().Add(q.backoff(msg.Attempts))
+
+	logger.InfoContext(ctx, "delivery failed temporarily, will retry",
+		slog.Any("error", err), slog.Time("next_attempt", msg.NextAttempt))
+
+	if serr := q.store.saveMeta(msg); serr != nil {
+		logger.ErrorContext(ctx, "could not update queued message", slog.Any("error", serr))
+	}
+
+	return true
+}
+
+func (q *Queue) drop(ctx context.Context, msg *Message, err error) {
+	if rerr := q.store.remove(msg.ID); rerr != nil {
+		slog.ErrorContext(ctx, "could not remove failed message",
+			slog.String("component", "spool"),
+			slog.String("uuid", msg.ID),
+			slog.Any("error", rerr),
+		)
+	}
+
+	if q.Failed != nil {
+		q.Failed(ctx, msg, err)
+	}
+}
+
+// backoff returns the delay before the next delivery attempt, doubling after
+// every attempt up to MaxBackoff.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.MinBackoff
+	for i := 1; i < attempts && d < q.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, q.MaxBackoff)
+}
+
+// permanent reports whether err is a permanent (5xx) SMTP error.
+func permanent(err error) bool {
+	var tperr *textproto.Error
+
+	return errors.As(err, &tperr) && tperr.Code >= 500
+}
+
+// messageHeap orders messages by their next delivery attempt.
+type messageHeap []*Message
+
+func (h messageHeap) Len() int           { return len(h) }
+func (h messageHeap) Less(i, j int) bool { return h[i].NextAttempt.Before(h[j].NextAttempt) }
+func (h messageHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *messageHeap) Push(x any) { *h = append(*h, x.(*Message)) }
+
+func (h *messageHeap) Pop() any {
+	old := *h
+	n := len(old)
+	msg := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return msg
+}
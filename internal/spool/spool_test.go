@@ -0,0 +1,311 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a Deliver function which records delivered messages, and fails
+// with the queued errors first.
+type recorder struct {
+	mu        sync.Mutex
+	errs      []error
+	delivered []Message
+	data      []string // of the delivered messages
+	failed    []error
+	dropped   []string // data of the failed messages
+}
+
+func (r *recorder) deliver(_ context.Context, msg *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+
+		return err
+	}
+
+	data, err := io.ReadAll(msg.Data())
+	if err != nil {
+		return err
+	}
+
+	r.delivered = append(r.delivered, *msg)
+	r.data = append(r.data, string(data))
+
+	return nil
+}
+
+func (r *recorder) fail(_ context.Context, msg *Message, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, _ := io.ReadAll(msg.Data())
+
+	r.failed = append(r.failed, err)
+	r.dropped = append(r.dropped, string(data))
+}
+
+func (r *recorder) counts() (delivered, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.delivered), len(r.failed)
+}
+
+func startQueue(t *testing.T, dir string, rec *recorder) *Queue {
+	t.Helper()
+
+	q := &Queue{
+		Dir:        dir,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Deliver:    rec.deliver,
+		Failed:     rec.fail,
+	}
+	require.NoError(t, q.Open())
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return q
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+
+	return files
+}
+
+func TestQueueDelivers(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rec := &recorder{}
+	q := startQueue(t, dir, rec)
+
+	err := q.Enqueue(t.Context(), &Message{
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com"},
+	}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		delivered, _ := rec.counts()
+		return delivered == 1
+	}, time.Second, 5*time.Millisecond)
+
+	msg := rec.delivered[0]
+	assert.Equal(t, "bob@example.com", msg.Sender)
+	assert.Equal(t, []string{"alice@example.com"}, msg.Recipients)
+	assert.Equal(t, "Subject: test\r\n\r\nhello\r\n", rec.data[0])
+	assert.Equal(t, 1, msg.Attempts)
+
+	require.Eventually(t, func() bool {
+		return len(spoolFiles(t, dir)) == 0 && q.Len() == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestQueueRetriesTemporaryFailures(t *testing.T) {
+	t.Parallel()
+
+	rec := &recorder{errs: []error{
+		&textproto.Error{Code: 451, Msg: "try again later"},
+		errors.New("connection refused"),
+	}}
+	q := startQueue(t, t.TempDir(), rec)
+
+	require.NoError(t, q.Enqueue(t.Context(), &Message{}, strings.NewReader("hello")))
+
+	require.Eventually(t, func() bool {
+		delivered, _ := rec.counts()
+		return delivered == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, 3, rec.delivered[0].Attempts)
+	assert.Equal(t, "connection refused", rec.delivered[0].LastError)
+}
+
+func TestQueuePermanentFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	permErr := &textproto.Error{Code: 550, Msg: "no such user"}
+	rec := &recorder{errs: []error{permErr}}
+	q := startQueue(t, dir, rec)
+
+	require.NoError(t, q.Enqueue(t.Context(), &Message{}, strings.NewReader("hello")))
+
+	require.Eventually(t, func() bool {
+		_, failed := rec.counts()
+		return failed == 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.ErrorIs(t, rec.failed[0], permErr)
+	assert.Equal(t, "hello", rec.dropped[0])
+	assert.Empty(t, spoolFiles(t, dir))
+	assert.Empty(t, rec.delivered)
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	t.Parallel()
+
+	rec := &recorder{errs: []error{
+		&textproto.Error{Code: 421, Msg: "busy"},
+		&textproto.Error{Code: 421, Msg: "busy"},
+	}}
+
+	q := &Queue{
+		Dir:     t.TempDir(),
+		MaxAge:  time.Nanosecond,
+		Deliver: rec.deliver,
+		Failed:  rec.fail,
+	}
+	require.NoError(t, q.Open())
+	require.NoError(t, q.Enqueue(t.Context(), &Message{}, strings.NewReader("hello")))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	go q.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		_, failed := rec.counts()
+		return failed == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.ErrorContains(t, rec.failed[0], "giving up after 1 attempts")
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// enqueue without running any workers
+	q := &Queue{Dir: dir}
+	require.NoError(t, q.Open())
+
+	err := q.Enqueue(t.Context(), &Message{
+		ID:             "msg-1",
+		Sender:         "bob@example.com",
+		OriginalSender: "dave@example.com",
+		Recipients:     []string{"alice@example.com", "carol@example.com"},
+	}, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Len(t, spoolFiles(t, dir), 2)
+
+	// leftovers from an interrupted write must be ignored and cleaned up
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "orphan.eml"), []byte("x"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("x"), 0o600))
+
+	rec := &recorder{}
+	q2 := startQueue(t, dir, rec)
+
+	require.Eventually(t, func() bool {
+		delivered, _ := rec.counts()
+		return delivered == 1
+	}, time.Second, 5*time.Millisecond)
+
+	msg := rec.delivered[0]
+	assert.Equal(t, "msg-1", msg.ID)
+	assert.Equal(t, "dave@example.com", msg.OriginalSender)
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, msg.Recipients)
+	assert.Equal(t, "hello", rec.data[0])
+
+	require.Eventually(t, func() bool {
+		return len(spoolFiles(t, dir)) == 0 && q2.Len() == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestQueueBackoff(t *testing.T) {
+	t.Parallel()
+
+	q := &Queue{MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute}
+
+	assert.Equal(t, time.Minute, q.backoff(1))
+	assert.Equal(t, 2*time.Minute, q.backoff(2))
+	assert.Equal(t, 8*time.Minute, q.backoff(4))
+	assert.Equal(t, 10*time.Minute, q.backoff(5))
+	assert.Equal(t, 10*time.Minute, q.backoff(100))
+}
+
+func TestQueueNarrowedRecipients(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	mu := sync.Mutex{}
+	attempts := [][]string{}
+
+	q := &Queue{
+		Dir:        dir,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Deliver: func(_ context.Context, msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			attempts = append(attempts, msg.Recipients)
+
+			if len(attempts) == 1 {
+				// delivered to alice, bob should be retried
+				msg.Recipients = []string{"bob@example.com"}
+
+				return errors.New("bob's server is down")
+			}
+
+			return nil
+		},
+	}
+	require.NoError(t, q.Open())
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	go q.Run(ctx)
+
+	err := q.Enqueue(ctx, &Message{
+		Sender:     "dave@example.com",
+		Recipients: []string{"alice@example.com", "bob@example.com"},
+	}, strings.NewReader("hello\r\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return q.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, [][]string{
+		{"alice@example.com", "bob@example.com"},
+		{"bob@example.com"},
+	}, attempts)
+}
@@ -0,0 +1,203 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dataExt = ".eml"
+	metaExt = ".json"
+	tmpPfx  = ".tmp-"
+)
+
+// store persists messages in a directory. Each message is made of two files:
+// the raw message data (<id>.eml) and its metadata (<id>.json). The metadata
+// file is always written last, so its presence marks a committed message.
+type store struct {
+	dir string
+}
+
+func (s *store) init() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("create spool directory: %w", err)
+	}
+
+	// remove leftovers from interrupted writes
+	tmps, err := filepath.Glob(filepath.Join(s.dir, tmpPfx+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, tmp := range tmps {
+		_ = os.Remove(tmp)
+	}
+
+	return nil
+}
+
+func (s *store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// save writes the message data, read from data, and metadata to disk.
+func (s *store) save(msg *Message, data io.Reader) error {
+	if err := s.writeFile(s.path(msg.ID, dataExt), data); err != nil {
+		return fmt.Errorf("write message data: %w", err)
+	}
+
+	return s.saveMeta(msg)
+}
+
+// saveMeta writes (or overwrites) the message metadata.
+func (s *store) saveMeta(msg *Message) error {
+	meta, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encode message metadata: %w", err)
+	}
+
+	if err := s.writeFile(s.path(msg.ID, metaExt), bytes.NewReader(meta)); err != nil {
+		return fmt.Errorf("write message metadata: %w", err)
+	}
+
+	return nil
+}
+
+// openData opens the message data, to be read with msg.Data until closeData
+// is called.
+func (s *store) openData(msg *Message) error {
+	f, err := os.Open(s.path(msg.ID, dataExt))
+	if err != nil {
+		return fmt.Errorf("open message data: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("open message data: %w", err)
+	}
+
+	msg.data = f
+	msg.size = info.Size()
+
+	return nil
+}
+
+// closeData closes the message data opened by openData.
+func (s *store) closeData(msg *Message) {
+	if msg.data != nil {
+		_ = msg.data.Close()
+	}
+
+	msg.data = nil
+	msg.size = 0
+}
+
+// remove deletes the message from disk. The metadata is removed first, so an
+// interrupted removal leaves only an orphaned data file behind.
+func (s *store) remove(id string) error {
+	err := os.Remove(s.path(id, metaExt))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(s.path(id, dataExt))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// list loads the metadata of all committed messages. Message data is not
+// loaded. Data files without metadata are removed.
+func (s *store) list() ([]*Message, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := map[string]bool{}
+	msgs := []*Message{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, metaExt) || strings.HasPrefix(name, tmpPfx) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &Message{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			return nil, fmt.Errorf("decode %q: %w", name, err)
+		}
+
+		committed[msg.ID] = true
+		msgs = append(msgs, msg)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, dataExt) || strings.HasPrefix(name, tmpPfx) {
+			continue
+		}
+
+		if !committed[strings.TrimSuffix(name, dataExt)] {
+			_ = os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+
+	return msgs, nil
+}
+
+// writeFile atomically writes the data read from r to path, by writing to a
+// temporary file first, syncing it, and renaming it into place.
+func (s *store) writeFile(path string, r io.Reader) error {
+	f, err := os.CreateTemp(s.dir, tmpPfx+"*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return s.syncDir()
+}
+
+func (s *store) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
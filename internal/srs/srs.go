@@ -0,0 +1,209 @@
+// Package srs implements the Sender Rewriting Scheme, which rewrites the
+// envelope senders of forwarded messages into addresses of the forwarding
+// domain, so they pass SPF checks, while bounces can still be routed back to
+// the original senders.
+//
+// Addresses are compatible with libsrs2 and postsrsd: SRS0 addresses wrap an
+// original sender, and SRS1 addresses wrap an SRS0 address of another
+// forwarder, so addresses don't grow when forwarded several times:
+//
+//	SRS0=HHHH=TT=example.com=bob@forwarder.example
+//	SRS1=HHHH=forwarder.example==HHHH=TT=example.com=bob@other.example
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // as used by other SRS implementations
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	hashLength = 4
+
+	// timestamps are days, modulo 1024, encoded in two base32 characters
+	timestampChars     = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timestampPrecision = 24 * time.Hour
+	timestampSlots     = 1024
+)
+
+// Rewriter rewrites addresses into SRS addresses of a domain, and back.
+type Rewriter struct {
+	// Domain is the domain of the SRS addresses.
+	Domain string
+	// Secrets are the keys authenticating SRS addresses. Addresses are
+	// created with the first one, and accepted with any of them, so the key
+	// can be rotated.
+	Secrets []string
+	// MaxAge is how long SRS addresses are accepted for.
+	MaxAge time.Duration
+}
+
+// IsSRS reports whether the address is an SRS address.
+func IsSRS(addr string) bool {
+	local, _, _ := strings.Cut(addr, "@")
+
+	return hasPrefixFold(local, "SRS0=") || hasPrefixFold(local, "SRS1=")
+}
+
+// Forward rewrites a sender address into an SRS address of the domain.
+func (r *Rewriter) Forward(addr string, now time.Time) (string, error) {
+	local, domain, ok := cutAddress(addr)
+	if !ok {
+		return "", fmt.Errorf("invalid address %q", addr)
+	}
+
+	if strings.EqualFold(domain, r.Domain) {
+		return addr, nil
+	}
+
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		// wrap the address of the previous forwarder
+		rest := local[len("SRS0"):]
+
+		return fmt.Sprintf("SRS1=%s=%s=%s@%s", r.hash(r.Secrets[0], domain, rest), domain, rest, r.Domain), nil
+	case hasPrefixFold(local, "SRS1="):
+		// keep the address of the first forwarder
+		_, forwarder, rest, err := splitSRS1(local)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("SRS1=%s=%s=%s@%s", r.hash(r.Secrets[0], forwarder, rest), forwarder, rest, r.Domain), nil
+	default:
+		ts := timestamp(now)
+
+		return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", r.hash(r.Secrets[0], ts, domain, local), ts, domain, local, r.Domain), nil
+	}
+}
+
+// Reverse decodes an SRS address of the domain into the address it wraps,
+// checking it is authentic and not expired.
+func (r *Rewriter) Reverse(addr string, now time.Time) (string, error) {
+	local, domain, ok := cutAddress(addr)
+	if !ok || !strings.EqualFold(domain, r.Domain) {
+		return "", fmt.Errorf("not an SRS address of %s", r.Domain)
+	}
+
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		parts := strings.SplitN(local[len("SRS0="):], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", errors.New("malformed SRS0 address")
+		}
+
+		hash, ts, origDomain, origLocal := parts[0], parts[1], parts[2], parts[3]
+
+		if !r.verify(hash, ts, origDomain, origLocal) {
+			return "", errors.New("invalid SRS hash")
+		}
+
+		if err := r.checkTimestamp(ts, now); err != nil {
+			return "", err
+		}
+
+		return origLocal + "@" + origDomain, nil
+	case hasPrefixFold(local, "SRS1="):
+		hash, forwarder, rest, err := splitSRS1(local)
+		if err != nil {
+			return "", err
+		}
+
+		if !r.verify(hash, forwarder, rest) {
+			return "", errors.New("invalid SRS hash")
+		}
+
+		return "SRS0" + rest + "@" + forwarder, nil
+	default:
+		return "", errors.New("not an SRS address")
+	}
+}
+
+// splitSRS1 splits the local part of an SRS1 address into its hash, the
+// domain of the first forwarder, and the rest of its SRS0 address, starting
+// with a separator.
+func splitSRS1(local string) (hash, forwarder, rest string, err error) {
+	hash, tail, ok := strings.Cut(local[len("SRS1="):], "=")
+	if !ok {
+		return "", "", "", errors.New("malformed SRS1 address")
+	}
+
+	forwarder, rest, ok = strings.Cut(tail, "==")
+	if !ok || forwarder == "" || rest == "" {
+		return "", "", "", errors.New("malformed SRS1 address")
+	}
+
+	return hash, forwarder, "=" + rest, nil
+}
+
+// hash authenticates the parts of an address, like libsrs2: a truncated
+// HMAC-SHA1 of the lowercased parts.
+func (r *Rewriter) hash(secret string, parts ...string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	for _, part := range parts {
+		mac.Write([]byte(strings.ToLower(part)))
+	}
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// verify checks the hash of the parts of an address with each secret.
+func (r *Rewriter) verify(hash string, parts ...string) bool {
+	for _, secret := range r.Secrets {
+		if strings.EqualFold(hash, r.hash(secret, parts...)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rewriter) checkTimestamp(ts string, now time.Time) error {
+	if len(ts) != 2 {
+		return errors.New("malformed SRS timestamp")
+	}
+
+	then := 0
+
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(timestampChars, c)
+		if i < 0 {
+			return errors.New("malformed SRS timestamp")
+		}
+
+		then = then<<5 | i
+	}
+
+	today := int(now.Unix()/int64(timestampPrecision/time.Second)) % timestampSlots
+	age := (today - then + timestampSlots) % timestampSlots
+
+	if time.Duration(age)*timestampPrecision > r.MaxAge {
+		return errors.New("expired SRS address")
+	}
+
+	return nil
+}
+
+func timestamp(now time.Time) string {
+	t := now.Unix() / int64(timestampPrecision/time.Second) % timestampSlots
+
+	return string([]byte{timestampChars[t>>5&31], timestampChars[t&31]})
+}
+
+// cutAddress splits an address on its last @.
+func cutAddress(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+
+	return addr[:i], addr[i+1:], true
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
@@ -0,0 +1,103 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardReverse(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	r := &Rewriter{Domain: "forwarder.example", Secrets: []string{"secret"}, MaxAge: 21 * 24 * time.Hour}
+
+	srs0, err := r.Forward("bob@example.com", now)
+	require.NoError(t, err)
+	assert.Regexp(t, `^SRS0=[A-Za-z0-9+/]{4}=[A-Z2-7]{2}=example\.com=bob@forwarder\.example$`, srs0)
+	assert.True(t, IsSRS(srs0))
+
+	orig, err := r.Reverse(srs0, now.Add(20*24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", orig)
+
+	// case changes don't matter
+	orig, err = r.Reverse(strings.ToLower(srs0), now)
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", orig)
+
+	_, err = r.Reverse(srs0, now.Add(22*24*time.Hour))
+	require.ErrorContains(t, err, "expired")
+
+	// addresses of the domain aren't rewritten
+	addr, err := r.Forward("alice@Forwarder.example", now)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@Forwarder.example", addr)
+
+	// SRS0 addresses of other forwarders are wrapped in SRS1 addresses
+	other := &Rewriter{Domain: "other.example", Secrets: []string{"other secret"}, MaxAge: r.MaxAge}
+
+	srs1, err := other.Forward(srs0, now)
+	require.NoError(t, err)
+	assert.Equal(t, "SRS1="+other.hash("other secret", "forwarder.example", srs0[4:strings.Index(srs0, "@")])+
+		"=forwarder.example=="+srs0[len("SRS0="):strings.Index(srs0, "@")]+"@other.example", srs1)
+
+	// and SRS1 addresses keep the first forwarder
+	third := &Rewriter{Domain: "third.example", Secrets: []string{"third secret"}, MaxAge: r.MaxAge}
+
+	srs1b, err := third.Forward(srs1, now)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(srs1b, "SRS1="))
+	assert.True(t, strings.HasSuffix(srs1b, "=forwarder.example=="+srs0[len("SRS0="):strings.Index(srs0, "@")]+"@third.example"))
+
+	back, err := third.Reverse(srs1b, now)
+	require.NoError(t, err)
+	assert.Equal(t, srs0, back)
+
+	back, err = other.Reverse(srs1, now)
+	require.NoError(t, err)
+	assert.Equal(t, srs0, back)
+
+	// forged and foreign addresses are refused
+	for _, bad := range []string{
+		"SRS0=AAAA=" + srs0[len("SRS0=xxxx="):],
+		"SRS0=xxxx@forwarder.example",
+		"SRS1=AAAA=forwarder.example==abc@forwarder.example",
+		"SRS1=AAAA=forwarder.example@forwarder.example",
+		srs0[:strings.Index(srs0, "@")] + "@other.example",
+		"bob@forwarder.example",
+	} {
+		_, err := r.Reverse(bad, now)
+		require.Error(t, err, bad)
+	}
+
+	// addresses made with a previous secret are still accepted
+	rotated := &Rewriter{Domain: r.Domain, Secrets: []string{"new secret", "secret"}, MaxAge: r.MaxAge}
+
+	orig, err = rotated.Reverse(srs0, now)
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", orig)
+
+	_, err = r.Forward("not an address", now)
+	require.Error(t, err)
+}
+
+func TestTimestamp(t *testing.T) {
+	t.Parallel()
+
+	r := &Rewriter{MaxAge: 3 * 24 * time.Hour}
+
+	// timestamps wrap around after 1024 days
+	day := 1023 * 24 * time.Hour
+	then := time.Unix(0, 0).Add(day)
+
+	ts := timestamp(then)
+	assert.Equal(t, "77", ts)
+
+	require.NoError(t, r.checkTimestamp(ts, then.Add(2*24*time.Hour)))
+	require.Error(t, r.checkTimestamp(ts, then.Add(4*24*time.Hour)))
+	require.Error(t, r.checkTimestamp("!!", then))
+}
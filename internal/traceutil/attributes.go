@@ -6,9 +6,14 @@ import (
 
 const (
 	senderKey     = attribute.Key("smtp.sender")
+	rewrittenKey  = attribute.Key("smtp.sender.rewritten")
 	recipientsKey = attribute.Key("smtp.recipients")
+	redirectedKey = attribute.Key("smtp.recipients.redirected")
 	datasizeKey   = attribute.Key("smtp.data.size")
 	statusCodeKey = attribute.Key("smtp.response.status_code")
+	authSPFKey    = attribute.Key("smtp.auth.spf")
+	authDKIMKey   = attribute.Key("smtp.auth.dkim")
+	authDMARCKey  = attribute.Key("smtp.auth.dmarc")
 )
 
 // The sender address (from the 'MAIL FROM' SMTP command).
@@ -20,6 +25,15 @@ func Sender(name string) attribute.KeyValue {
 	return senderKey.String(name)
 }
 
+// The envelope sender the message is relayed with, when rewritten.
+//
+// Type: string
+// Required: No
+// Examples: "SRS0=HHHH=TT=example.com=bob@relay.example.org"
+func RewrittenSender(name string) attribute.KeyValue {
+	return rewrittenKey.String(name)
+}
+
 // The recipient addresses (from the 'RCPT TO' SMTP command).
 //
 // Type: []string
@@ -29,6 +43,15 @@ func Recipients(names []string) attribute.KeyValue {
 	return recipientsKey.StringSlice(names)
 }
 
+// The recipient addresses the message is relayed to, when redirected.
+//
+// Type: []string
+// Required: No
+// Examples: ["staging@example.com"]
+func RedirectedRecipients(names []string) attribute.KeyValue {
+	return redirectedKey.StringSlice(names)
+}
+
 // The size of the message data (from the 'DATA' SMTP command).
 //
 // Type: int64
@@ -46,3 +69,30 @@ func DataSize(size int64) attribute.KeyValue {
 func StatusCode(code int) attribute.KeyValue {
 	return statusCodeKey.Int(code)
 }
+
+// The SPF result of an inbound message.
+//
+// Type: string
+// Required: No
+// Examples: "pass", "softfail"
+func AuthSPF(result string) attribute.KeyValue {
+	return authSPFKey.String(result)
+}
+
+// The DKIM results of an inbound message, one per signature.
+//
+// Type: []string
+// Required: No
+// Examples: ["pass"], ["fail", "pass"]
+func AuthDKIM(results []string) attribute.KeyValue {
+	return authDKIMKey.StringSlice(results)
+}
+
+// The DMARC result of an inbound message.
+//
+// Type: string
+// Required: No
+// Examples: "pass", "fail"
+func AuthDMARC(result string) attribute.KeyValue {
+	return authDMARCKey.String(result)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/smtprelay/v2/internal/spool"
+)
+
+var errJournalFailed = &textproto.Error{Code: 451, Msg: "4.3.0 Could not archive message, try again later"}
+
+// validateJournal checks the journaling settings.
+func validateJournal(cfg *config) error {
+	if cfg.journalTo == "" {
+		if cfg.journalHost != "" || cfg.journalInclude != "" || cfg.journalRequired {
+			return errors.New("journal_to must be set to journal messages")
+		}
+
+		return nil
+	}
+
+	if _, err := parseJournalInclude(cfg.journalInclude); err != nil {
+		return err
+	}
+
+	if cfg.journalHost != "" {
+		if err := validateUpstreams(splitstr(cfg.journalHost, ' '), cfg); err != nil {
+			return fmt.Errorf("journal_host: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseJournalInclude parses the journal_include patterns.
+func parseJournalInclude(s string) ([]addrPattern, error) {
+	patterns := []addrPattern{}
+
+	for _, pattern := range splitstr(s, ' ') {
+		p, err := parseAddrPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("journal_include: %w", err)
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// journaled reports whether a message must be journaled: all messages are,
+// unless journal_include is set, then only those whose sender or a recipient
+// matches one of its patterns.
+func (r *relay) journaled(sender string, recipients []string) bool {
+	if r.cfg.journalTo == "" {
+		return false
+	}
+
+	// don't journal journal reports
+	if slices.Equal(recipients, []string{r.cfg.journalTo}) {
+		return false
+	}
+
+	if len(r.journalInclude) == 0 {
+		return true
+	}
+
+	for _, p := range r.journalInclude {
+		if p.matches(sender) || slices.ContainsFunc(recipients, p.matches) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// journal sends a journal report of a delivered message to journal_to,
+// through journal_host if set, otherwise like other messages. When spooling,
+// the report is spooled. Failures are logged and counted.
+func (r *relay) journal(ctx context.Context, id, sender string, recipients []string, data *message) error {
+	if !r.journaled(sender, recipients) {
+		return nil
+	}
+
+	logger := slog.With(
+		slog.String("component", "journal"),
+		slog.String("uuid", id),
+		slog.String("to", r.cfg.journalTo),
+	)
+
+	report, err := newJournalReport(r.cfg.hostName, r.cfg.journalTo, id, sender, recipients, data, time.Now())
+	if err == nil {
+		to := []string{r.cfg.journalTo}
+
+		// reports are sent with a null sender, so failures don't bounce
+		switch {
+		case r.journalDest != nil:
+			err = r.journalDest.send(ctx, "", to, report)
+		case r.queue != nil:
+			err = r.queue.Enqueue(ctx, &spool.Message{Recipients: to}, report.reader())
+		default:
+			err = r.send(ctx, "", to, report)
+		}
+	}
+
+	if err != nil {
+		journalReports.WithLabelValues("error").Inc()
+		logger.ErrorContext(ctx, "could not journal message", slog.Any("error", err))
+
+		return err
+	}
+
+	journalReports.WithLabelValues("success").Inc()
+	logger.DebugContext(ctx, "message journaled")
+
+	return nil
+}
+
+// newJournalReport wraps a message in a journal report, with its envelope: a
+// multipart message, whose first part lists the envelope sender and
+// recipients, and whose second part is the message itself. The report streams
+// the message, rather than copying it.
+func newJournalReport(hostName, to, id, sender string, recipients []string, data *message, now time.Time) (*message, error) {
+	orig, _ := textproto.NewReader(bufio.NewReader(data.reader())).ReadMIMEHeader()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	header := &bytes.Buffer{}
+	fmt.Fprintf(header, "From: Mail Journal <MAILER-DAEMON@%s>\r\n", hostName)
+	fmt.Fprintf(header, "To: <%s>\r\n", to)
+	fmt.Fprintf(header, "Subject: %s\r\n", oneLine(orig.Get("Subject")))
+	fmt.Fprintf(header, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(header, "Message-ID: <%s@%s>\r\n", uuid.NewString(), hostName)
+	fmt.Fprintf(header, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(header, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(header, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", w.Boundary())
+
+	envelope, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(envelope, "Sender: %s\r\n", sender)
+	fmt.Fprintf(envelope, "Subject: %s\r\n", oneLine(orig.Get("Subject")))
+	fmt.Fprintf(envelope, "Message-Id: %s\r\n", oneLine(orig.Get("Message-Id")))
+	fmt.Fprintf(envelope, "Relay-Id: %s\r\n", id)
+
+	for _, rcpt := range recipients {
+		fmt.Fprintf(envelope, "To: %s\r\n", rcpt)
+	}
+
+	if _, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"attachment"},
+	}); err != nil {
+		return nil, err
+	}
+
+	prefix := append(header.Bytes(), body.Bytes()...)
+
+	// the closing boundary follows the message
+	body.Reset()
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	suffix := bytes.Clone(body.Bytes())
+
+	return &message{
+		open: func() io.Reader {
+			return io.MultiReader(bytes.NewReader(prefix), data.reader(), bytes.NewReader(suffix))
+		},
+		size: int64(len(prefix)) + data.size + int64(len(suffix)),
+	}, nil
+}
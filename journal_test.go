@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewJournalReport(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("From: bob@example.com\nSubject: quarterly\n results\nMessage-Id: <1@example.com>\n\nconfidential\n")
+
+	report, err := newJournalReport("relay.example.com", "archive@example.com", "1234", "bob@example.com",
+		[]string{"alice@example.net", "carol@example.org"}, newMessage(data), time.Now())
+	require.NoError(t, err)
+
+	reportData, err := report.bytes()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(reportData)), report.size)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(reportData))
+	require.NoError(t, err)
+
+	assert.Equal(t, "<archive@example.com>", msg.Header.Get("To"))
+	assert.Equal(t, "quarterly results", msg.Header.Get("Subject"))
+	assert.Equal(t, "auto-generated", msg.Header.Get("Auto-Submitted"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	parts := []string{}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(p)
+		require.NoError(t, err)
+
+		parts = append(parts, p.Header.Get("Content-Type")+"\n"+string(content))
+	}
+
+	require.Len(t, parts, 2)
+	assert.Equal(t, "text/plain; charset=utf-8\n"+
+		"Sender: bob@example.com\r\n"+
+		"Subject: quarterly results\r\n"+
+		"Message-Id: <1@example.com>\r\n"+
+		"Relay-Id: 1234\r\n"+
+		"To: alice@example.net\r\n"+
+		"To: carol@example.org\r\n", parts[0])
+	assert.Equal(t, "message/rfc822\n"+string(data), parts[1])
+}
+
+func TestJournaled(t *testing.T) {
+	t.Parallel()
+
+	r := &relay{cfg: &config{}}
+	assert.False(t, r.journaled("bob@example.com", []string{"alice@example.com"}))
+
+	r.cfg.journalTo = "archive@example.com"
+	assert.True(t, r.journaled("bob@example.com", []string{"alice@example.com"}))
+	assert.False(t, r.journaled("", []string{"archive@example.com"}))
+
+	r.journalInclude, _ = parseJournalInclude("finance.example .legal.example")
+	assert.True(t, r.journaled("bob@finance.example", []string{"alice@example.com"}))
+	assert.True(t, r.journaled("bob@example.com", []string{"alice@example.com", "carol@eu.legal.example"}))
+	assert.False(t, r.journaled("bob@example.com", []string{"alice@example.com"}))
+}
+
+func TestValidateJournal(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateJournal(&config{}))
+	require.NoError(t, validateJournal(&config{journalTo: "archive@example.com", journalHost: "eml:///var/archive", journalInclude: "example.com"}))
+	require.Error(t, validateJournal(&config{journalRequired: true}))
+	require.Error(t, validateJournal(&config{journalTo: "archive@example.com", journalInclude: "/(/"}))
+	require.Error(t, validateJournal(&config{journalTo: "archive@example.com", journalHost: "eml://relative"}))
+}
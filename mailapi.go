@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+)
+
+// Hosts of the mail APIs, unless overridden in the graph:// or gmail:// spec
+// (for national clouds, or tests).
+const (
+	graphHost = "graph.microsoft.com"
+	gmailHost = "gmail.googleapis.com"
+)
+
+// isMailAPI reports whether the upstream spec requests delivery through the
+// Microsoft Graph or Gmail API.
+func isMailAPI(spec string) bool {
+	return strings.HasPrefix(spec, "graph://") || strings.HasPrefix(spec, "gmail://")
+}
+
+// parseMailAPI parses a graph:// or gmail:// spec, optionally with another
+// API host, and checks the OAuth2 settings the APIs are used with. It returns
+// the base URL of the API.
+func parseMailAPI(spec string, cfg *config) (*url.URL, error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.User != nil || parsed.RawQuery != "" || (parsed.Path != "" && parsed.Path != "/") {
+		return nil, fmt.Errorf("%s:// only accepts an API host, like %s://%s", parsed.Scheme, parsed.Scheme, graphHost)
+	}
+
+	if !isOAuth2(cfg.remoteAuth) {
+		return nil, fmt.Errorf("%s:// requires remote_auth xoauth2 or xoauth2_client_credentials", parsed.Scheme)
+	}
+
+	if cfg.remoteUser == "" {
+		return nil, fmt.Errorf("%s:// requires remote_user to be set to the mailbox address", parsed.Scheme)
+	}
+
+	base := &url.URL{Scheme: "https", Host: parsed.Host}
+
+	if base.Host == "" {
+		base.Host = graphHost
+		if parsed.Scheme == "gmail" {
+			base.Host = gmailHost
+		}
+	}
+
+	return base, nil
+}
+
+// newMailAPIDestination returns a destination submitting messages through
+// the Microsoft Graph sendMail endpoint, or the Gmail users.messages.send
+// endpoint, as the remote_user mailbox. Requests are authorized with the
+// tokens of the remote_auth OAuth2 method.
+func newMailAPIDestination(ctx context.Context, spec string, cfg *config, tokenSources map[string]oauth2.TokenSource) (*httpDestination, error) {
+	base, err := parseMailAPI(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &httpDestination{
+		client:    newHTTPClient(cfg),
+		authorize: oauth2Auth(ctx, cfg, tokenSources),
+	}
+
+	mailbox := url.PathEscape(cfg.remoteUser)
+
+	if strings.HasPrefix(spec, "gmail://") {
+		d.url = base.JoinPath("upload/gmail/v1/users", mailbox, "messages/send")
+		d.url.RawQuery = "uploadType=media"
+		d.request = gmailRequest
+	} else {
+		d.url = base.JoinPath("v1.0/users", mailbox, "sendMail")
+		d.request = graphRequest
+	}
+
+	return d, nil
+}
+
+// graphRequest submits the message as base64-encoded MIME, as expected by
+// Graph.
+func graphRequest(ctx context.Context, target, _ string, recipients []string, msg *message) (*http.Request, error) {
+	data, err := msg.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = addMissingBcc(data, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(body, data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+
+	return req, nil
+}
+
+// gmailRequest uploads the message as is.
+func gmailRequest(ctx context.Context, target, _ string, recipients []string, msg *message) (*http.Request, error) {
+	data, err := msg.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = addMissingBcc(data, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "message/rfc822")
+
+	return req, nil
+}
+
+// addMissingBcc adds a Bcc header listing the recipients missing from the
+// To, Cc and Bcc headers. Mail APIs deliver messages to the recipients in
+// their headers rather than to an envelope, and remove Bcc headers.
+func addMissingBcc(data []byte, recipients []string) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	listed := map[string]bool{}
+
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		addrs, err := msg.Header.AddressList(key)
+		if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+			return nil, fmt.Errorf("invalid %s header: %w", key, err)
+		}
+
+		for _, addr := range addrs {
+			listed[strings.ToLower(addr.Address)] = true
+		}
+	}
+
+	missing := []string{}
+
+	for _, rcpt := range recipients {
+		if !listed[strings.ToLower(rcpt)] {
+			missing = append(missing, rcpt)
+		}
+	}
+
+	if len(missing) == 0 {
+		return data, nil
+	}
+
+	header := "Bcc: " + strings.Join(missing, ", ") + smtpd.LineEnding(data)
+
+	return append([]byte(header), data...), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// startTestTokenServer starts an OAuth2 token endpoint issuing the token for
+// the client credentials grant, and counts the tokens issued.
+func startTestTokenServer(t *testing.T, token string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	issued := &atomic.Int32{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+
+		issued.Add(1)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600}`, token)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, issued
+}
+
+func TestMailAPIDestinations(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		scheme      string
+		path        string
+		contentType string
+		decode      func([]byte) []byte
+	}{
+		{
+			scheme:      "graph",
+			path:        "/v1.0/users/sender@example.com/sendMail",
+			contentType: "text/plain",
+			decode: func(body []byte) []byte {
+				data, err := base64.StdEncoding.DecodeString(string(body))
+				assert.NoError(t, err)
+
+				return data
+			},
+		},
+		{
+			scheme:      "gmail",
+			path:        "/upload/gmail/v1/users/sender@example.com/messages/send?uploadType=media",
+			contentType: "message/rfc822",
+			decode:      func(body []byte) []byte { return body },
+		},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := t.Context()
+
+			tokenSrv, issued := startTestTokenServer(t, "access-"+tc.scheme)
+			api, cfg, reqs := startTestHTTPAPI(t, http.StatusAccepted, "")
+
+			cfg.remoteAuth = "xoauth2_client_credentials"
+			cfg.remoteUser = "sender@example.com"
+			cfg.xoauth2ClientID = "client"
+			cfg.xoauth2ClientSecret = "secret"
+			cfg.xoauth2TokenURL = tokenSrv.URL
+
+			spec := tc.scheme + "://" + api.Listener.Addr().String()
+			require.NoError(t, validateUpstreams([]string{spec}, cfg))
+
+			// the token source is shared with the relay
+			tokenSources := map[string]oauth2.TokenSource{cfg.remoteAuth: newOAuth2TokenSource(ctx, cfg, cfg.remoteAuth)}
+
+			dest, err := newDestination(ctx, cfg, []string{spec}, tokenSources)
+			require.NoError(t, err)
+			assert.Equal(t, "https://"+api.Listener.Addr().String()+tc.path, dest.String())
+
+			data := "From: sender@example.com\r\nTo: Alice <alice@example.com>\r\nSubject: test\r\n\r\nhello\r\n"
+
+			for range 2 {
+				err = dest.send(ctx, "sender@example.com", []string{"alice@example.com", "bob@example.com"}, newMessage([]byte(data)))
+				require.NoError(t, err)
+
+				req := <-reqs
+				assert.Equal(t, "Bearer access-"+tc.scheme, req.header.Get("Authorization"))
+				assert.Equal(t, tc.contentType, req.header.Get("Content-Type"))
+
+				// recipients missing from the headers are added as Bcc
+				assert.Equal(t, "Bcc: bob@example.com\r\n"+data, string(tc.decode(req.body)))
+			}
+
+			// the token is reused
+			assert.Equal(t, int32(1), issued.Load())
+		})
+	}
+}
+
+func TestParseMailAPI(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{remoteAuth: "xoauth2", remoteUser: "sender@example.com"}
+
+	base, err := parseMailAPI("graph://", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "https://graph.microsoft.com", base.String())
+
+	base, err = parseMailAPI("graph://graph.microsoft.us", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "https://graph.microsoft.us", base.String())
+
+	base, err = parseMailAPI("gmail://", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "https://gmail.googleapis.com", base.String())
+
+	for spec, cfg := range map[string]*config{
+		"graph://user@graph.microsoft.com": cfg,
+		"gmail:///v1":                      cfg,
+		"graph://":                         {remoteAuth: "plain", remoteUser: "sender@example.com"},
+		"gmail://":                         {remoteAuth: "xoauth2"},
+	} {
+		_, err := parseMailAPI(spec, cfg)
+		require.Error(t, err, spec)
+	}
+
+	require.Error(t, validateUpstreams([]string{"graph://", "smtp.example.com:25"}, cfg))
+}
+
+func TestAddMissingBcc(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("To: alice@example.com\nCc: \"Bob\" <BOB@example.com>\nBcc: carol@example.com\n\nhello\n")
+
+	got, err := addMissingBcc(data, []string{"alice@example.com", "bob@example.com", "carol@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	got, err = addMissingBcc(data, []string{"alice@example.com", "dave@example.com", "erin@example.com"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(got), "Bcc: dave@example.com, erin@example.com\nTo:"), string(got))
+
+	_, err = addMissingBcc([]byte("To: <broken\n\nhello\n"), []string{"alice@example.com"})
+	require.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"syscall"
 
 	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/spool"
 	"github.com/grafana/smtprelay/v2/internal/traceutil"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
@@ -51,7 +52,7 @@ func run(ctx context.Context, cfg *config) error {
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	defer stop()
 
-	metricsSrv, err := handleMetrics(ctx, cfg.metricsListen, metricsRegistry)
+	metricsSrv, err := handleMetrics(ctx, cfg.metricsListen, metricsRegistry, cfg.catcher)
 	if err != nil {
 		return fmt.Errorf("could not start metrics server: %w", err)
 	}
@@ -64,6 +65,35 @@ func run(ctx context.Context, cfg *config) error {
 	//nolint:errcheck
 	defer closer(ctx)
 
+	// shared by all the relays
+	dests, err := newDestinations(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error creating destinations: %w", err)
+	}
+
+	var queue *spool.Queue
+	if cfg.spoolDir != "" {
+		queue, err = newQueue(ctx, cfg, dests)
+		if err != nil {
+			return fmt.Errorf("error creating queue: %w", err)
+		}
+
+		queueCtx, cancelQueue := context.WithCancel(ctx)
+		queueDone := make(chan struct{})
+
+		go func() {
+			queue.Run(queueCtx)
+			close(queueDone)
+		}()
+
+		// stop the queue last, once the listeners are closed, and wait for
+		// deliveries in progress
+		defer func() {
+			cancelQueue()
+			<-queueDone
+		}()
+	}
+
 	addresses := strings.Split(cfg.listen, " ")
 
 	errch := make(chan error)
@@ -72,11 +102,13 @@ func run(ctx context.Context, cfg *config) error {
 		address := addresses[i]
 
 		var relay *relay
-		relay, err = newRelay(ctx, cfg)
+		relay, err = newRelay(ctx, cfg, dests)
 		if err != nil {
 			return fmt.Errorf("error creating relay: %w", err)
 		}
 
+		relay.queue = queue
+
 		var listener net.Listener
 		listener, err = relay.listen(address)
 		if err != nil {
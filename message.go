@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/spool"
+)
+
+// message is the data of a message being relayed. It's read from its start
+// by each delivery attempt, possibly concurrently, so messages the SMTP
+// server spilled to disk are streamed to the upstreams, instead of being
+// loaded in memory.
+type message struct {
+	open func() io.Reader
+	size int64
+}
+
+// newMessage returns a message held in memory.
+func newMessage(data []byte) *message {
+	return &message{
+		open: func() io.Reader { return bytes.NewReader(data) },
+		size: int64(len(data)),
+	}
+}
+
+// envelopeMessage returns the message of an envelope, as it is: later changes
+// to the envelope's header aren't reflected.
+func envelopeMessage(env *smtpd.Envelope) *message {
+	snapshot := *env
+
+	return &message{open: snapshot.Reader, size: snapshot.Size()}
+}
+
+// queuedMessage returns the message of a spooled message, streamed from the
+// spool while it's being delivered.
+func queuedMessage(msg *spool.Message) *message {
+	return &message{open: msg.Data, size: msg.Size()}
+}
+
+// reader returns a reader of the message, from its start.
+func (m *message) reader() io.Reader {
+	return m.open()
+}
+
+// bytes returns the message, read in memory, for destinations which need
+// all of it at once.
+func (m *message) bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, m.size))
+
+	if _, err := buf.ReadFrom(m.open()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// copyMessage returns a copy of the message which outlives its data, held in
+// memory up to spillSize bytes and written to a temporary file in spillDir
+// past it, like the bodies of messages being received (-1 never spills). The
+// returned function removes the temporary file, once the copy isn't used
+// anymore.
+func copyMessage(m *message, spillSize int, spillDir string) (*message, func(), error) {
+	if spillSize < 0 || m.size <= int64(spillSize) {
+		data, err := m.bytes()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return newMessage(data), func() {}, nil
+	}
+
+	f, err := os.CreateTemp(spillDir, "smtprelay-copy-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remove := func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+
+	size, err := io.Copy(f, m.reader())
+	if err != nil {
+		remove()
+
+		return nil, nil, err
+	}
+
+	return &message{
+		open: func() io.Reader { return io.NewSectionReader(f, 0, size) },
+		size: size,
+	}, remove, nil
+}
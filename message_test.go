@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEnvelope returns an envelope holding data.
+func testEnvelope(sender string, recipients []string, data string) *smtpd.Envelope {
+	env := &smtpd.Envelope{Sender: sender, Recipients: recipients}
+	env.SetData([]byte(data))
+
+	return env
+}
+
+// envelopeData returns the message of an envelope.
+func envelopeData(t *testing.T, env *smtpd.Envelope) string {
+	t.Helper()
+
+	data, err := env.Bytes()
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestMessage(t *testing.T) {
+	t.Parallel()
+
+	msg := newMessage([]byte("Subject: hello\r\n\r\nhello\r\n"))
+	assert.Equal(t, int64(25), msg.size)
+
+	// messages are read from their start every time
+	for range 2 {
+		data, err := io.ReadAll(msg.reader())
+		require.NoError(t, err)
+		assert.Equal(t, "Subject: hello\r\n\r\nhello\r\n", string(data))
+	}
+
+	// later changes to the envelope aren't reflected
+	env := testEnvelope("bob@example.com", nil, "Subject: hello\n\nhello\n")
+	msg = envelopeMessage(env)
+
+	env.AddHeader("X-Relay-Id", "1234")
+
+	data, err := msg.bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: hello\n\nhello\n", string(data))
+	assert.Equal(t, int64(len(data)), msg.size)
+	assert.Equal(t, "X-Relay-Id: 1234\nSubject: hello\n\nhello\n", envelopeData(t, env))
+}
+
+func TestCopyMessage(t *testing.T) {
+	t.Parallel()
+
+	const data = "Subject: hello\r\n\r\nhello\r\n"
+
+	// small messages are copied in memory, larger ones to a temporary file
+	for _, tc := range []struct {
+		spillSize int
+		spilled   bool
+	}{
+		{spillSize: -1},
+		{spillSize: len(data)},
+		{spillSize: len(data) - 1, spilled: true},
+	} {
+		dir := t.TempDir()
+
+		copied, remove, err := copyMessage(newMessage([]byte(data)), tc.spillSize, dir)
+		require.NoError(t, err)
+
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Equal(t, tc.spilled, len(files) == 1, tc.spillSize)
+
+		for range 2 {
+			got, err := io.ReadAll(copied.reader())
+			require.NoError(t, err)
+			assert.Equal(t, data, string(got), tc.spillSize)
+		}
+
+		assert.Equal(t, int64(len(data)), copied.size)
+
+		remove()
+
+		files, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, files, tc.spillSize)
+	}
+}
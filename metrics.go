@@ -12,6 +12,8 @@ import (
 	"time"
 
 	deltapprof "github.com/grafana/pyroscope-go/godeltaprof/http/pprof"
+	"github.com/grafana/smtprelay/v2/internal/catcher"
+	"github.com/grafana/smtprelay/v2/internal/spool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -19,12 +21,23 @@ import (
 )
 
 var (
-	requestsCounter    prometheus.Counter
-	errorsCounter      *prometheus.CounterVec
-	durationHistogram  *prometheus.HistogramVec
-	durationNative     *prometheus.HistogramVec
-	msgSizeHistogram   prometheus.Histogram
-	rateLimitedCounter prometheus.Counter
+	requestsCounter      prometheus.Counter
+	errorsCounter        *prometheus.CounterVec
+	durationHistogram    *prometheus.HistogramVec
+	durationNative       *prometheus.HistogramVec
+	msgSizeHistogram     prometheus.Histogram
+	rateLimitedCounter   prometheus.Counter
+	spoolAttempts        *prometheus.CounterVec
+	spoolDropped         prometheus.Counter
+	journalReports       *prometheus.CounterVec
+	mirrorDeliveries     *prometheus.CounterVec
+	mirrorDuration       *prometheus.HistogramVec
+	mirrorDropped        prometheus.Counter
+	circuitBreakerState  prometheus.Gauge
+	upstreamFailures     *prometheus.CounterVec
+	smarthostUp          *prometheus.GaugeVec
+	smarthostConnections *prometheus.GaugeVec
+	smarthostDials       *prometheus.CounterVec
 )
 
 const mb = 1024 * 1024
@@ -77,6 +90,84 @@ func init() {
 		Name:      "rate_limited_total",
 		Help:      "count of rate limited messages",
 	})
+
+	spoolAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "spool",
+		Name:      "delivery_attempts_total",
+		Help:      "count of delivery attempts of spooled messages",
+	}, []string{"result"})
+
+	spoolDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "spool",
+		Name:      "dropped_total",
+		Help:      "count of spooled messages dropped without being delivered",
+	})
+
+	journalReports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "journal",
+		Name:      "reports_total",
+		Help:      "count of journal reports of relayed messages, by result",
+	}, []string{"result"})
+
+	mirrorDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "mirror",
+		Name:      "deliveries_total",
+		Help:      "count of mirrored deliveries, by status code",
+	}, []string{"status_code"})
+
+	mirrorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: "mirror",
+		Name:      "duration_seconds",
+		Help:      "duration of mirrored deliveries",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"status_code"})
+
+	mirrorDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "mirror",
+		Name:      "dropped_total",
+		Help:      "count of messages not mirrored because too many mirrored deliveries were pending",
+	})
+
+	circuitBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "circuit_breaker",
+		Name:      "state",
+		Help:      "state of the circuit breaker of deliveries: closed (0), half-open (1) or open (2)",
+	})
+
+	upstreamFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "upstream",
+		Name:      "failures_total",
+		Help:      "count of delivery failures, by class (from response_map, or temporary, permanent or error)",
+	}, []string{"class"})
+
+	smarthostUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "smarthost",
+		Name:      "up",
+		Help:      "whether the outgoing SMTP server is considered healthy (1) or not (0)",
+	}, []string{"host"})
+
+	smarthostConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "smarthost",
+		Name:      "pool_connections",
+		Help:      "number of pooled sessions with the outgoing SMTP server, by state (active or idle)",
+	}, []string{"host", "state"})
+
+	smarthostDials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "smarthost",
+		Name:      "dials_total",
+		Help:      "count of sessions opened with the outgoing SMTP server",
+	}, []string{"host"})
 }
 
 func registerMetrics(registry prometheus.Registerer) error {
@@ -106,6 +197,61 @@ func registerMetrics(registry prometheus.Registerer) error {
 		return err
 	}
 
+	err = registry.Register(spoolAttempts)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(spoolDropped)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(journalReports)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(mirrorDeliveries)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(mirrorDuration)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(mirrorDropped)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(circuitBreakerState)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(upstreamFailures)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(smarthostUp)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(smarthostConnections)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(smarthostDials)
+	if err != nil {
+		return err
+	}
+
 	err = registry.Register(version.NewCollector(applicationName))
 	if err != nil {
 		return err
@@ -114,7 +260,19 @@ func registerMetrics(registry prometheus.Registerer) error {
 	return nil
 }
 
-func handleMetrics(ctx context.Context, addr string, registry prometheus.Registerer) (*instrumentationServer, error) {
+// registerQueueMetrics registers metrics reporting the state of the queue.
+func registerQueueMetrics(registry prometheus.Registerer, queue *spool.Queue) error {
+	return registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: applicationName,
+		Subsystem: "spool",
+		Name:      "messages",
+		Help:      "number of messages waiting in the spool",
+	}, func() float64 {
+		return float64(queue.Len())
+	}))
+}
+
+func handleMetrics(ctx context.Context, addr string, registry prometheus.Registerer, store *catcher.Store) (*instrumentationServer, error) {
 	log := slog.Default().With(slog.String("component", "metrics"))
 
 	// Setup listeners first, so we can fail early if the address is in use.
@@ -144,6 +302,10 @@ func handleMetrics(ctx context.Context, addr string, registry prometheus.Registe
 	router.HandleFunc("/debug/pprof/delta_block", deltapprof.Block)
 	router.HandleFunc("/debug/pprof/delta_mutex", deltapprof.Mutex)
 
+	if store != nil {
+		router.Handle(catcher.Prefix, store.Handler())
+	}
+
 	srv := &http.Server{
 		// 5s timeout for header reads to avoid Slowloris attacks (https://thetooth.io/blog/slowloris-attack/)
 		ReadHeaderTimeout: 5 * time.Second,
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// validateMirror checks the mirroring settings.
+func validateMirror(cfg *config) error {
+	if cfg.mirrorHost == "" {
+		return nil
+	}
+
+	if cfg.mirrorSample <= 0 || cfg.mirrorSample > 100 {
+		return errors.New("mirror_sample must be a percentage, greater than 0")
+	}
+
+	if cfg.mirrorMaxPending < 1 {
+		return errors.New("mirror_max_pending must be at least 1")
+	}
+
+	return validateUpstreams(splitstr(cfg.mirrorHost, ' '), cfg)
+}
+
+// mirror replays a sample of the messages to mirror_host, in the background:
+// its outcome never changes the reply to the client. Mirrored deliveries are
+// traced in their own traces, linked with the traces of the messages, and
+// dropped when mirror_max_pending of them are in progress. Mirrored messages
+// are copied, as they outlive the client's transaction: in memory up to
+// spill_size bytes, and to a temporary file past it.
+func (r *relay) mirror(ctx context.Context, sender string, recipients []string, data *message) {
+	if r.mirrorDest == nil {
+		return
+	}
+
+	//nolint:gosec // sampling doesn't need a secure random number
+	if rand.Float64()*100 >= r.cfg.mirrorSample {
+		return
+	}
+
+	select {
+	case r.mirrorSlots <- struct{}{}:
+	default:
+		mirrorDropped.Inc()
+		slog.WarnContext(ctx, "too many pending mirrored deliveries, dropping message",
+			slog.String("component", "mirror"))
+
+		return
+	}
+
+	copied, remove, err := copyMessage(data, r.cfg.spillSize, r.cfg.spillDir)
+	if err != nil {
+		<-r.mirrorSlots
+		slog.ErrorContext(ctx, "could not copy mirrored message", slog.String("component", "mirror"), slog.Any("error", err))
+
+		return
+	}
+
+	mirrorCtx, span := tracer.Start(context.WithoutCancel(ctx), "relay.mirror",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String("mirror.host", r.mirrorDest.String()),
+			traceutil.Sender(sender),
+			traceutil.Recipients(recipients),
+		),
+	)
+
+	trace.SpanFromContext(ctx).AddLink(trace.LinkFromContext(mirrorCtx))
+
+	r.mirrors.Go(func() {
+		defer func() { <-r.mirrorSlots }()
+		defer remove()
+		defer span.End()
+
+		start := time.Now()
+		err := r.mirrorDest.send(mirrorCtx, sender, recipients, copied)
+		duration := time.Since(start)
+
+		statusCode := 250
+
+		if err != nil {
+			var tperr *textproto.Error
+			if !errors.As(err, &tperr) {
+				tperr = smtpd.ErrForwardingFailed
+			}
+
+			statusCode = tperr.Code
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.SetAttributes(traceutil.StatusCode(statusCode))
+
+		mirrorDeliveries.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+		mirrorDuration.WithLabelValues(strconv.Itoa(statusCode)).Observe(duration.Seconds())
+
+		slog.DebugContext(mirrorCtx, "message mirrored",
+			slog.String("component", "mirror"),
+			slog.String("host", r.mirrorDest.String()),
+			slog.Int("status_code", statusCode),
+			slog.Duration("duration", duration),
+			slog.Any("error", err),
+		)
+	})
+}
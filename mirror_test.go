@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cfg := &config{mirrorSample: 100}
+
+	dest, err := newFileDestination("eml://"+dir, cfg)
+	require.NoError(t, err)
+
+	r := &relay{cfg: cfg, mirrorDest: dest, mirrorSlots: make(chan struct{}, 1)}
+
+	r.mirror(t.Context(), "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("Subject: hello\r\n\r\nhello\r\n")))
+	r.mirrors.Wait()
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// messages are dropped while too many deliveries are pending
+	r.mirrorSlots <- struct{}{}
+
+	r.mirror(t.Context(), "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("Subject: hello\r\n\r\nhello\r\n")))
+	r.mirrors.Wait()
+
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestValidateMirror(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateMirror(&config{}))
+	require.NoError(t, validateMirror(&config{mirrorHost: "smtp://sandbox.example.com:25", mirrorSample: 10, mirrorMaxPending: 1}))
+	require.Error(t, validateMirror(&config{mirrorHost: "smtp://sandbox.example.com:25", mirrorSample: 0, mirrorMaxPending: 1}))
+	require.Error(t, validateMirror(&config{mirrorHost: "smtp://sandbox.example.com:25", mirrorSample: 101, mirrorMaxPending: 1}))
+	require.Error(t, validateMirror(&config{mirrorHost: "smtp://sandbox.example.com:25", mirrorSample: 10}))
+	require.Error(t, validateMirror(&config{mirrorHost: "eml://relative", mirrorSample: 10, mirrorMaxPending: 1}))
+}
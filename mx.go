@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpclient"
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// mxResolver looks up the DNS records needed for MX delivery. It is satisfied
+// by *net.Resolver.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// resolver used for MX delivery - overridable for tests
+var defaultMXResolver mxResolver = net.DefaultResolver
+
+// mxDestination delivers messages directly to the MX hosts of the recipient
+// domains, as described in RFC 5321 section 5.1.
+type mxDestination struct {
+	resolver  mxResolver
+	port      string
+	client    smtpclient.Config
+	tlsPolicy string
+	tls       *tls.Config
+}
+
+// isMX reports whether the upstream spec requests MX delivery.
+func isMX(spec string) bool {
+	return strings.HasPrefix(spec, "mx://")
+}
+
+// parseMX parses an MX delivery spec: "mx://", optionally with the port to
+// deliver to ("mx://:2525").
+func parseMX(spec string) (port string, err error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Hostname() != "" || parsed.User != nil || parsed.RawQuery != "" || (parsed.Path != "" && parsed.Path != "/") {
+		return "", errors.New("mx:// only accepts a port, like mx://:25")
+	}
+
+	port = parsed.Port()
+	if port == "" {
+		port = "25"
+	}
+
+	return port, nil
+}
+
+func newMXDestination(spec string, cfg *config) (*mxDestination, error) {
+	port, err := parseMX(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := cfg.remoteTLSPolicy
+	if policy == "" {
+		policy = tlsPolicyOpportunistic
+	}
+
+	// opportunistic TLS doesn't verify certificates, as usual between MX
+	// hosts (RFC 7435), but required TLS verifies them against the MX host
+	tlsConfig := remoteTLSConfig(cfg)
+	if policy != tlsPolicyRequired {
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec
+	}
+
+	return &mxDestination{
+		resolver:  defaultMXResolver,
+		port:      port,
+		client:    clientConfig(cfg),
+		tlsPolicy: policy,
+		tls:       tlsConfig,
+	}, nil
+}
+
+func (d *mxDestination) start(_ context.Context) {}
+
+func (d *mxDestination) String() string {
+	return "mx://:" + d.port
+}
+
+// send delivers the message to each recipient domain separately, and combines
+// the results.
+func (d *mxDestination) send(ctx context.Context, sender string, recipients []string, data *message) error {
+	domains := []string{}
+	byDomain := map[string][]string{}
+
+	for _, rcpt := range recipients {
+		domain := ""
+		if idx := strings.LastIndex(rcpt, "@"); idx != -1 {
+			domain = strings.ToLower(rcpt[idx+1:])
+		}
+
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	groups := make([][]string, 0, len(domains))
+	errs := make([]error, 0, len(domains))
+
+	for _, domain := range domains {
+		err := d.sendDomain(ctx, domain, sender, byDomain[domain], data)
+		if err != nil {
+			err = fmt.Errorf("domain %q: %w", domain, err)
+		}
+
+		groups = append(groups, byDomain[domain])
+		errs = append(errs, err)
+	}
+
+	return combineResults(groups, errs)
+}
+
+func (d *mxDestination) sendDomain(ctx context.Context, domain, sender string, recipients []string, data *message) error {
+	ctx, span := tracer.Start(ctx, "relay.mx",
+		trace.WithAttributes(
+			attribute.String("smtp.domain", domain),
+			attribute.StringSlice("smtp.recipients", recipients),
+		),
+	)
+	defer span.End()
+
+	hosts, err := d.lookup(ctx, domain)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return err
+	}
+
+	var lastErr error
+
+	for _, host := range hosts {
+		addrs, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			lastErr = &upstreamError{addr: host, err: err}
+			continue
+		}
+
+		for _, addr := range addrs {
+			tlsConfig := d.tls.Clone()
+			tlsConfig.ServerName = host
+
+			u := &upstream{
+				addr:      net.JoinHostPort(addr.IP.String(), d.port),
+				host:      host,
+				tlsPolicy: d.tlsPolicy,
+				tlsConfig: tlsConfig,
+				healthy:   true,
+			}
+
+			span.SetAttributes(attribute.String("smtp.mx", host))
+
+			err := u.send(ctx, d.client, sender, recipients, data)
+
+			var uerr *upstreamError
+			if !errors.As(err, &uerr) {
+				return err
+			}
+
+			lastErr = err
+
+			if ctx.Err() != nil {
+				return err
+			}
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address found for the MX hosts of %q", domain)
+	}
+
+	span.RecordError(lastErr)
+	span.SetStatus(codes.Error, lastErr.Error())
+
+	return lastErr
+}
+
+// lookup returns the hosts to deliver to for the domain, in order of
+// preference, and in random order for equal preferences to spread the load
+// (RFC 5321 section 5.1). Domains without MX records have an implicit MX record
+// pointing to themselves.
+func (d *mxDestination) lookup(ctx context.Context, domain string) ([]string, error) {
+	if domain == "" {
+		return nil, smtpd.ErrDomainNotFound
+	}
+
+	mxs, err := d.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %w", smtpd.ErrDNSFailed, err)
+		}
+
+		mxs = nil
+	}
+
+	// RFC 7505: a single "." MX means the domain doesn't accept mail
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, smtpd.ErrNullMX
+	}
+
+	if len(mxs) == 0 {
+		_, err := d.resolver.LookupIPAddr(ctx, domain)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, smtpd.ErrDomainNotFound
+			}
+
+			return nil, fmt.Errorf("%w: %w", smtpd.ErrDNSFailed, err)
+		}
+
+		return []string{domain}, nil
+	}
+
+	mxs = slices.Clone(mxs)
+	rand.Shuffle(len(mxs), func(i, j int) {
+		mxs[i], mxs[j] = mxs[j], mxs[i]
+	})
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+
+	return hosts, nil
+}
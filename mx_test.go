@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver is an in-process DNS stand-in. Names without records are
+// reported as not found, unless listed in temporary.
+type fakeResolver struct {
+	mx        map[string][]*net.MX
+	ip        map[string][]net.IPAddr
+	txt       map[string][]string
+	temporary map[string]bool
+}
+
+func (f *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if f.temporary[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	if mxs, ok := f.mx[name]; ok {
+		return mxs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if f.temporary[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	if txt, ok := f.txt[name]; ok {
+		return txt, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := f.ip[host]; ok {
+		return ips, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestParseMX(t *testing.T) {
+	t.Parallel()
+
+	port, err := parseMX("mx://")
+	require.NoError(t, err)
+	assert.Equal(t, "25", port)
+
+	port, err = parseMX("mx://:2525")
+	require.NoError(t, err)
+	assert.Equal(t, "2525", port)
+
+	for _, bad := range []string{"mx://example.com", "mx://user@:25", "mx://:25/path", "mx://:25?auth=plain"} {
+		_, err := parseMX(bad)
+		require.Error(t, err, bad)
+	}
+
+	_, err = newDestination(t.Context(), &config{}, []string{"mx://", "smtp.example.com:25"}, nil)
+	require.Error(t, err)
+}
+
+func TestMXLookup(t *testing.T) {
+	t.Parallel()
+
+	d := &mxDestination{resolver: &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx1b.example.com.", Pref: 10},
+			},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		ip: map[string][]net.IPAddr{
+			"implicit.example": {{IP: net.ParseIP("192.0.2.1")}},
+		},
+		temporary: map[string]bool{"broken.example": true},
+	}}
+
+	ctx := t.Context()
+
+	// hosts with the same preference are tried in random order
+	firsts := map[string]bool{}
+
+	for range 100 {
+		hosts, err := d.lookup(ctx, "example.com")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"mx1.example.com", "mx1b.example.com"}, hosts[:2])
+		require.Equal(t, "mx2.example.com", hosts[2])
+
+		firsts[hosts[0]] = true
+	}
+
+	assert.Len(t, firsts, 2)
+
+	// no MX records, the domain itself is used
+	hosts, err := d.lookup(ctx, "implicit.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"implicit.example"}, hosts)
+
+	_, err = d.lookup(ctx, "null.example")
+	require.ErrorIs(t, err, smtpd.ErrNullMX)
+
+	_, err = d.lookup(ctx, "nxdomain.example")
+	require.ErrorIs(t, err, smtpd.ErrDomainNotFound)
+
+	_, err = d.lookup(ctx, "broken.example")
+	require.ErrorIs(t, err, smtpd.ErrDNSFailed)
+}
+
+func TestMXDeliveryFallback(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	_, port, err := net.SplitHostPort(srv.addr)
+	require.NoError(t, err)
+
+	d, err := newMXDestination("mx://:"+port, &config{})
+	require.NoError(t, err)
+
+	d.resolver = &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+			},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		ip: map[string][]net.IPAddr{
+			// nothing listens there, so delivery falls back to mx2
+			"mx1.example.com":  {{IP: net.ParseIP("127.0.0.2")}},
+			"mx2.example.com":  {{IP: net.ParseIP("127.0.0.1")}},
+			"implicit.example": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+	}
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	err = d.send(ctx, "bob@example.org", []string{"alice@example.com", "carol@implicit.example", "dave@EXAMPLE.com"}, newMessage(data))
+	require.NoError(t, err)
+
+	// one transaction per domain
+	msgs := srv.messages()
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []string{"alice@example.com", "dave@EXAMPLE.com"}, msgs[0].Recipients)
+	assert.Equal(t, []string{"carol@implicit.example"}, msgs[1].Recipients)
+
+	// a permanent failure for one domain doesn't prevent delivery to others
+	err = d.send(ctx, "bob@example.org", []string{"alice@null.example", "eve@example.com"}, newMessage(data))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 556, tperr.Code)
+	assert.Len(t, srv.messages(), 3)
+}
+
+func TestMXDeliveryTLSPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+
+	serverCert, serverKey := writeTestCertificate(t, dir, "server")
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clients := make(chan *smtpd.Peer, 2)
+	srv := &smtpd.Server{
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}},
+		Handler: func(_ context.Context, peer smtpd.Peer, _ smtpd.Envelope) error {
+			clients <- &peer
+			return nil
+		},
+	}
+
+	go func() {
+		_ = srv.Serve(ctx, l)
+	}()
+
+	plain := startTestSMTPServer(ctx, t)
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	_, plainPort, err := net.SplitHostPort(plain.addr)
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			// the certificate is only valid for 127.0.0.1
+			"example.com":  {{Host: "mx.example.com.", Pref: 10}},
+			"example.net":  {{Host: "127.0.0.1.", Pref: 10}},
+			"example.test": {{Host: "127.0.0.1.", Pref: 10}},
+		},
+		ip: map[string][]net.IPAddr{
+			"mx.example.com": {{IP: net.ParseIP("127.0.0.1")}},
+			"127.0.0.1":      {{IP: net.ParseIP("127.0.0.1")}},
+		},
+	}
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	cfg := &config{remoteTLSPolicy: "required", remoteTLSMinVersion: "1.2", remoteCAFile: serverCert}
+	cfg.remoteTLS, err = setupRemoteTLS(cfg)
+	require.NoError(t, err)
+
+	required, err := newMXDestination("mx://:"+port, cfg)
+	require.NoError(t, err)
+
+	required.resolver = resolver
+
+	// the certificate is verified against the MX host
+	err = required.send(ctx, "bob@example.org", []string{"alice@example.net"}, newMessage(data))
+	require.NoError(t, err)
+
+	peer := <-clients
+	require.NotNil(t, peer.TLS)
+
+	err = required.send(ctx, "bob@example.org", []string{"alice@example.com"}, newMessage(data))
+	require.Error(t, err)
+
+	// TLS is required, but the MX host doesn't offer STARTTLS
+	required, err = newMXDestination("mx://:"+plainPort, cfg)
+	require.NoError(t, err)
+
+	required.resolver = resolver
+
+	err = required.send(ctx, "bob@example.org", []string{"alice@example.test"}, newMessage(data))
+	require.ErrorContains(t, err, "STARTTLS")
+	assert.Empty(t, plain.messages())
+
+	// opportunistic TLS doesn't verify certificates
+	opportunistic, err := newMXDestination("mx://:"+port, &config{})
+	require.NoError(t, err)
+
+	opportunistic.resolver = resolver
+
+	err = opportunistic.send(ctx, "bob@example.org", []string{"alice@example.com"}, newMessage(data))
+	require.NoError(t, err)
+
+	peer = <-clients
+	require.NotNil(t, peer.TLS)
+}
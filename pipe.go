@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Placeholders in remote_pipe_args, replaced by the envelope.
+const (
+	pipeSender     = "{sender}"     // replaced in any argument
+	pipeRecipients = "{recipients}" // expanded to one argument per recipient
+)
+
+// maxPipeStderr bounds how much of the command's stderr is kept for logs.
+const maxPipeStderr = 4096
+
+// pipeDestination hands messages off to a local MTA, by running a
+// sendmail-compatible command with the message on its standard input.
+type pipeDestination struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+// sysexit is how an exit status of sysexits.h is reported to clients.
+type sysexit struct {
+	name     string
+	code     int
+	enhanced string
+}
+
+// sysexits maps the exit statuses of sendmail-compatible commands onto SMTP
+// replies. Other non-zero statuses are temporary failures.
+var sysexits = map[int]sysexit{
+	64: {"EX_USAGE", 451, "4.3.5"},
+	65: {"EX_DATAERR", 554, "5.6.0"},
+	66: {"EX_NOINPUT", 451, "4.3.0"},
+	67: {"EX_NOUSER", 550, "5.1.1"},
+	68: {"EX_NOHOST", 550, "5.1.2"},
+	69: {"EX_UNAVAILABLE", 554, "5.3.0"},
+	70: {"EX_SOFTWARE", 451, "4.3.0"},
+	71: {"EX_OSERR", 451, "4.3.0"},
+	72: {"EX_OSFILE", 451, "4.3.5"},
+	73: {"EX_CANTCREAT", 550, "5.2.0"},
+	74: {"EX_IOERR", 451, "4.3.0"},
+	75: {"EX_TEMPFAIL", 451, "4.3.0"},
+	76: {"EX_PROTOCOL", 554, "5.5.0"},
+	77: {"EX_NOPERM", 550, "5.7.1"},
+	78: {"EX_CONFIG", 451, "4.3.5"},
+}
+
+// isPipe reports whether the upstream spec requests delivery through a local
+// command.
+func isPipe(spec string) bool {
+	return strings.HasPrefix(spec, "pipe://")
+}
+
+// parsePipe parses a pipe spec, like pipe:///usr/sbin/sendmail, and returns
+// the path of the command.
+func parsePipe(spec string) (string, error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Host != "" || parsed.User != nil || parsed.RawQuery != "" || parsed.Path == "" || parsed.Path == "/" {
+		return "", errors.New("pipe:// only accepts the absolute path of a command, like pipe:///usr/sbin/sendmail")
+	}
+
+	return filepath.Clean(parsed.Path), nil
+}
+
+// newPipeDestination returns a destination running the command with the
+// remote_pipe_args arguments, and remote_data_timeout as a timeout.
+func newPipeDestination(spec string, cfg *config) (*pipeDestination, error) {
+	command, err := parsePipe(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pipeDestination{
+		command: command,
+		args:    splitstr(cfg.remotePipeArgs, ' '),
+		timeout: cfg.remoteDataTimeout,
+	}, nil
+}
+
+func (d *pipeDestination) start(_ context.Context) {}
+
+func (d *pipeDestination) String() string {
+	return "pipe://" + d.command
+}
+
+// send runs the command, with the message on its standard input.
+func (d *pipeDestination) send(ctx context.Context, sender string, recipients []string, data *message) error {
+	ctx, span := tracer.Start(ctx, "relay.pipe",
+		trace.WithAttributes(
+			attribute.String("process.command", d.command),
+			attribute.StringSlice("smtp.recipients", recipients),
+		),
+	)
+	defer span.End()
+
+	err := d.run(ctx, sender, recipients, data)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+func (d *pipeDestination) run(ctx context.Context, sender string, recipients []string, data *message) error {
+	args, err := pipeArgs(d.args, sender, recipients)
+	if err != nil {
+		return err
+	}
+
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	stderr := &limitedBuffer{max: maxPipeStderr}
+
+	cmd := exec.CommandContext(ctx, d.command, args...)
+	cmd.Stdin = data.reader()
+	cmd.Stderr = stderr
+	// don't wait forever for children of the command holding stderr open
+	cmd.WaitDelay = 5 * time.Second
+
+	err = cmd.Run()
+
+	logger := slog.With(
+		slog.String("component", "pipe"),
+		slog.String("command", d.command),
+		slog.String("stderr", strings.TrimSpace(stderr.String())),
+	)
+
+	var exitErr *exec.ExitError
+
+	switch {
+	case err == nil:
+		if stderr.Len() > 0 {
+			logger.WarnContext(ctx, "pipe command succeeded with errors")
+		}
+
+		return nil
+	case ctx.Err() != nil:
+		logger.ErrorContext(ctx, "pipe command timed out", slog.Any("error", err))
+
+		return &textproto.Error{Code: 451, Msg: "4.4.7 Local delivery timed out"}
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		logger.ErrorContext(ctx, "pipe command failed", slog.Int("exit_code", exitErr.ExitCode()))
+
+		return pipeExitError(exitErr.ExitCode())
+	default:
+		logger.ErrorContext(ctx, "could not run pipe command", slog.Any("error", err))
+
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Local delivery failed"}
+	}
+}
+
+// pipeArgs returns the arguments of the command, with the placeholders
+// replaced by the envelope. Addresses looking like options are rejected, as
+// they could change what the command does.
+func pipeArgs(args []string, sender string, recipients []string) ([]string, error) {
+	if sender == "" {
+		sender = "<>"
+	}
+
+	for _, addr := range append([]string{sender}, recipients...) {
+		if strings.HasPrefix(addr, "-") {
+			return nil, &textproto.Error{Code: 553, Msg: "5.1.3 Invalid address " + addr}
+		}
+	}
+
+	expanded := make([]string, 0, len(args)+len(recipients))
+
+	for _, arg := range args {
+		if arg == pipeRecipients {
+			expanded = append(expanded, recipients...)
+			continue
+		}
+
+		expanded = append(expanded, strings.ReplaceAll(arg, pipeSender, sender))
+	}
+
+	return expanded, nil
+}
+
+// pipeExitError maps a non-zero exit status of the command onto an SMTP
+// reply. Its stderr is only logged, as it may reveal local details.
+func pipeExitError(status int) *textproto.Error {
+	exit, ok := sysexits[status]
+	if !ok {
+		exit = sysexit{name: "status", code: 451, enhanced: "4.3.0"}
+	}
+
+	msg := fmt.Sprintf("%s Local delivery failed with %s (%d)", exit.enhanced, exit.name, status)
+
+	return &textproto.Error{Code: exit.code, Msg: msg}
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the
+// rest.
+type limitedBuffer struct {
+	bytes.Buffer
+
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+
+	return len(p), nil
+}
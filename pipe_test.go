@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// writeTestCommand writes a shell script saving its arguments and standard
+// input to files in dir, and running the given commands.
+func writeTestCommand(t *testing.T, dir, script string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "sendmail")
+	content := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+		"cat > " + filepath.Join(dir, "data") + "\n" +
+		script + "\n"
+
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o700)) //nolint:gosec
+
+	return path
+}
+
+func TestPipe(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+	command := writeTestCommand(t, dir, "echo 'warning: deprecated' >&2")
+
+	cfg := &config{remotePipeArgs: "-i -f {sender} -- {recipients}", remoteDataTimeout: time.Minute}
+
+	dest, err := newDestination(ctx, cfg, []string{"pipe://" + command}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com", "carol@example.com"}, newMessage([]byte("Subject: test\n\nhello\n")))
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "-i\n-f\nbob@example.com\n--\nalice@example.com\ncarol@example.com\n", string(args))
+
+	data, err := os.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\n\nhello\n", string(data))
+
+	// null sender
+	err = dest.send(ctx, "", []string{"alice@example.com"}, newMessage([]byte("hello\n")))
+	require.NoError(t, err)
+
+	args, err = os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "-i\n-f\n<>\n--\nalice@example.com\n", string(args))
+
+	// addresses can't be passed as options
+	err = dest.send(ctx, "bob@example.com", []string{"-oQ/tmp"}, newMessage([]byte("hello\n")))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 553, tperr.Code)
+}
+
+func TestPipeFailures(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	for _, tc := range []struct {
+		script string
+		code   int
+		msg    string
+	}{
+		{"echo 'queue full' >&2; exit 75", 451, "4.3.0 Local delivery failed with EX_TEMPFAIL (75)"},
+		{"echo 'alice... User unknown' >&2; exit 67", 550, "5.1.1 Local delivery failed with EX_NOUSER (67)"},
+		{"exit 65", 554, "5.6.0 Local delivery failed with EX_DATAERR (65)"},
+		{"exit 1", 451, "4.3.0 Local delivery failed with status (1)"},
+		{"exec sleep 10", 451, "4.4.7 Local delivery timed out"},
+	} {
+		dir := t.TempDir()
+
+		dest, err := newPipeDestination("pipe://"+writeTestCommand(t, dir, tc.script), &config{remoteDataTimeout: 500 * time.Millisecond})
+		require.NoError(t, err)
+
+		err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\n")))
+
+		var tperr *textproto.Error
+		require.ErrorAs(t, err, &tperr, tc.script)
+		assert.Equal(t, tc.code, tperr.Code, tc.script)
+		assert.Equal(t, tc.msg, tperr.Msg, tc.script)
+	}
+
+	dest, err := newPipeDestination("pipe:///nonexistent/sendmail", &config{})
+	require.NoError(t, err)
+
+	err = dest.send(ctx, "bob@example.com", []string{"alice@example.com"}, newMessage([]byte("hello\n")))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 451, tperr.Code)
+
+	for _, spec := range []string{"pipe://", "pipe://host/sendmail", "pipe:///usr/sbin/sendmail?x=1"} {
+		_, err := parsePipe(spec)
+		require.Error(t, err, spec)
+	}
+
+	require.Error(t, validateUpstreams([]string{"pipe:///usr/sbin/sendmail", "smtp.example.com:25"}, &config{}))
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	t.Parallel()
+
+	b := &limitedBuffer{max: 5}
+
+	n, err := b.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = b.Write([]byte(strings.Repeat("d", 10)))
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	assert.Equal(t, "abcdd", b.String())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/grafana/smtprelay/v2/internal/spool"
+)
+
+// newQueue opens the spool directory, and returns a queue which delivers
+// spooled messages through a relay of its own, sharing the destinations of the
+// listeners. The queue must be started with Run.
+func newQueue(ctx context.Context, cfg *config, dests *destinations) (*spool.Queue, error) {
+	r, err := newRelay(ctx, cfg, dests)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &spool.Queue{
+		Dir:        cfg.spoolDir,
+		Workers:    cfg.spoolWorkers,
+		MaxAge:     cfg.spoolMaxAge,
+		MinBackoff: cfg.spoolRetryBackoff,
+		MaxBackoff: cfg.spoolRetryMaxBackoff,
+		Deliver:    r.deliverQueued,
+		Failed:     r.queueFailed,
+	}
+
+	// delivery status notifications are spooled too
+	r.queue = queue
+
+	if err := queue.Open(); err != nil {
+		return nil, fmt.Errorf("open spool %q: %w", cfg.spoolDir, err)
+	}
+
+	if err := registerQueueMetrics(metricsRegistry, queue); err != nil {
+		return nil, fmt.Errorf("registerQueueMetrics: %w", err)
+	}
+
+	slog.InfoContext(ctx, "spool opened",
+		slog.String("component", "spool"),
+		slog.String("dir", cfg.spoolDir),
+		slog.Int("messages", queue.Len()),
+	)
+
+	return queue, nil
+}
+
+// deliverQueued is called by the queue for every delivery attempt.
+func (r *relay) deliverQueued(ctx context.Context, msg *spool.Message) error {
+	logger := slog.With(
+		slog.String("component", "spool"),
+		slog.String("uuid", msg.ID),
+		slog.String("from", msg.Sender),
+		slog.Any("to", msg.Recipients),
+		slog.String("host", r.remote.String()),
+		slog.Int("attempt", msg.Attempts),
+	)
+
+	data := queuedMessage(msg)
+
+	err := r.send(ctx, msg.Sender, msg.Recipients, data)
+
+	var rerr *recipientsError
+	if errors.As(err, &rerr) && rerr.partial() {
+		rerr.log(ctx, logger)
+
+		temporary, permanent := rerr.split()
+
+		// give up on the recipients rejected permanently, and retry the
+		// others only
+		if len(permanent) > 0 {
+			failed := *msg
+			failed.Recipients = failedRecipients(permanent)
+
+			r.queueFailed(ctx, &failed, &recipientsError{failed: permanent})
+		}
+
+		// the delivered recipients won't be retried
+		_ = r.journal(ctx, msg.ID, msg.OriginalSender, rerr.delivered, data)
+
+		if len(temporary) == 0 {
+			spoolAttempts.WithLabelValues("success").Inc()
+
+			return nil
+		}
+
+		msg.Recipients = failedRecipients(temporary)
+		err = &recipientsError{delivered: rerr.delivered, failed: temporary}
+	}
+
+	if err != nil {
+		spoolAttempts.WithLabelValues("error").Inc()
+
+		return err
+	}
+
+	spoolAttempts.WithLabelValues("success").Inc()
+
+	logger.InfoContext(ctx, "delivery successful")
+
+	// the message was delivered, so failures can't be retried
+	_ = r.journal(ctx, msg.ID, msg.OriginalSender, msg.Recipients, data)
+
+	return nil
+}
+
+// queueFailed is called by the queue when it drops an undeliverable message.
+func (r *relay) queueFailed(ctx context.Context, msg *spool.Message, err error) {
+	spoolDropped.Inc()
+
+	slog.ErrorContext(ctx, "dropping undeliverable message",
+		slog.String("component", "spool"),
+		slog.String("uuid", msg.ID),
+		slog.String("from", msg.Sender),
+		slog.Any("to", msg.Recipients),
+		slog.Int("attempts", msg.Attempts),
+		slog.Any("error", err),
+	)
+
+	r.bounce(ctx, msg.OriginalSender, msg.CreatedAt, queuedMessage(msg), failuresOf(msg.Recipients, err))
+}
+
+func failedRecipients(failures []rcptFailure) []string {
+	rcpts := make([]string, 0, len(failures))
+	for _, f := range failures {
+		rcpts = append(rcpts, f.rcpt)
+	}
+
+	return rcpts
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// rcptFailure is a recipient the message couldn't be delivered to.
+type rcptFailure struct {
+	rcpt string
+	err  error
+}
+
+// recipientsError is returned when the message couldn't be delivered to some
+// of its recipients. It was delivered to the others, if any.
+type recipientsError struct {
+	delivered []string
+	failed    []rcptFailure
+}
+
+func (e *recipientsError) Error() string {
+	msgs := make([]string, 0, len(e.failed))
+	for _, f := range e.failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", f.rcpt, f.err))
+	}
+
+	return fmt.Sprintf("%d of %d recipients failed: %s",
+		len(e.failed), len(e.failed)+len(e.delivered), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns a single error standing for all the failures, as returned by
+// combineErrors.
+func (e *recipientsError) Unwrap() error {
+	errs := make([]error, 0, len(e.failed))
+	for _, f := range e.failed {
+		errs = append(errs, f.err)
+	}
+
+	return combineErrors(errs)
+}
+
+// partial reports whether the message was delivered to some recipients.
+func (e *recipientsError) partial() bool {
+	return len(e.delivered) > 0
+}
+
+// split returns the failures which are temporary and permanent.
+func (e *recipientsError) split() (temporary, permanent []rcptFailure) {
+	for _, f := range e.failed {
+		if isPermanent(f.err) {
+			permanent = append(permanent, f)
+		} else {
+			temporary = append(temporary, f)
+		}
+	}
+
+	return temporary, permanent
+}
+
+// log logs and traces the failures.
+func (e *recipientsError) log(ctx context.Context, logger *slog.Logger) {
+	span := trace.SpanFromContext(ctx)
+
+	for _, f := range e.failed {
+		attrs := []any{slog.String("rcpt", f.rcpt), slog.Any("error", f.err)}
+		spanAttrs := []attribute.KeyValue{attribute.String("smtp.recipient", f.rcpt)}
+
+		var tperr *textproto.Error
+		if errors.As(f.err, &tperr) {
+			attrs = append(attrs, slog.Int("err_code", tperr.Code), slog.String("err_msg", tperr.Msg))
+			spanAttrs = append(spanAttrs, attribute.Int("smtp.response.status_code", tperr.Code))
+		}
+
+		logger.WarnContext(ctx, "delivery to recipient failed", attrs...)
+		span.AddEvent("recipient failed", trace.WithAttributes(spanAttrs...))
+	}
+}
+
+// isPermanent reports whether a delivery error is permanent, i.e. a 5xx
+// reply. Anything else is worth retrying.
+func isPermanent(err error) bool {
+	var tperr *textproto.Error
+	return errors.As(err, &tperr) && tperr.Code >= 500
+}
+
+// combineErrors combines the errors of several partial deliveries into a
+// single error: if any of them failed temporarily, the first temporary error
+// is returned so the client retries, otherwise the first permanent error is
+// returned. Nil errors are ignored.
+func combineErrors(errs []error) error {
+	var temporary, permanent error
+
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case isPermanent(err):
+			if permanent == nil {
+				permanent = err
+			}
+		case temporary == nil:
+			temporary = err
+		}
+	}
+
+	if temporary != nil {
+		return temporary
+	}
+
+	return permanent
+}
+
+// combineResults combines the results of the deliveries to several groups of
+// recipients into a *recipientsError, or nil if all of them succeeded.
+func combineResults(recipients [][]string, errs []error) error {
+	combined := &recipientsError{}
+
+	for i, err := range errs {
+		var rerr *recipientsError
+
+		switch {
+		case err == nil:
+			combined.delivered = append(combined.delivered, recipients[i]...)
+		case errors.As(err, &rerr):
+			combined.delivered = append(combined.delivered, rerr.delivered...)
+			combined.failed = append(combined.failed, rerr.failed...)
+		default:
+			for _, rcpt := range recipients[i] {
+				combined.failed = append(combined.failed, rcptFailure{rcpt: rcpt, err: err})
+			}
+		}
+	}
+
+	if len(combined.failed) == 0 {
+		return nil
+	}
+
+	return combined
+}
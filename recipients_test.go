@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestCombineResults(t *testing.T) {
+	t.Parallel()
+
+	rejected := &textproto.Error{Code: 550, Msg: "no such user"}
+	down := errors.New("connection refused")
+
+	assert.NoError(t, combineResults([][]string{{"a@example.com"}, {"b@example.org"}}, []error{nil, nil}))
+
+	err := combineResults(
+		[][]string{{"a@example.com", "b@example.com"}, {"c@example.org"}, {"d@example.net"}},
+		[]error{
+			&recipientsError{delivered: []string{"a@example.com"}, failed: []rcptFailure{{"b@example.com", rejected}}},
+			nil,
+			down,
+		},
+	)
+
+	var rerr *recipientsError
+	require.ErrorAs(t, err, &rerr)
+	assert.True(t, rerr.partial())
+	assert.Equal(t, []string{"a@example.com", "c@example.org"}, rerr.delivered)
+
+	temporary, permanent := rerr.split()
+	assert.Equal(t, []rcptFailure{{"d@example.net", down}}, temporary)
+	assert.Equal(t, []rcptFailure{{"b@example.com", rejected}}, permanent)
+
+	// temporary failures win, so that the client retries
+	require.ErrorIs(t, err, down)
+	assert.False(t, isPermanent(err))
+
+	err = combineResults([][]string{{"a@example.com"}}, []error{rejected})
+	require.ErrorAs(t, err, &rerr)
+	assert.False(t, rerr.partial())
+	assert.True(t, isPermanent(err))
+}
+
+func TestSmarthostsPartialRecipients(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+
+	srv := startTestSMTPServer(ctx, t)
+
+	hosts, err := newSmarthosts(ctx, &config{}, []string{srv.addr}, map[string]oauth2.TokenSource{})
+	require.NoError(t, err)
+
+	err = hosts.send(ctx, "bob@example.com", []string{"alice@example.com", "nobody@example.com"}, newMessage([]byte("hello\r\n")))
+
+	var rerr *recipientsError
+	require.ErrorAs(t, err, &rerr)
+	assert.Equal(t, []string{"alice@example.com"}, rerr.delivered)
+	require.Len(t, rerr.failed, 1)
+	assert.Equal(t, "nobody@example.com", rerr.failed[0].rcpt)
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, rerr.failed[0].err, &tperr)
+	assert.Equal(t, 550, tperr.Code)
+
+	require.Len(t, srv.messages(), 1)
+	assert.Equal(t, []string{"alice@example.com"}, srv.messages()[0].Recipients)
+}
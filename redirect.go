@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redirector redirects the recipients of all messages, so a staging relay
+// never delivers to real recipients.
+type redirector struct {
+	rules   []*senderRule // per-sender redirect addresses
+	to      string        // default redirect address
+	exclude []addrPattern // recipients passing through
+}
+
+// validateRedirect checks the redirect settings.
+func validateRedirect(cfg *config) error {
+	_, err := newRedirector(cfg)
+
+	return err
+}
+
+// newRedirector returns a redirector for the redirect_* settings, or nil if
+// recipients aren't redirected.
+func newRedirector(cfg *config) (*redirector, error) {
+	if cfg.redirectTo == "" && cfg.redirectMap == "" && cfg.redirectExclude == "" {
+		return nil, nil
+	}
+
+	if cfg.redirectTo == "" {
+		return nil, errors.New("redirect_to must be set to redirect recipients")
+	}
+
+	d := &redirector{to: cfg.redirectTo}
+
+	if cfg.redirectMap != "" {
+		rules, err := loadSenderRewriteMap(cfg.redirectMap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load redirect map %q: %w", cfg.redirectMap, err)
+		}
+
+		d.rules = rules
+	}
+
+	for _, pattern := range splitstr(cfg.redirectExclude, ' ') {
+		p, err := parseAddrPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redirect_exclude: %w", err)
+		}
+
+		d.exclude = append(d.exclude, p)
+	}
+
+	return d, nil
+}
+
+// target returns the address to redirect the messages of the sender to.
+func (d *redirector) target(sender string) string {
+	for _, rule := range d.rules {
+		if rule.matches(sender) {
+			return rule.rewrite(sender)
+		}
+	}
+
+	return d.to
+}
+
+// excluded reports whether a recipient passes through unchanged.
+func (d *redirector) excluded(rcpt string) bool {
+	for _, p := range d.exclude {
+		if p.matches(rcpt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redirect replaces the recipients of the message with the redirect address
+// of its sender, except the excluded ones, and records the original
+// recipients in X-Original-To header fields.
+func (r *relay) redirect(ctx context.Context, env *smtpd.Envelope) {
+	if r.redirector == nil {
+		return
+	}
+
+	target := r.redirector.target(env.Sender)
+	recipients := make([]string, 0, len(env.Recipients))
+	redirected := []string{}
+
+	for _, rcpt := range env.Recipients {
+		if r.redirector.excluded(rcpt) {
+			recipients = append(recipients, rcpt)
+			continue
+		}
+
+		redirected = append(redirected, rcpt)
+		recipients = append(recipients, target)
+	}
+
+	if len(redirected) == 0 {
+		return
+	}
+
+	// in reverse, so the fields are in the order of the recipients
+	for _, rcpt := range slices.Backward(redirected) {
+		env.AddHeader("X-Original-To", rcpt)
+	}
+
+	// redirected recipients are delivered to once
+	seen := map[string]bool{}
+	env.Recipients = slices.DeleteFunc(recipients, func(rcpt string) bool {
+		dup := seen[rcpt]
+		seen[rcpt] = true
+
+		return dup
+	})
+
+	slog.InfoContext(ctx, "recipients redirected", slog.String("component", "redirect"),
+		slog.Any("original", redirected), slog.Any("to", env.Recipients))
+	trace.SpanFromContext(ctx).SetAttributes(traceutil.RedirectedRecipients(env.Recipients))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirect(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "redirect")
+	require.NoError(t, os.WriteFile(path, []byte("/^(.+)@apps\\.internal$/  qa+$1@example.com\n"), 0o600))
+
+	d, err := newRedirector(&config{
+		redirectTo:      "staging@example.com",
+		redirectMap:     path,
+		redirectExclude: "example.com .test.example",
+	})
+	require.NoError(t, err)
+
+	r := &relay{cfg: &config{}, redirector: d}
+
+	env := testEnvelope("billing@apps.internal",
+		[]string{"alice@customer.example", "bob@example.com", "carol@customer.example", "dave@qa.test.example"},
+		"Subject: invoice\r\n\r\nhello\r\n")
+
+	r.redirect(t.Context(), env)
+
+	assert.Equal(t, []string{"qa+billing@example.com", "bob@example.com", "dave@qa.test.example"}, env.Recipients)
+	assert.Equal(t, "X-Original-To: alice@customer.example\r\n"+
+		"X-Original-To: carol@customer.example\r\n"+
+		"Subject: invoice\r\n\r\nhello\r\n", envelopeData(t, env))
+
+	// senders not in the map are redirected to redirect_to
+	env = testEnvelope("", []string{"alice@customer.example"}, "Subject: bounce\r\n\r\n")
+
+	r.redirect(t.Context(), env)
+
+	assert.Equal(t, []string{"staging@example.com"}, env.Recipients)
+	assert.Equal(t, "alice@customer.example", env.Header.Get("X-Original-To"))
+
+	// excluded recipients only are left alone
+	env = testEnvelope("bob@example.com", []string{"bob@example.com"}, "Subject: hi\r\n\r\n")
+
+	r.redirect(t.Context(), env)
+
+	assert.Equal(t, []string{"bob@example.com"}, env.Recipients)
+	assert.Equal(t, "Subject: hi\r\n\r\n", envelopeData(t, env))
+}
+
+func TestValidateRedirect(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateRedirect(&config{}))
+	require.NoError(t, validateRedirect(&config{redirectTo: "staging@example.com", redirectExclude: "example.com"}))
+	require.Error(t, validateRedirect(&config{redirectExclude: "example.com"}))
+	require.Error(t, validateRedirect(&config{redirectTo: "staging@example.com", redirectExclude: "/(/"}))
+	require.Error(t, validateRedirect(&config{redirectTo: "staging@example.com", redirectMap: filepath.Join(t.TempDir(), "missing")}))
+}
@@ -7,15 +7,17 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
-	"net/smtp"
 	"net/textproto"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/grafana/smtprelay/v2/internal/smtpclient"
 	"github.com/grafana/smtprelay/v2/internal/smtpd"
+	"github.com/grafana/smtprelay/v2/internal/spool"
 	"github.com/grafana/smtprelay/v2/internal/traceutil"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
@@ -32,17 +34,111 @@ type relay struct {
 	cfg               *config
 	rateLimiter       *rateLimiter
 	oauth2TokenSource oauth2.TokenSource
+	remote            destination
+	transports        []*transport
+	queue             *spool.Queue    // nil unless spooling is enabled
+	dkim              *dkimSigner     // nil unless DKIM signing is enabled
+	resolver          authResolver    // for inbound verification
+	rewriter          *senderRewriter // nil unless senders are rewritten
+	headerRules       []*headerRule
+	redirector        *redirector // nil unless recipients are redirected
+	journalDest       destination // nil unless journal_host is set
+	journalInclude    []addrPattern
+	mirrorDest        destination   // nil unless mirror_host is set
+	mirrorSlots       chan struct{} // one per pending mirrored delivery
+	mirrors           sync.WaitGroup
+	breaker           *circuitBreaker // nil unless the circuit breaker is enabled
+	responseMap       []*responseRule
 }
 
-func newRelay(ctx context.Context, cfg *config) (*relay, error) {
+// destinations are what relays deliver messages through. They are built once,
+// and shared by the relays of all the listeners and of the queue, so upstreams
+// get a single session pool, health state and probe each, and deliveries all
+// count towards the same circuit breaker.
+type destinations struct {
+	tokenSource oauth2.TokenSource // for remote_auth
+	remote      destination
+	transports  []*transport
+	journal     destination     // nil unless journal_host is set
+	mirror      destination     // nil unless mirror_host is set
+	mirrorSlots chan struct{}   // one per pending mirrored delivery
+	breaker     *circuitBreaker // nil unless the circuit breaker is enabled
+}
+
+// newDestinations builds and starts the destinations of remote_host,
+// transport_map, journal_host and mirror_host.
+func newDestinations(ctx context.Context, cfg *config) (*destinations, error) {
+	d := &destinations{
+		tokenSource: newOAuth2TokenSource(ctx, cfg, cfg.remoteAuth),
+		breaker:     newCircuitBreaker(cfg),
+	}
+
+	tokenSources := map[string]oauth2.TokenSource{cfg.remoteAuth: d.tokenSource}
+
+	var err error
+
+	d.remote, err = newDestination(ctx, cfg, splitstr(cfg.remoteHost, ' '), tokenSources)
+	if err != nil {
+		return nil, fmt.Errorf("remote_host: %w", err)
+	}
+
+	d.remote.start(ctx)
+
+	if cfg.journalHost != "" {
+		d.journal, err = newDestination(ctx, cfg, splitstr(cfg.journalHost, ' '), tokenSources)
+		if err != nil {
+			return nil, fmt.Errorf("journal_host: %w", err)
+		}
+
+		d.journal.start(ctx)
+	}
+
+	if cfg.mirrorHost != "" {
+		d.mirror, err = newDestination(ctx, cfg, splitstr(cfg.mirrorHost, ' '), tokenSources)
+		if err != nil {
+			return nil, fmt.Errorf("mirror_host: %w", err)
+		}
+
+		d.mirror.start(ctx)
+		d.mirrorSlots = make(chan struct{}, cfg.mirrorMaxPending)
+	}
+
+	if cfg.transportMap != "" {
+		d.transports, err = loadTransportMap(cfg.transportMap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load transport map %q: %w", cfg.transportMap, err)
+		}
+
+		for _, t := range d.transports {
+			t.dest, err = newDestination(ctx, cfg, t.upstreams, tokenSources)
+			if err != nil {
+				return nil, fmt.Errorf("transport map %q, pattern %q: %w", cfg.transportMap, t.pattern, err)
+			}
+
+			t.dest.start(ctx)
+		}
+	}
+
+	return d, nil
+}
+
+func newRelay(ctx context.Context, cfg *config, dests *destinations) (*relay, error) {
 	r := &relay{
-		cfg: cfg,
+		cfg:               cfg,
+		resolver:          defaultAuthResolver,
+		oauth2TokenSource: dests.tokenSource,
+		remote:            dests.remote,
+		transports:        dests.transports,
+		journalDest:       dests.journal,
+		mirrorDest:        dests.mirror,
+		mirrorSlots:       dests.mirrorSlots,
+		breaker:           dests.breaker,
 	}
 
 	r.server = &smtpd.Server{
 		HeloChecker:       r.heloChecker,
 		ConnectionChecker: r.connectionChecker(cfg.allowedNets),
-		SenderChecker:     r.senderChecker(cfg.allowedSender, cfg.allowedUsers),
+		SenderChecker:     r.circuitChecker(r.senderChecker(cfg.allowedSender, cfg.allowedUsers)),
 		RecipientChecker:  r.recipientChecker(cfg.allowedRecipients, cfg.deniedRecipients),
 		Handler:           r.mailHandler(cfg),
 
@@ -51,6 +147,8 @@ func newRelay(ctx context.Context, cfg *config) (*relay, error) {
 		MaxMessageSize: cfg.maxMessageSize,
 		MaxConnections: cfg.maxConnections,
 		MaxRecipients:  cfg.maxRecipients,
+		SpillSize:      cfg.spillSize,
+		SpillDir:       cfg.spillDir,
 		ReadTimeout:    cfg.readTimeout,
 		WriteTimeout:   cfg.writeTimeout,
 		DataTimeout:    cfg.dataTimeout,
@@ -69,7 +167,53 @@ func newRelay(ctx context.Context, cfg *config) (*relay, error) {
 		r.rateLimiter = newRateLimiter(cfg.rateLimitMessagesPerSecond, cfg.rateLimitBurst)
 	}
 
-	switch cfg.remoteAuth {
+	var err error
+
+	r.dkim, err = newDKIMSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("dkim_keys: %w", err)
+	}
+
+	if r.dkim != nil {
+		r.dkim.start(ctx)
+	}
+
+	r.rewriter, err = newSenderRewriter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.redirector, err = newRedirector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.journalInclude, err = parseJournalInclude(cfg.journalInclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.headerRules != "" {
+		r.headerRules, err = loadHeaderRules(cfg.headerRules)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load header rules %q: %w", cfg.headerRules, err)
+		}
+	}
+
+	if cfg.responseMap != "" {
+		r.responseMap, err = loadResponseMap(cfg.responseMap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load response map %q: %w", cfg.responseMap, err)
+		}
+	}
+
+	return r, nil
+}
+
+// newOAuth2TokenSource returns a token source for the given OAuth2 remote_auth
+// method, or nil for other methods.
+func newOAuth2TokenSource(ctx context.Context, cfg *config, method string) oauth2.TokenSource {
+	switch method {
 	case "xoauth2":
 		oauth2Config := &oauth2.Config{
 			ClientID:     cfg.xoauth2ClientID,
@@ -84,7 +228,7 @@ func newRelay(ctx context.Context, cfg *config) (*relay, error) {
 			RefreshToken: cfg.xoauth2RefreshToken,
 		}
 
-		r.oauth2TokenSource = oauth2.ReuseTokenSource(
+		return oauth2.ReuseTokenSource(
 			initialToken,
 			oauth2Config.TokenSource(ctx, initialToken))
 	case "xoauth2_client_credentials":
@@ -98,9 +242,10 @@ func newRelay(ctx context.Context, cfg *config) (*relay, error) {
 			TokenURL:     cfg.xoauth2TokenURL,
 			Scopes:       scopes,
 		}
-		r.oauth2TokenSource = oauth2.ReuseTokenSource(nil, ccConfig.TokenSource(ctx))
+		return oauth2.ReuseTokenSource(nil, ccConfig.TokenSource(ctx))
 	}
-	return r, nil
+
+	return nil
 }
 
 func (r *relay) serve(ctx context.Context, ln net.Listener) error {
@@ -123,8 +268,10 @@ func (r *relay) shutdown(ctx context.Context) error {
 	}
 
 	go func() {
-		// wait for the server to shut down, then cancel the context
+		// wait for the server and the mirrored deliveries to finish, then
+		// cancel the context
 		_ = r.server.Wait()
+		r.mirrors.Wait()
 
 		if ctx.Err() == nil {
 			cancel()
@@ -272,6 +419,14 @@ func (r *relay) recipientChecker(allowed, denied string) func(ctx context.Contex
 	log := slog.With(slog.String("component", "recipient_checker"))
 
 	return func(ctx context.Context, _ smtpd.Peer, addr string) error {
+		// bounces to forged or expired SRS addresses are refused early
+		if r.rewriter != nil {
+			if _, _, err := r.rewriter.reverse(addr, time.Now()); err != nil {
+				log.WarnContext(ctx, "invalid srs address", slog.String("address", addr), slog.Any("error", err))
+				return observeErr(ctx, errInvalidSRS)
+			}
+		}
+
 		// First, we check the deny list as that one takes precedence.
 		if denied != "" {
 			// TODO: precompile this regexp and reject it at config time
@@ -325,7 +480,7 @@ func (r *relay) mailHandler(cfg *config) func(ctx context.Context, peer smtpd.Pe
 				semconv.ClientAddress(peer.Addr.String()),
 				traceutil.Sender(env.Sender),
 				traceutil.Recipients(env.Recipients),
-				traceutil.DataSize(int64(len(env.Data))),
+				traceutil.DataSize(env.Size()),
 			),
 		)
 		defer span.End()
@@ -339,7 +494,7 @@ func (r *relay) mailHandler(cfg *config) func(ctx context.Context, peer smtpd.Pe
 		deliveryLog := logger.With(
 			slog.String("from", env.Sender),
 			slog.Any("to", env.Recipients),
-			slog.String("host", cfg.remoteHost),
+			slog.String("host", r.remote.String()),
 		)
 		deliveryLog = addLogHeaderFields(cfg.logHeaders, deliveryLog, env.Header)
 
@@ -377,68 +532,128 @@ func (r *relay) mailHandler(cfg *config) func(ctx context.Context, peer smtpd.Pe
 			}
 		}
 
-		var auth smtp.Auth
-		host, _, _ := net.SplitHostPort(cfg.remoteHost)
+		// verify before adding our own headers
+		if tperr := r.verifyInbound(ctx, peer, &env); tperr != nil {
+			statusCode = tperr.Code
 
-		hasUser := cfg.remoteUser != ""
-		canAuth := hasUser && (cfg.remotePass != "" || cfg.remoteAuth == "xoauth2" || cfg.remoteAuth == "xoauth2_client_credentials")
+			return observeErr(ctx, tperr)
+		}
 
-		if canAuth {
-			switch cfg.remoteAuth {
-			case "plain":
-				auth = smtp.PlainAuth("", cfg.remoteUser, cfg.remotePass, host)
-			case "xoauth2", "xoauth2_client_credentials":
-				var authToken *oauth2.Token
+		env.AddReceivedLine(peer)
 
-				authToken, err = r.oauth2TokenSource.Token()
-				if err != nil {
-					return fmt.Errorf("OAuth2 token fetching failed: %w", err)
-				}
+		r.rewriteHeaders(ctx, uniqueID, peer, &env)
+
+		sender := r.envelopeSender(ctx, env.Sender)
+
+		env.Recipients, err = r.reverseRecipients(ctx, env.Recipients)
+		if err != nil {
+			logger.WarnContext(ctx, "invalid srs recipient", slog.Any("error", err))
+
+			statusCode = errInvalidSRS.Code
+
+			return observeErr(ctx, errInvalidSRS)
+		}
+
+		r.redirect(ctx, &env)
+
+		// sign last, so the signature covers the message as relayed
+		if r.dkim != nil {
+			r.dkim.sign(ctx, &env)
+		}
+
+		msgSizeHistogram.Observe(float64(env.Size()))
+
+		// streamed from the envelope, which may have been spilled to disk
+		msg := envelopeMessage(&env)
 
-				auth = &xoauth2Auth{
-					user:  cfg.remoteUser,
-					token: authToken.AccessToken,
+		r.mirror(ctx, sender, env.Recipients, msg)
+
+		if r.queue != nil {
+			// spool each route separately, so they are retried independently
+			groups := r.route(env.Recipients)
+
+			for i, group := range groups {
+				id := uniqueID
+				if len(groups) > 1 {
+					id = fmt.Sprintf("%s-%d", uniqueID, i+1)
 				}
-			default:
-				logger.ErrorContext(ctx, "unsupported auth method", slog.String("method", cfg.remoteAuth))
 
-				statusCode = smtpd.ErrUnsupportedAuthMethod.Code
+				// streamed to the spool, rather than read in memory
+				err = r.queue.Enqueue(ctx, &spool.Message{
+					ID:             id,
+					Sender:         sender,
+					OriginalSender: env.Sender,
+					Recipients:     group.recipients,
+				}, msg.reader())
+				if err != nil {
+					logger.ErrorContext(ctx, "could not spool message", slog.Any("error", err))
+
+					statusCode = smtpd.ErrSpoolFailed.Code
 
-				return observeErr(ctx, smtpd.ErrUnsupportedAuthMethod)
+					return observeErr(ctx, smtpd.ErrSpoolFailed)
+				}
 			}
+
+			deliveryLog.InfoContext(ctx, "message spooled for delivery")
+
+			return nil
 		}
 
-		env.AddReceivedLine(peer)
+		// required reports are sent while the message can still be failed,
+		// listing the recipients it's about to be delivered to
+		if cfg.journalRequired {
+			if err := r.journal(ctx, uniqueID, env.Sender, env.Recipients, msg); err != nil {
+				statusCode = errJournalFailed.Code
+
+				return observeErr(ctx, errJournalFailed)
+			}
+		}
 
-		var sender string
+		err = r.deliver(ctx, sender, env.Recipients, msg)
 
-		if cfg.remoteSender == "" {
-			sender = env.Sender
-		} else {
-			sender = cfg.remoteSender
+		// recorded before the response map can change what counts as a
+		// failure of the upstreams
+		if r.breaker != nil {
+			r.breaker.record(ctx, time.Now(), err)
 		}
 
-		msgSizeHistogram.Observe(float64(len(env.Data)))
+		err = r.finishSend(ctx, sender, env.Recipients, msg, err)
 
-		err = smtp.SendMail(
-			cfg.remoteHost,
-			auth,
-			sender,
-			env.Recipients,
-			env.Data,
-		)
-		if err != nil {
-			err = fmt.Errorf("sendMail: %w", err)
+		var rerr *recipientsError
+		if errors.As(err, &rerr) {
+			rerr.log(ctx, deliveryLog)
+
+			// there's no way to tell the client only some recipients failed,
+			// so the message is accepted to avoid duplicates
+			if rerr.partial() {
+				deliveryLog.WarnContext(ctx, "delivery partially successful",
+					slog.Any("delivered", rerr.delivered), slog.Int("failed", len(rerr.failed)))
+
+				// nothing will retry the failed recipients, and the client
+				// wasn't told, so the sender is always notified they failed
+				r.notify(ctx, env.Sender, time.Now(), msg, rerr.failed)
 
+				// the message can't be failed anymore
+				if !cfg.journalRequired {
+					_ = r.journal(ctx, uniqueID, env.Sender, rerr.delivered, msg)
+				}
+
+				return nil
+			}
+		}
+
+		if err != nil {
 			var tperr *textproto.Error
 
+			failLog := logger.With(clientErrorAttrs(err)...)
+
 			if errors.As(err, &tperr) {
-				logger.ErrorContext(ctx, "delivery failed",
+				failLog.ErrorContext(ctx, "delivery failed",
 					slog.Int("err_code", tperr.Code), slog.String("err_msg", tperr.Msg))
 			} else {
 				tperr = smtpd.ErrForwardingFailed
 
-				logger.ErrorContext(ctx, "delivery failed", slog.Any("error", err))
+				failLog.ErrorContext(ctx, "delivery failed", slog.Any("error", err))
 			}
 
 			statusCode = tperr.Code
@@ -448,10 +663,69 @@ func (r *relay) mailHandler(cfg *config) func(ctx context.Context, peer smtpd.Pe
 
 		deliveryLog.InfoContext(ctx, "delivery successful", slog.Int("status_code", statusCode))
 
+		// the message can't be failed anymore
+		if !cfg.journalRequired {
+			_ = r.journal(ctx, uniqueID, env.Sender, env.Recipients, msg)
+		}
+
 		return nil
 	}
 }
 
+// send delivers a message to its destinations, routing recipients through the
+// transport map. Errors returned by the destinations are wrapped
+// *textproto.Error values, rewritten by the response map.
+func (r *relay) send(ctx context.Context, sender string, recipients []string, data *message) error {
+	return r.finishSend(ctx, sender, recipients, data, r.deliver(ctx, sender, recipients, data))
+}
+
+// deliver delivers a message to its destinations, routing recipients through
+// the transport map, and returns the errors of the destinations as they are.
+func (r *relay) deliver(ctx context.Context, sender string, recipients []string, data *message) error {
+	groups := r.route(recipients)
+	if len(groups) == 1 {
+		return r.sendGroup(ctx, groups[0], sender, data)
+	}
+
+	return r.sendRouted(ctx, groups, sender, data)
+}
+
+// finishSend rewrites the error of a delivery with the response map, and keeps
+// what was sent in the mail catcher.
+func (r *relay) finishSend(ctx context.Context, sender string, recipients []string, data *message, err error) error {
+	err = r.mapResponses(ctx, err)
+
+	// keep what was sent in the mail catcher
+	var rerr *recipientsError
+	if errors.As(err, &rerr) {
+		r.recordCaught(ctx, sender, rerr.delivered, data)
+	} else if err == nil {
+		r.recordCaught(ctx, sender, recipients, data)
+	}
+
+	if err != nil {
+		return fmt.Errorf("sendMail: %w", err)
+	}
+
+	return nil
+}
+
+// clientErrorAttrs returns log attributes describing where a session with an
+// upstream failed, if err comes from one.
+func clientErrorAttrs(err error) []any {
+	var cerr *smtpclient.Error
+	if !errors.As(err, &cerr) {
+		return nil
+	}
+
+	attrs := []any{slog.String("phase", string(cerr.Phase))}
+	if cerr.EnhancedCode != "" {
+		attrs = append(attrs, slog.String("enhanced_code", cerr.EnhancedCode))
+	}
+
+	return attrs
+}
+
 func observeErr(ctx context.Context, err *textproto.Error) error {
 	errorsCounter.WithLabelValues(strconv.Itoa(err.Code)).Inc()
 
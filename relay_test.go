@@ -9,6 +9,7 @@ import (
 	"net/textproto"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/smtprelay/v2/internal/smtpd"
 	"github.com/prometheus/client_golang/prometheus"
@@ -286,3 +287,31 @@ func TestAddrAllowedMixed(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestRelaysShareDestinations(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	cfg := &config{
+		remoteHost:             "smtp.example.com:587 smtp://backup.example.com:25",
+		remotePoolSize:         2,
+		circuitBreakerFailures: 3,
+		circuitBreakerWindow:   time.Minute,
+		circuitBreakerCooldown: time.Minute,
+	}
+
+	dests, err := newDestinations(ctx, cfg)
+	require.NoError(t, err)
+
+	r1, err := newRelay(ctx, cfg, dests)
+	require.NoError(t, err)
+
+	r2, err := newRelay(ctx, cfg, dests)
+	require.NoError(t, err)
+
+	// the listeners share the pools and health state of the upstreams, and
+	// their failures open the same circuit
+	assert.Same(t, r1.remote, r2.remote)
+	require.NotNil(t, r1.breaker)
+	assert.Same(t, r1.breaker, r2.breaker)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpd"
+)
+
+// responseRule rewrites the failures of deliveries matching its conditions.
+type responseRule struct {
+	// conditions, unset if empty or nil
+	code     string   // "550", "5xx" or "55x"
+	enhanced []string // "5", "7", "*"
+	message  *regexp.Regexp
+
+	// rewrites, unset if zero or empty
+	newCode     int
+	newEnhanced string
+	text        string
+	retry       *bool
+	class       string
+}
+
+// mappedError is an upstream failure rewritten by a response rule. It's
+// replied to clients as its reply, while the original error stays in the
+// chain.
+type mappedError struct {
+	reply *textproto.Error
+	err   error
+}
+
+func (e *mappedError) Error() string {
+	return fmt.Sprintf("%d %s (upstream: %v)", e.reply.Code, e.reply.Msg, e.err)
+}
+
+func (e *mappedError) Unwrap() []error {
+	return []error{e.reply, e.err}
+}
+
+// loadResponseMap loads the response rules from a file.
+func loadResponseMap(path string) ([]*responseRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseResponseMap(f)
+}
+
+// parseResponseMap parses response rules, one per line, the first matching
+// rule applying:
+//
+//	CONDITION... -> REWRITE...
+//
+// Conditions are code=CODE, where 'x' matches any digit ("550", "5xx"),
+// enhanced=CODE, where '*' matches any part ("5.7.*"), and
+// message=/REGEXP/, matched against the reply text, or the error of failures
+// without a reply (connection failures). A single "*" matches any failure.
+//
+// Rewrites are code=CODE, enhanced=CODE, text=TEXT, replacing the reply
+// text but its enhanced code, retry=true|false, making the failure temporary
+// or permanent (4xx or 5xx), and class=NAME, the class of the failure in the
+// metrics. Failures without a reply are rewritten as "554 Forwarding failed"
+// replies. Tokens with spaces can be written as Go quoted strings
+// (text="Mailbox unavailable"). Empty lines and lines starting with '#' are
+// ignored.
+func parseResponseMap(r io.Reader) ([]*responseRule, error) {
+	rules := []*responseRule{}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseResponseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseResponseRule(line string) (*responseRule, error) {
+	tokens, err := splitTokens(line)
+	if err != nil {
+		return nil, err
+	}
+
+	arrow := -1
+
+	for i, token := range tokens {
+		if token == "->" {
+			arrow = i
+			break
+		}
+	}
+
+	if arrow < 1 || arrow == len(tokens)-1 {
+		return nil, errors.New("expected CONDITION... -> REWRITE...")
+	}
+
+	rule := &responseRule{}
+
+	conds := tokens[:arrow]
+	if len(conds) == 1 && conds[0] == "*" {
+		conds = nil
+	}
+
+	for _, token := range conds {
+		if err := rule.parseCondition(token); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, token := range tokens[arrow+1:] {
+		if err := rule.parseRewrite(token); err != nil {
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+func (rule *responseRule) parseCondition(token string) error {
+	key, value, ok := strings.Cut(token, "=")
+	if !ok {
+		return fmt.Errorf("invalid condition %q", token)
+	}
+
+	switch key {
+	case "code":
+		if len(value) != 3 || strings.Trim(value, "0123456789x") != "" || value[0] == 'x' {
+			return fmt.Errorf("invalid code %q", value)
+		}
+
+		rule.code = value
+	case "enhanced":
+		parts := strings.Split(value, ".")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid enhanced code %q", value)
+		}
+
+		for _, part := range parts {
+			if _, err := strconv.Atoi(part); err != nil && part != "*" {
+				return fmt.Errorf("invalid enhanced code %q", value)
+			}
+		}
+
+		rule.enhanced = parts
+	case "message":
+		re, err := parseSlashRegexp(value)
+		if err != nil {
+			return err
+		}
+
+		rule.message = re
+	default:
+		return fmt.Errorf("unknown condition %q", key)
+	}
+
+	return nil
+}
+
+func (rule *responseRule) parseRewrite(token string) error {
+	key, value, ok := strings.Cut(token, "=")
+	if !ok {
+		return fmt.Errorf("invalid rewrite %q", token)
+	}
+
+	switch key {
+	case "code":
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 400 || code > 599 {
+			return fmt.Errorf("invalid code %q, must be 4xx or 5xx", value)
+		}
+
+		rule.newCode = code
+	case "enhanced":
+		if !dsnStatusRe.MatchString(value) {
+			return fmt.Errorf("invalid enhanced code %q", value)
+		}
+
+		rule.newEnhanced = value
+	case "text":
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid text %q", value)
+		}
+
+		rule.text = value
+	case "retry":
+		retry, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid retry %q: %w", value, err)
+		}
+
+		rule.retry = &retry
+	case "class":
+		if value == "" {
+			return errors.New("empty class")
+		}
+
+		rule.class = value
+	default:
+		return fmt.Errorf("unknown rewrite %q", key)
+	}
+
+	return nil
+}
+
+// matches reports whether the rule applies to a failure, with reply tperr, if
+// any.
+func (rule *responseRule) matches(err error, tperr *textproto.Error) bool {
+	if tperr == nil {
+		if rule.code != "" || rule.enhanced != nil {
+			return false
+		}
+
+		return rule.message == nil || rule.message.MatchString(err.Error())
+	}
+
+	if rule.code != "" {
+		code := strconv.Itoa(tperr.Code)
+		if len(code) != 3 {
+			return false
+		}
+
+		for i := range 3 {
+			if rule.code[i] != 'x' && rule.code[i] != code[i] {
+				return false
+			}
+		}
+	}
+
+	if rule.enhanced != nil {
+		enhanced, _, _ := splitEnhancedCode(tperr.Msg)
+
+		parts := strings.Split(enhanced, ".")
+		if len(parts) != 3 {
+			return false
+		}
+
+		for i, part := range rule.enhanced {
+			if part != "*" && part != parts[i] {
+				return false
+			}
+		}
+	}
+
+	return rule.message == nil || rule.message.MatchString(tperr.Msg)
+}
+
+// rewrite returns the reply to a failure, with reply tperr, if any.
+func (rule *responseRule) rewrite(tperr *textproto.Error) *textproto.Error {
+	if tperr == nil {
+		tperr = smtpd.ErrForwardingFailed
+	}
+
+	code := tperr.Code
+	enhanced, text, _ := splitEnhancedCode(tperr.Msg)
+
+	if rule.newCode != 0 {
+		code = rule.newCode
+	}
+
+	if rule.retry != nil {
+		switch {
+		case *rule.retry && code >= 500:
+			code -= 100
+		case !*rule.retry && code < 500:
+			code += 100
+		}
+	}
+
+	if rule.newEnhanced != "" {
+		enhanced = rule.newEnhanced
+	}
+
+	// the class of the enhanced code must match the code's
+	if enhanced != "" {
+		enhanced = strconv.Itoa(code/100) + enhanced[1:]
+	}
+
+	if rule.text != "" {
+		text = rule.text
+	}
+
+	msg := text
+	if enhanced != "" {
+		msg = strings.TrimSpace(enhanced + " " + text)
+	}
+
+	return &textproto.Error{Code: code, Msg: msg}
+}
+
+// rewrites reports whether the rule rewrites the replies, rather than only
+// classifying them.
+func (rule *responseRule) rewrites() bool {
+	return rule.newCode != 0 || rule.newEnhanced != "" || rule.text != "" || rule.retry != nil
+}
+
+// splitEnhancedCode splits the enhanced status code (RFC 3463) at the start of
+// a reply text from the rest of the text.
+func splitEnhancedCode(msg string) (enhanced, text string, ok bool) {
+	m := dsnStatusRe.FindStringSubmatchIndex(msg)
+	if m == nil {
+		return "", msg, false
+	}
+
+	return msg[m[2]:m[3]], msg[m[1]:], true
+}
+
+// mapResponse rewrites a delivery failure with the first matching response
+// rule, and counts it by class: the rule's class, or "temporary",
+// "permanent" or "error" (no reply) otherwise.
+func (r *relay) mapResponse(ctx context.Context, err error) error {
+	var tperr *textproto.Error // nil for failures without a reply
+	errors.As(err, &tperr)
+
+	class := ""
+
+	for _, rule := range r.responseMap {
+		if !rule.matches(err, tperr) {
+			continue
+		}
+
+		if rule.rewrites() {
+			reply := rule.rewrite(tperr)
+
+			slog.DebugContext(ctx, "upstream response mapped", slog.String("component", "response_map"),
+				slog.Any("error", err), slog.Int("err_code", reply.Code), slog.String("err_msg", reply.Msg))
+
+			err = &mappedError{reply: reply, err: err}
+			tperr = reply
+		}
+
+		class = rule.class
+
+		break
+	}
+
+	if class == "" {
+		switch {
+		case tperr == nil:
+			class = "error"
+		case isPermanent(tperr):
+			class = "permanent"
+		default:
+			class = "temporary"
+		}
+	}
+
+	upstreamFailures.WithLabelValues(class).Inc()
+
+	return err
+}
+
+// mapResponses maps the failures of a delivery, to each of the failed
+// recipients if it was partial.
+func (r *relay) mapResponses(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var rerr *recipientsError
+	if !errors.As(err, &rerr) {
+		return r.mapResponse(ctx, err)
+	}
+
+	mapped := &recipientsError{
+		delivered: rerr.delivered,
+		failed:    make([]rcptFailure, len(rerr.failed)),
+	}
+
+	for i, f := range rerr.failed {
+		mapped.failed[i] = rcptFailure{rcpt: f.rcpt, err: r.mapResponse(ctx, f.err)}
+	}
+
+	return mapped
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseMap(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseResponseMap(strings.NewReader(`
+# hide the provider's internals
+code=5xx message=/quota/ -> retry=true text="Mailbox full" class=quota
+code=550 enhanced=5.7.* -> code=554 enhanced=5.7.1 text="Rejected by policy"
+code=421 -> class=throttled
+message="/connection refused/" -> code=451 text="Upstream unavailable"
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+
+	r := &relay{responseMap: rules}
+
+	tests := []struct {
+		name string
+		err  error
+		want *textproto.Error // nil if not rewritten
+	}{
+		{
+			name: "retried",
+			err:  &textproto.Error{Code: 552, Msg: "5.2.2 Mailbox over quota (mx42.internal)"},
+			want: &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"},
+		},
+		{
+			name: "rewritten",
+			err:  &textproto.Error{Code: 550, Msg: "5.7.26 Unauthenticated email from example.com"},
+			want: &textproto.Error{Code: 554, Msg: "5.7.1 Rejected by policy"},
+		},
+		{
+			name: "classified only",
+			err:  &textproto.Error{Code: 421, Msg: "4.7.0 Try again later"},
+		},
+		{
+			name: "not matched",
+			err:  &textproto.Error{Code: 550, Msg: "5.1.1 No such user"},
+		},
+		{
+			name: "without a reply",
+			err:  &upstreamError{addr: "smtp.example.com:25", err: errors.New("dial tcp: connection refused")},
+			want: &textproto.Error{Code: 451, Msg: "Upstream unavailable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := r.mapResponse(t.Context(), tt.err)
+
+			if tt.want == nil {
+				assert.Same(t, tt.err, err)
+				return
+			}
+
+			var tperr *textproto.Error
+			require.ErrorAs(t, err, &tperr)
+			assert.Equal(t, tt.want, tperr)
+
+			// the original error is kept
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	t.Run("partial", func(t *testing.T) {
+		t.Parallel()
+
+		err := r.mapResponses(t.Context(), &recipientsError{
+			delivered: []string{"alice@example.com"},
+			failed: []rcptFailure{
+				{rcpt: "bob@example.com", err: &textproto.Error{Code: 552, Msg: "5.2.2 Over quota"}},
+				{rcpt: "carol@example.com", err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}},
+			},
+		})
+
+		var rerr *recipientsError
+		require.ErrorAs(t, err, &rerr)
+		assert.Equal(t, []string{"alice@example.com"}, rerr.delivered)
+		require.Len(t, rerr.failed, 2)
+		assert.False(t, isPermanent(rerr.failed[0].err))
+		assert.True(t, isPermanent(rerr.failed[1].err))
+	})
+}
+
+func TestParseResponseMapErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, line := range []string{
+		"code=550",
+		"-> retry=true",
+		"code=550 ->",
+		"code=5 -> retry=true",
+		"code=x50 -> retry=true",
+		"enhanced=5.7 -> retry=true",
+		"message=quota -> retry=true",
+		"status=550 -> retry=true",
+		"code=550 -> code=250",
+		"code=550 -> enhanced=5.7",
+		"code=550 -> retry=maybe",
+		"code=550 -> class=",
+		"code=550 -> text=",
+		`code=550 -> text="unterminated`,
+		"code=550 -> bounce=true",
+	} {
+		_, err := parseResponseMap(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
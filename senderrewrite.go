@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/smtprelay/v2/internal/srs"
+	"github.com/grafana/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errInvalidSRS = &textproto.Error{Code: 550, Msg: "5.1.1 Invalid or expired SRS address"}
+
+// senderRule rewrites the envelope senders matching a pattern.
+type senderRule struct {
+	addrPattern
+
+	replacement string
+}
+
+// loadSenderRewriteMap reads a sender rewrite map file.
+func loadSenderRewriteMap(path string) ([]*senderRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseSenderRewriteMap(f)
+}
+
+// parseSenderRewriteMap parses a sender rewrite map. Each line is made of a
+// pattern (see addrPattern) and a replacement address. With a regular
+// expression, the replacement can refer to its groups ("$1@example.com");
+// otherwise, a replacement starting with '@' only replaces the domain. The
+// first matching line wins. Empty lines and lines starting with '#' are
+// ignored.
+func parseSenderRewriteMap(r io.Reader) ([]*senderRule, error) {
+	rules := []*senderRule{}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a pattern and a replacement", lineno)
+		}
+
+		pattern, err := parseAddrPattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+
+		rules = append(rules, &senderRule{addrPattern: pattern, replacement: fields[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// rewrite returns the address rewritten by the rule.
+func (rule *senderRule) rewrite(addr string) string {
+	if rule.re != nil {
+		return rule.re.ReplaceAllString(addr, rule.replacement)
+	}
+
+	if strings.HasPrefix(rule.replacement, "@") {
+		local, _, _ := strings.Cut(addr, "@")
+
+		return local + rule.replacement
+	}
+
+	return rule.replacement
+}
+
+// senderRewriter rewrites envelope senders with the rules of
+// sender_rewrite_map, then with SRS.
+type senderRewriter struct {
+	rules   []*senderRule
+	srs     *srs.Rewriter // nil unless SRS is enabled
+	exclude []string      // sender domains not rewritten with SRS
+}
+
+// validateSenderRewrite checks the sender rewriting settings.
+func validateSenderRewrite(cfg *config) error {
+	_, err := newSenderRewriter(cfg)
+
+	return err
+}
+
+// newSenderRewriter returns a rewriter for the sender_rewrite_map and srs_*
+// settings, or nil if senders aren't rewritten.
+func newSenderRewriter(cfg *config) (*senderRewriter, error) {
+	if cfg.senderRewriteMap == "" && cfg.srsDomain == "" {
+		return nil, nil
+	}
+
+	s := &senderRewriter{}
+
+	if cfg.senderRewriteMap != "" {
+		rules, err := loadSenderRewriteMap(cfg.senderRewriteMap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load sender rewrite map %q: %w", cfg.senderRewriteMap, err)
+		}
+
+		s.rules = rules
+	}
+
+	if cfg.srsDomain != "" {
+		secrets := splitstr(cfg.srsSecret, ' ')
+		if len(secrets) == 0 {
+			return nil, errors.New("srs_secret must be set with srs_domain")
+		}
+
+		if cfg.srsMaxAge <= 0 {
+			return nil, errors.New("srs_max_age must be positive")
+		}
+
+		s.srs = &srs.Rewriter{Domain: strings.ToLower(cfg.srsDomain), Secrets: secrets, MaxAge: cfg.srsMaxAge}
+
+		for _, domain := range splitstr(cfg.srsExcludeDomains, ' ') {
+			s.exclude = append(s.exclude, strings.ToLower(domain))
+		}
+	}
+
+	return s, nil
+}
+
+// rewrite returns the rewritten envelope sender. Null senders aren't
+// rewritten.
+func (s *senderRewriter) rewrite(sender string, now time.Time) (string, error) {
+	if sender == "" {
+		return sender, nil
+	}
+
+	for _, rule := range s.rules {
+		if rule.matches(sender) {
+			sender = rule.rewrite(sender)
+			break
+		}
+	}
+
+	if s.srs == nil {
+		return sender, nil
+	}
+
+	_, domain, _ := strings.Cut(sender, "@")
+	if slices.Contains(s.exclude, strings.ToLower(domain)) {
+		return sender, nil
+	}
+
+	return s.srs.Forward(sender, now)
+}
+
+// reverse decodes an SRS address of srs_domain. It reports false if the
+// address isn't one.
+func (s *senderRewriter) reverse(addr string, now time.Time) (string, bool, error) {
+	if s.srs == nil || !srs.IsSRS(addr) {
+		return "", false, nil
+	}
+
+	_, domain, _ := strings.Cut(addr, "@")
+	if !strings.EqualFold(domain, s.srs.Domain) {
+		return "", false, nil
+	}
+
+	orig, err := s.srs.Reverse(addr, now)
+
+	return orig, true, err
+}
+
+// envelopeSender returns the envelope sender to relay a message from sender
+// with: remote_sender if set, or the rewritten sender.
+func (r *relay) envelopeSender(ctx context.Context, sender string) string {
+	if r.cfg.remoteSender != "" {
+		return r.cfg.remoteSender
+	}
+
+	if r.rewriter == nil {
+		return sender
+	}
+
+	logger := slog.With(slog.String("component", "sender_rewrite"), slog.String("sender", sender))
+
+	rewritten, err := r.rewriter.rewrite(sender, time.Now())
+	if err != nil {
+		logger.WarnContext(ctx, "could not rewrite sender, keeping it", slog.Any("error", err))
+		return sender
+	}
+
+	if rewritten != sender {
+		logger.InfoContext(ctx, "sender rewritten", slog.String("rewritten", rewritten))
+		trace.SpanFromContext(ctx).SetAttributes(traceutil.RewrittenSender(rewritten))
+	}
+
+	return rewritten
+}
+
+// reverseRecipients decodes the SRS addresses of srs_domain among the
+// recipients, so bounces reach the original senders.
+func (r *relay) reverseRecipients(ctx context.Context, recipients []string) ([]string, error) {
+	if r.rewriter == nil {
+		return recipients, nil
+	}
+
+	reversed := make([]string, 0, len(recipients))
+
+	for _, rcpt := range recipients {
+		orig, ok, err := r.rewriter.reverse(rcpt, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rcpt, err)
+		}
+
+		if ok {
+			slog.InfoContext(ctx, "srs recipient decoded", slog.String("component", "sender_rewrite"),
+				slog.String("recipient", rcpt), slog.String("decoded", orig))
+
+			rcpt = orig
+		}
+
+		reversed = append(reversed, rcpt)
+	}
+
+	return reversed, nil
+}
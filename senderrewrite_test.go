@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSenderRewriteMap(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseSenderRewriteMap(strings.NewReader(`
+# per-app bounce addresses
+/^(.+)@apps\.internal$/  bounces+$1@example.com
+.corp.example            @example.com
+legacy.example           noreply@example.com
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	for addr, want := range map[string]string{
+		"billing@apps.internal":   "bounces+billing@example.com",
+		"bob@eu.corp.example":     "bob@example.com",
+		"alice@legacy.example":    "noreply@example.com",
+		"carol@unrelated.example": "carol@unrelated.example",
+	} {
+		got := addr
+
+		for _, rule := range rules {
+			if rule.matches(addr) {
+				got = rule.rewrite(addr)
+				break
+			}
+		}
+
+		assert.Equal(t, want, got, addr)
+	}
+
+	for _, bad := range []string{"example.com", "example.com a@b c@d", "/(/ a@b"} {
+		_, err := parseSenderRewriteMap(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSenderRewriter(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "sender_rewrite")
+	require.NoError(t, os.WriteFile(path, []byte("apps.internal @example.com\n"), 0o600))
+
+	cfg := &config{
+		senderRewriteMap:  path,
+		srsDomain:         "Relay.example.org",
+		srsSecret:         "new old",
+		srsMaxAge:         time.Hour,
+		srsExcludeDomains: "Example.com",
+	}
+
+	s, err := newSenderRewriter(cfg)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// rules apply first, and excluded domains aren't rewritten with SRS
+	rewritten, err := s.rewrite("billing@apps.internal", now)
+	require.NoError(t, err)
+	assert.Equal(t, "billing@example.com", rewritten)
+
+	rewritten, err = s.rewrite("bob@example.net", now)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rewritten, "SRS0="))
+	assert.True(t, strings.HasSuffix(rewritten, "=example.net=bob@relay.example.org"))
+
+	null, err := s.rewrite("", now)
+	require.NoError(t, err)
+	assert.Empty(t, null)
+
+	orig, ok, err := s.reverse(strings.ToUpper(rewritten), now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "BOB@EXAMPLE.NET", orig)
+
+	_, ok, err = s.reverse(rewritten, now.Add(2*24*time.Hour))
+	require.Error(t, err)
+	assert.True(t, ok)
+
+	// other addresses aren't SRS addresses of the relay
+	for _, addr := range []string{"bob@relay.example.org", strings.Replace(rewritten, "relay.example.org", "other.example", 1)} {
+		_, ok, err := s.reverse(addr, now)
+		require.NoError(t, err)
+		assert.False(t, ok, addr)
+	}
+
+	// remote_sender takes precedence
+	r := &relay{cfg: &config{}, rewriter: s}
+	assert.Equal(t, "billing@example.com", r.envelopeSender(t.Context(), "billing@apps.internal"))
+
+	r.cfg.remoteSender = "fixed@example.com"
+	assert.Equal(t, "fixed@example.com", r.envelopeSender(t.Context(), "billing@apps.internal"))
+
+	recipients, err := r.reverseRecipients(t.Context(), []string{"alice@example.com", rewritten})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.net"}, recipients)
+
+	_, err = r.reverseRecipients(t.Context(), []string{"SRS0=AAAA=AA=example.net=bob@relay.example.org"})
+	require.Error(t, err)
+}
+
+func TestValidateSenderRewrite(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateSenderRewrite(&config{}))
+	require.NoError(t, validateSenderRewrite(&config{srsDomain: "example.org", srsSecret: "s", srsMaxAge: time.Hour}))
+	require.Error(t, validateSenderRewrite(&config{srsDomain: "example.org", srsMaxAge: time.Hour}))
+	require.Error(t, validateSenderRewrite(&config{srsDomain: "example.org", srsSecret: "s"}))
+	require.Error(t, validateSenderRewrite(&config{senderRewriteMap: filepath.Join(t.TempDir(), "missing")}))
+}
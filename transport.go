@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// addrPattern matches addresses, as written in map files: a domain
+// ("example.com"), a parent domain matching all its subdomains
+// (".example.com"), a regular expression matched against the whole address
+// ("/^.+@example\.com$/"), or "*" to match everything.
+type addrPattern struct {
+	pattern string         // as written in the map
+	domain  string         // exact domain, or parent domain if prefixed with "."
+	re      *regexp.Regexp // matched against the whole address
+}
+
+// transport routes recipients matching a pattern to their own upstreams.
+type transport struct {
+	addrPattern
+
+	upstreams []string // upstream specs, as in remote_host
+	sender    string   // envelope sender override, if not empty
+
+	dest destination
+}
+
+// routeGroup is a set of recipients to be delivered through the same
+// transport. A nil transport means the default remote_host.
+type routeGroup struct {
+	transport  *transport
+	recipients []string
+}
+
+// loadTransportMap reads a transport map file.
+func loadTransportMap(path string) ([]*transport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseTransportMap(f)
+}
+
+// parseTransportMap parses a transport map. Each line is made of a pattern, a
+// comma-separated list of upstreams (in the remote_host syntax) tried in
+// order, and an optional envelope sender to use for these recipients. The
+// first line with a matching pattern (see addrPattern) wins; recipients not
+// matching any line are relayed to remote_host. Empty lines and lines
+// starting with '#' are ignored.
+func parseTransportMap(r io.Reader) ([]*transport, error) {
+	transports := []*transport{}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected a pattern, upstreams and an optional sender", lineno)
+		}
+
+		pattern, err := parseAddrPattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+
+		t := &transport{
+			addrPattern: pattern,
+			upstreams:   splitstr(fields[1], ','),
+		}
+
+		if len(fields) == 3 {
+			t.sender = fields[2]
+		}
+
+		transports = append(transports, t)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return transports, nil
+}
+
+// parseAddrPattern parses an address pattern of a map file.
+func parseAddrPattern(pattern string) (addrPattern, error) {
+	p := addrPattern{pattern: pattern}
+
+	switch {
+	case pattern == "*":
+		p.re = regexp.MustCompile(".*")
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return p, err
+		}
+
+		p.re = re
+	default:
+		p.domain = strings.ToLower(pattern)
+	}
+
+	return p, nil
+}
+
+// matches reports whether the address matches the pattern.
+func (p *addrPattern) matches(addr string) bool {
+	if p.re != nil {
+		return p.re.MatchString(addr)
+	}
+
+	idx := strings.LastIndex(addr, "@")
+	if idx == -1 {
+		return false
+	}
+
+	domain := strings.ToLower(addr[idx+1:])
+
+	if strings.HasPrefix(p.domain, ".") {
+		return strings.HasSuffix(domain, p.domain)
+	}
+
+	return domain == p.domain
+}
+
+// route splits the recipients into groups sharing the same transport, in
+// order of first appearance.
+func (r *relay) route(recipients []string) []routeGroup {
+	groups := []routeGroup{}
+	index := map[*transport]int{}
+
+	for _, rcpt := range recipients {
+		var match *transport
+
+		for _, t := range r.transports {
+			if t.matches(rcpt) {
+				match = t
+				break
+			}
+		}
+
+		i, ok := index[match]
+		if !ok {
+			i = len(groups)
+			index[match] = i
+			groups = append(groups, routeGroup{transport: match})
+		}
+
+		groups[i].recipients = append(groups[i].recipients, rcpt)
+	}
+
+	return groups
+}
+
+// sendGroup delivers the message to the recipients of a group, through the
+// group's transport.
+func (r *relay) sendGroup(ctx context.Context, group routeGroup, sender string, data *message) error {
+	dest := r.remote
+
+	if t := group.transport; t != nil {
+		dest = t.dest
+		if t.sender != "" {
+			sender = t.sender
+		}
+	}
+
+	return dest.send(ctx, sender, group.recipients, data)
+}
+
+// sendRouted delivers the message to several groups of recipients, and
+// combines the results into a single error.
+func (r *relay) sendRouted(ctx context.Context, groups []routeGroup, sender string, data *message) error {
+	recipients := make([][]string, 0, len(groups))
+	errs := make([]error, 0, len(groups))
+
+	for _, group := range groups {
+		pattern := "default"
+		if group.transport != nil {
+			pattern = group.transport.pattern
+		}
+
+		gctx, span := tracer.Start(ctx, "relay.route",
+			trace.WithAttributes(
+				attribute.String("smtp.route", pattern),
+				attribute.StringSlice("smtp.recipients", group.recipients),
+			),
+		)
+
+		err := r.sendGroup(gctx, group, sender, data)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			err = fmt.Errorf("route %q: %w", pattern, err)
+		}
+
+		recipients = append(recipients, group.recipients)
+		errs = append(errs, err)
+
+		span.End()
+	}
+
+	return combineResults(recipients, errs)
+}
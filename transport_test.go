@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransportMap(t *testing.T) {
+	t.Parallel()
+
+	transports, err := parseTransportMap(strings.NewReader(`
+# internal domains
+example.com      internal.example.com:25
+.corp.example    smtp://relay1.corp.example:25,smtp://relay2.corp.example:25  noreply@corp.example
+/^ops-.*@/       ops.example.com:2525
+*                fallback.example.com:587
+`))
+	require.NoError(t, err)
+	require.Len(t, transports, 4)
+
+	assert.Equal(t, "example.com", transports[0].domain)
+	assert.Equal(t, []string{"internal.example.com:25"}, transports[0].upstreams)
+	assert.Empty(t, transports[0].sender)
+
+	assert.Equal(t, ".corp.example", transports[1].domain)
+	assert.Equal(t, []string{"smtp://relay1.corp.example:25", "smtp://relay2.corp.example:25"}, transports[1].upstreams)
+	assert.Equal(t, "noreply@corp.example", transports[1].sender)
+
+	assert.NotNil(t, transports[2].re)
+	assert.NotNil(t, transports[3].re)
+
+	for _, bad := range []string{
+		"example.com",
+		"example.com host:25 sender@example.com extra",
+		"/[/ host:25",
+	} {
+		_, err := parseTransportMap(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestTransportMatches(t *testing.T) {
+	t.Parallel()
+
+	transports, err := parseTransportMap(strings.NewReader(`
+example.com    a:25
+.example.org   b:25
+/^ops-.*@/     c:25
+`))
+	require.NoError(t, err)
+
+	domain, parent, re := transports[0], transports[1], transports[2]
+
+	assert.True(t, domain.matches("alice@example.com"))
+	assert.True(t, domain.matches("alice@EXAMPLE.com"))
+	assert.False(t, domain.matches("alice@sub.example.com"))
+	assert.False(t, domain.matches("example.com"))
+
+	assert.True(t, parent.matches("alice@sub.example.org"))
+	assert.True(t, parent.matches("alice@a.b.example.org"))
+	assert.False(t, parent.matches("alice@example.org"))
+	assert.False(t, parent.matches("alice@badexample.org"))
+
+	assert.True(t, re.matches("ops-team@example.net"))
+	assert.False(t, re.matches("dev-team@example.net"))
+}
+
+func TestRoute(t *testing.T) {
+	t.Parallel()
+
+	transports, err := parseTransportMap(strings.NewReader(`
+example.com    a:25
+example.org    b:25
+`))
+	require.NoError(t, err)
+
+	r := &relay{transports: transports}
+
+	groups := r.route([]string{
+		"alice@example.com",
+		"bob@elsewhere.net",
+		"carol@example.org",
+		"dave@example.com",
+	})
+
+	require.Len(t, groups, 3)
+	assert.Equal(t, transports[0], groups[0].transport)
+	assert.Equal(t, []string{"alice@example.com", "dave@example.com"}, groups[0].recipients)
+	assert.Nil(t, groups[1].transport)
+	assert.Equal(t, []string{"bob@elsewhere.net"}, groups[1].recipients)
+	assert.Equal(t, transports[1], groups[2].transport)
+	assert.Equal(t, []string{"carol@example.org"}, groups[2].recipients)
+
+	// without a transport map, everything goes to the default route
+	groups = (&relay{}).route([]string{"alice@example.com", "bob@example.org"})
+	require.Len(t, groups, 1)
+	assert.Nil(t, groups[0].transport)
+}
+
+//nolint:paralleltest
+func TestSendMailTransportMap(t *testing.T) {
+	ctx := t.Context()
+
+	defaultSrv := startTestSMTPServer(ctx, t)
+	internalSrv := startTestSMTPServer(ctx, t)
+
+	transportMap := filepath.Join(t.TempDir(), "transport")
+	err := os.WriteFile(transportMap, []byte("internal.example "+internalSrv.addr+" noreply@internal.example\n"), 0o600)
+	require.NoError(t, err)
+
+	addr := startRelayWithConfig(ctx, t, defaultSrv.addr, func(cfg *config) {
+		cfg.transportMap = transportMap
+	})
+
+	err = sendMsg(t, addr, []string{"alice@example.com", "bob@internal.example", "carol@internal.example"},
+		"dave@example.com", "routed message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, defaultSrv.messages(), 1)
+	assert.Equal(t, "dave@example.com", defaultSrv.messages()[0].Sender)
+	assert.Equal(t, []string{"alice@example.com"}, defaultSrv.messages()[0].Recipients)
+
+	require.Len(t, internalSrv.messages(), 1)
+	assert.Equal(t, "noreply@internal.example", internalSrv.messages()[0].Sender)
+	assert.Equal(t, []string{"bob@internal.example", "carol@internal.example"}, internalSrv.messages()[0].Recipients)
+	assert.Equal(t, "routed message", internalSrv.messages()[0].Header.Get("Subject"))
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"net/smtp"
+
+	"github.com/grafana/smtprelay/v2/internal/smtpclient"
 )
 
 type xoauth2Auth struct {
@@ -11,7 +12,7 @@ type xoauth2Auth struct {
 	token string
 }
 
-func (a *xoauth2Auth) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+func (a *xoauth2Auth) Start(_ *smtpclient.ServerInfo) (string, []byte, error) {
 	// XOAUTH2 expects: user={email}\001auth=Bearer {token}\001\001
 	resp := []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.user, a.token))
 	return "XOAUTH2", resp, nil
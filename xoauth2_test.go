@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"net/smtp"
 	"testing"
 
+	"github.com/grafana/smtprelay/v2/internal/smtpclient"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,7 +16,7 @@ func Test_xoauth2Auth_Start(t *testing.T) {
 		token: "abcdef",
 	}
 
-	gotAuth, gotPayload, gotErr := a.Start(&smtp.ServerInfo{})
+	gotAuth, gotPayload, gotErr := a.Start(&smtpclient.ServerInfo{})
 
 	// XOAUTH2 expects: user={email}\001auth=Bearer {token}\001\001
 	wantPayload := []byte("user=test@example.com\001auth=Bearer abcdef\001\001")